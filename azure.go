@@ -0,0 +1,302 @@
+package sqltocsvgzip
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const azureAPIVersion = "2020-10-02"
+
+// AzureBlobSink uploads to Azure Blob Storage as a block blob.
+// Parts are uploaded concurrently as blocks and committed with a block list.
+//
+// Authenticate with either AccountKey (Shared Key) or SASToken.
+type AzureBlobSink struct {
+	Account    string
+	AccountKey string // Base64 encoded storage account key
+	SASToken   string // Shared access signature, used instead of AccountKey if set
+	Container  string
+	Blob       string
+	Endpoint   string       // Default is https://<Account>.blob.core.windows.net. e.g. http://127.0.0.1:10000/devstoreaccount1 for Azurite
+	Client     *http.Client // Default is http.DefaultClient
+
+	mu          sync.Mutex
+	blockIDs    map[int64]string
+	contentType string
+}
+
+// NewAzureBlobSink returns an AzureBlobSink uploading to container/blob
+// using Shared Key authentication.
+func NewAzureBlobSink(account, accountKey, container, blob string) *AzureBlobSink {
+	return &AzureBlobSink{
+		Account:    account,
+		AccountKey: accountKey,
+		Container:  container,
+		Blob:       blob,
+	}
+}
+
+// Create prepares the block list. Blocks do not need a session.
+func (a *AzureBlobSink) Create(contentType string) error {
+	if a.AccountKey == "" && a.SASToken == "" {
+		return fmt.Errorf("Either AccountKey or SASToken is needed to upload to Azure Blob Storage")
+	}
+	a.blockIDs = make(map[int64]string)
+	a.contentType = contentType
+	return nil
+}
+
+// UploadPart uploads buf as an uncommitted block.
+func (a *AzureBlobSink) UploadPart(partNumber int64, buf []byte, checksum PartChecksum) error {
+	// Block IDs must have the same length within a blob
+	blockID := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%010d", partNumber)))
+
+	err := retry(fmt.Sprintf("Upload block #%v", partNumber), func() error {
+		query := url.Values{"comp": {"block"}, "blockid": {blockID}}
+		req, err := a.newRequest(http.MethodPut, query, buf)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(checksum.MD5))
+
+		_, err = a.do(req, http.StatusCreated)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.blockIDs[partNumber] = blockID
+	a.mu.Unlock()
+	return nil
+}
+
+// Complete commits the uploaded blocks in part order.
+// Every part from 1 to the last one must have been uploaded.
+func (a *AzureBlobSink) Complete() (*UploadOutput, error) {
+	a.mu.Lock()
+	partNumbers := make([]int64, 0, len(a.blockIDs))
+	for partNumber := range a.blockIDs {
+		partNumbers = append(partNumbers, partNumber)
+	}
+	sort.Slice(partNumbers, func(i, j int) bool {
+		return partNumbers[i] < partNumbers[j]
+	})
+	blockList := struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}{}
+	for i, partNumber := range partNumbers {
+		if partNumber != int64(i+1) {
+			a.mu.Unlock()
+			return nil, fmt.Errorf("Block of part #%v is missing. Not committing the block list", i+1)
+		}
+		blockList.Latest = append(blockList.Latest, a.blockIDs[partNumber])
+	}
+	a.mu.Unlock()
+	if len(blockList.Latest) == 0 {
+		return nil, fmt.Errorf("No blocks to commit")
+	}
+
+	body, err := xml.Marshal(blockList)
+	if err != nil {
+		return nil, err
+	}
+	body = append([]byte(xml.Header), body...)
+
+	var resp *http.Response
+	err = retry("Commit block list", func() error {
+		req, err := a.newRequest(http.MethodPut, url.Values{"comp": {"blocklist"}}, body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/xml")
+		req.Header.Set("x-ms-blob-content-type", a.contentType)
+
+		resp, err = a.do(req, http.StatusCreated)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a.output(resp), nil
+}
+
+// Abort is a no-op: uncommitted blocks are garbage collected by Azure after a week.
+func (a *AzureBlobSink) Abort() error {
+	return nil
+}
+
+// PutObject uploads buf as a block blob in a single request.
+func (a *AzureBlobSink) PutObject(buf []byte, contentType string) (*UploadOutput, error) {
+	checksum := NewPartChecksum(buf)
+
+	var resp *http.Response
+	err := retry("Upload blob", func() error {
+		req, err := a.newRequest(http.MethodPut, nil, buf)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(checksum.MD5))
+		req.Header.Set("x-ms-blob-type", "BlockBlob")
+
+		resp, err = a.do(req, http.StatusCreated)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a.output(resp), nil
+}
+
+func (a *AzureBlobSink) blobURL() string {
+	endpoint := a.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%v.blob.core.windows.net", a.Account)
+	}
+	return fmt.Sprintf("%v/%v/%v", strings.TrimRight(endpoint, "/"), url.PathEscape(a.Container), escapeBlobName(a.Blob))
+}
+
+// escapeBlobName escapes every segment of the blob name, keeping the slashes.
+func escapeBlobName(blob string) string {
+	segments := strings.Split(blob, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func (a *AzureBlobSink) newRequest(method string, query url.Values, body []byte) (*http.Request, error) {
+	u, err := url.Parse(a.blobURL())
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = query.Encode()
+	if a.SASToken != "" {
+		sas := strings.TrimPrefix(a.SASToken, "?")
+		if u.RawQuery != "" {
+			sas = "&" + sas
+		}
+		u.RawQuery += sas
+	}
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureAPIVersion)
+	return req, nil
+}
+
+// do signs and sends the request, and checks the status code.
+func (a *AzureBlobSink) do(req *http.Request, expected ...int) (*http.Response, error) {
+	if a.SASToken == "" {
+		err := a.sign(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	err = httpError(resp, expected...)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// sign adds the Shared Key Authorization header.
+// Ref: https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func (a *AzureBlobSink) sign(req *http.Request) error {
+	key, err := base64.StdEncoding.DecodeString(a.AccountKey)
+	if err != nil {
+		return fmt.Errorf("Invalid AccountKey: %v", err)
+	}
+
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	// Canonicalized headers
+	var msHeaders []string
+	for name := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-ms-") {
+			msHeaders = append(msHeaders, name)
+		}
+	}
+	sort.Strings(msHeaders)
+	var canonicalHeaders strings.Builder
+	for _, name := range msHeaders {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+
+	// Canonicalized resource
+	var canonicalResource strings.Builder
+	canonicalResource.WriteString("/" + a.Account + req.URL.EscapedPath())
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := query[name]
+		sort.Strings(values)
+		canonicalResource.WriteString("\n" + strings.ToLower(name) + ":" + strings.Join(values, ","))
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, x-ms-date is used instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}, "\n") + "\n" + canonicalHeaders.String() + canonicalResource.String()
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	req.Header.Set("Authorization", "SharedKey "+a.Account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+func (a *AzureBlobSink) output(resp *http.Response) *UploadOutput {
+	return &UploadOutput{
+		Bucket:    a.Container,
+		Key:       a.Blob,
+		Location:  a.blobURL(),
+		ETag:      strings.Trim(resp.Header.Get("ETag"), `"`),
+		VersionID: resp.Header.Get("x-ms-version-id"),
+	}
+}
@@ -0,0 +1,201 @@
+package sqltocsvgzip
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Well-known Azurite development storage account.
+const (
+	testAzureAccount = "devstoreaccount1"
+	testAzureKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// fakeAzure implements the block blob operations used by AzureBlobSink, like Azurite.
+type fakeAzure struct {
+	mu     sync.Mutex
+	blobs  map[string][]byte
+	blocks map[string][]byte
+	auth   []string // Authorization header or sig parameter of every request
+}
+
+func newFakeAzure(t *testing.T) (*fakeAzure, *httptest.Server) {
+	f := &fakeAzure{blobs: map[string][]byte{}, blocks: map[string][]byte{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Method != http.MethodPut || r.Header.Get("x-ms-version") != azureAPIVersion {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	if sig := r.URL.Query().Get("sig"); sig != "" {
+		f.auth = append(f.auth, sig)
+	} else {
+		f.auth = append(f.auth, r.Header.Get("Authorization"))
+	}
+	if contentMD5 := r.Header.Get("Content-MD5"); contentMD5 != "" {
+		sum := md5.Sum(body)
+		if contentMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+			http.Error(w, "Md5Mismatch", http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch r.URL.Query().Get("comp") {
+	case "block":
+		f.blocks[r.URL.Query().Get("blockid")] = body
+	case "blocklist":
+		var blockList struct {
+			Latest []string `xml:"Latest"`
+		}
+		err := xml.Unmarshal(body, &blockList)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var blob []byte
+		for _, blockID := range blockList.Latest {
+			block, ok := f.blocks[blockID]
+			if !ok {
+				http.Error(w, "InvalidBlockList", http.StatusBadRequest)
+				return
+			}
+			blob = append(blob, block...)
+		}
+		f.blobs[r.URL.Path] = blob
+	case "":
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			http.Error(w, "MissingRequiredHeader", http.StatusBadRequest)
+			return
+		}
+		f.blobs[r.URL.Path] = body
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("ETag", `"0x8D9"`)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func TestAzureBlobSinkUpload(t *testing.T) {
+	fake, server := newFakeAzure(t)
+	sink := NewAzureBlobSink(testAzureAccount, testAzureKey, "exports", "dir/out.csv.gz")
+	sink.Endpoint = server.URL + "/" + testAzureAccount
+
+	parts := [][]byte{[]byte("first part,"), []byte("second part,"), []byte("last part")}
+	err := sink.Create("application/x-gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Blocks are committed in part order whatever the upload order
+	for _, i := range []int{2, 0, 1} {
+		err = sink.UploadPart(int64(i+1), parts[i], NewPartChecksum(parts[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	output, err := sink.Complete()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob := fake.blobs["/devstoreaccount1/exports/dir/out.csv.gz"]
+	if expected := bytes.Join(parts, nil); !bytes.Equal(blob, expected) {
+		t.Fatalf("Committed %q, expected %q", blob, expected)
+	}
+	if output.ETag != "0x8D9" || output.Location != sink.Endpoint+"/exports/dir/out.csv.gz" {
+		t.Errorf("Unexpected output: %+v", output)
+	}
+	for _, auth := range fake.auth {
+		if !strings.HasPrefix(auth, "SharedKey "+testAzureAccount+":") {
+			t.Errorf("Unexpected Authorization: %q", auth)
+		}
+	}
+}
+
+func TestAzureBlobSinkSASToken(t *testing.T) {
+	fake, server := newFakeAzure(t)
+	sink := &AzureBlobSink{
+		Account:   testAzureAccount,
+		SASToken:  "?sv=2020-10-02&sig=signature",
+		Container: "exports",
+		Blob:      "out.csv.gz",
+		Endpoint:  server.URL + "/" + testAzureAccount,
+	}
+
+	err := sink.Create("application/x-gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sink.PutObject([]byte("small"), "application/x-gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fake.blobs["/devstoreaccount1/exports/out.csv.gz"]) != "small" {
+		t.Fatalf("Unexpected blob: %q", fake.blobs["/devstoreaccount1/exports/out.csv.gz"])
+	}
+	if len(fake.auth) != 1 || fake.auth[0] != "signature" {
+		t.Errorf("Unexpected signatures: %q", fake.auth)
+	}
+}
+
+func TestAzureBlobSinkSign(t *testing.T) {
+	sink := NewAzureBlobSink(testAzureAccount, testAzureKey, "exports", "out.csv.gz")
+	sink.Endpoint = "http://127.0.0.1:10000/devstoreaccount1"
+
+	req, err := sink.newRequest(http.MethodPut, map[string][]string{"comp": {"block"}, "blockid": {"MDA="}}, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("x-ms-date", "Mon, 04 Oct 2021 10:00:00 GMT")
+	req.Header.Set("Content-MD5", "jXd/OF09/siBXSD3SWAm3A==")
+	err = sink.sign(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stringToSign := "PUT\n\n\n4\njXd/OF09/siBXSD3SWAm3A==\n\n\n\n\n\n\n\n" +
+		"x-ms-date:Mon, 04 Oct 2021 10:00:00 GMT\nx-ms-version:" + azureAPIVersion + "\n" +
+		"/devstoreaccount1/devstoreaccount1/exports/out.csv.gz\nblockid:MDA=\ncomp:block"
+	key, _ := base64.StdEncoding.DecodeString(testAzureKey)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	expected := "SharedKey devstoreaccount1:" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	if got := req.Header.Get("Authorization"); got != expected {
+		t.Errorf("Authorization is %q, expected %q", got, expected)
+	}
+}
+
+func TestAzureBlobSinkConverter(t *testing.T) {
+	fake, server := newFakeAzure(t)
+	sink := NewAzureBlobSink(testAzureAccount, testAzureKey, "exports", "people.csv.gz")
+	sink.Endpoint = server.URL + "/" + testAzureAccount
+
+	c := UploadConfig(testRows(t, "people", "alice", "bob"))
+	c.LogLevel = Error
+	c.SetSink(sink)
+	_, err := c.Upload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gunzipString(t, fake.blobs["/devstoreaccount1/exports/people.csv.gz"]); got != "name\nalice\nbob\n" {
+		t.Fatalf("Unexpected blob: %q", got)
+	}
+}
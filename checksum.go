@@ -0,0 +1,61 @@
+package sqltocsvgzip
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// PartChecksum holds the digests of a single upload part.
+type PartChecksum struct {
+	MD5    []byte
+	SHA256 []byte
+}
+
+// NewPartChecksum computes the digests of buf.
+func NewPartChecksum(buf []byte) PartChecksum {
+	md5Sum := md5.Sum(buf)
+	sha256Sum := sha256.Sum256(buf)
+	return PartChecksum{
+		MD5:    md5Sum[:],
+		SHA256: sha256Sum[:],
+	}
+}
+
+// compositeChecksums returns the multipart ETag and the composite SHA-256
+// checksum S3 computes for the given parts: the digest of the concatenated
+// part digests (in part order) followed by "-<number of parts>".
+func compositeChecksums(parts map[int64]PartChecksum) (etag string, checksumSHA256 string) {
+	partNumbers := make([]int64, 0, len(parts))
+	for partNumber := range parts {
+		partNumbers = append(partNumbers, partNumber)
+	}
+	sort.Slice(partNumbers, func(i, j int) bool {
+		return partNumbers[i] < partNumbers[j]
+	})
+
+	md5Hash := md5.New()
+	sha256Hash := sha256.New()
+	for _, partNumber := range partNumbers {
+		md5Hash.Write(parts[partNumber].MD5)
+		sha256Hash.Write(parts[partNumber].SHA256)
+	}
+
+	etag = fmt.Sprintf("%v-%v", hex.EncodeToString(md5Hash.Sum(nil)), len(parts))
+	checksumSHA256 = fmt.Sprintf("%v-%v", base64.StdEncoding.EncodeToString(sha256Hash.Sum(nil)), len(parts))
+	return etag, checksumSHA256
+}
+
+// verifyChecksum compares a checksum returned by S3 with the expected one.
+// S3 returns ETags wrapped in double quotes.
+func verifyChecksum(name, expected, actual string) error {
+	actual = strings.Trim(actual, `"`)
+	if actual != expected {
+		return fmt.Errorf("%v mismatch: expected %v, got %v", name, expected, actual)
+	}
+	return nil
+}
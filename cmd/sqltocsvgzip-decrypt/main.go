@@ -0,0 +1,93 @@
+// Command sqltocsvgzip-decrypt decrypts files encrypted by sqltocsvgzip.
+//
+// Usage:
+//
+//	sqltocsvgzip-decrypt -aes-key-file key.hex < file.csv.gz.enc > file.csv.gz
+//	sqltocsvgzip-decrypt -age-identity-file key.txt -gunzip < file.csv.gz.age > file.csv
+//
+// The AES key file contains the hex encoded 32 byte key.
+// The age identity file contains one or more "AGE-SECRET-KEY-1..." lines.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/klauspost/pgzip"
+	"github.com/thatInfrastructureGuy/sqltocsvgzip"
+)
+
+func main() {
+	aesKeyFile := flag.String("aes-key-file", "", "File containing the hex encoded AES-256 key")
+	ageIdentityFile := flag.String("age-identity-file", "", "File containing age identities")
+	gunzip := flag.Bool("gunzip", false, "Decompress the decrypted output")
+	flag.Parse()
+
+	var r io.Reader
+	var err error
+	in := bufio.NewReader(os.Stdin)
+
+	switch {
+	case *aesKeyFile != "":
+		r, err = aesReader(in, *aesKeyFile)
+	case *ageIdentityFile != "":
+		r, err = ageReader(in, *ageIdentityFile)
+	default:
+		log.Fatal("Need -aes-key-file or -age-identity-file")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *gunzip {
+		zr, err := pgzip.NewReader(r)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	_, err = io.Copy(out, r)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = out.Flush()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func aesReader(in io.Reader, keyFile string) (io.Reader, error) {
+	content, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, err
+	}
+	return sqltocsvgzip.NewAESGCMReader(in, key)
+}
+
+func ageReader(in io.Reader, identityFile string) (io.Reader, error) {
+	content, err := os.ReadFile(identityFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var identities []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "AGE-SECRET-KEY-") {
+			identities = append(identities, line)
+		}
+	}
+	return sqltocsvgzip.NewAgeReader(in, identities...)
+}
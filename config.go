@@ -5,8 +5,11 @@ import (
 	"database/sql"
 	"os"
 	"runtime"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/text/encoding"
 )
 
 const (
@@ -16,6 +19,7 @@ const (
 type obj struct {
 	partNumber int64
 	buf        []byte
+	checksum   PartChecksum
 }
 
 type LogLevel int
@@ -37,28 +41,79 @@ type Converter struct {
 	WriteHeaders          bool     // Flag to output headers in your CSV (default is true)
 	TimeFormat            string   // Format string for any time.Time values (default is time's default)
 	Delimiter             rune     // Delimiter to use in your CSV (default is comma)
+	NullString            string   // String to write for SQL NULL values, other values equal to it are quoted (default is empty string)
 	CsvBufferSize         int
 	CompressionLevel      int
 	GzipGoroutines        int
 	GzipBatchPerGoroutine int
+	FileMode              os.FileMode // Permissions of the file written by WriteFile (default is 0666 before umask)
+	NoOverwrite           bool        // Make WriteFile fail instead of replacing an existing file
 	S3Bucket              string
 	S3Region              string
 	S3Acl                 string
 	S3Path                string
+	S3Endpoint            string // Endpoint of S3 compatible storage, e.g. http://localhost:9000 for MinIO (default is AWS)
 	S3Upload              bool
 	UploadThreads         int
 	UploadPartSize        int
+	S3SkipETagCheck       bool // Skip the multipart ETag check, e.g. for SSE-KMS buckets where ETags are not MD5 digests
+	S3Verify              bool // Read the uploaded object back and compare its rows and checksum with the export (default is false)
+	S3VerifyDelete        bool // Delete the uploaded object if S3Verify fails
 	RowCount              int64
+	ChecksumSHA256        string       // Hex encoded SHA-256 of the whole output, set once Write returns
+	ConcatResultSets      bool         // Write consecutive result sets with the same columns to a single output (see EachResultSet)
+	SchemaFormat          SchemaFormat // Write a schema sidecar next to the output (default is none)
+	SchemaTable           string       // Table name of the DDL sidecars and the SQLInsert output (default is the output file name without extensions, required by SQLInsert)
+	OutputFormat          OutputFormat // CSV, XLSX, FixedWidth or SQLInsert (default is CSV)
+	UseCRLF               bool         // End CSV lines with \r\n instead of \n
+	WriteBOM              bool         // Start the CSV with a UTF-8 byte order mark
+	EscapeFormulas        bool         // Prefix CSV values starting with =, +, -, @, tab or carriage return with a single quote (see SetExcelCSV)
+	Quoting               QuoteMode    // QuoteMinimal, QuoteAll or QuoteNone (default is QuoteMinimal)
+	QuoteChar             rune         // Quote character of the CSV (default is ")
+	EscapeChar            rune         // Escape quotes and line breaks with this character instead of doubling quotes, e.g. '\\' for MySQL (default is none)
+	RecordTerminator      string       // End of the CSV lines (default is \n, or \r\n with UseCRLF)
 
-	s3Svc            *s3.S3
-	s3Resp           *s3.CreateMultipartUploadOutput
-	s3CompletedParts []*s3.CompletedPart
-	rows             *sql.Rows
-	rowPreProcessor  CsvPreProcessorFunc
-	gzipBuf          []byte
-	partNumber       int64
-	uploadQ          chan *obj
-	quit             chan bool
+	// Character encoding of the CSV, e.g. charmap.Windows1252 or
+	// unicode.UTF16(unicode.LittleEndian, unicode.UseBOM) (default is UTF-8)
+	OutputEncoding encoding.Encoding
+	// Characters OutputEncoding cannot represent and invalid UTF-8 (default is InvalidCharError)
+	InvalidChars InvalidCharPolicy
+	// Values longer than their column in the FixedWidth output (default is OverflowError)
+	FixedWidthOverflow OverflowPolicy
+	// Values containing line breaks or the RecordTerminator in the FixedWidth output (default is LineBreakError)
+	FixedWidthLineBreaks LineBreakPolicy
+	// PostgresInsert, MySQLInsert or SQLServerInsert (default is PostgresInsert)
+	InsertDialect InsertDialect
+	// Rows per INSERT statement of the SQLInsert output (default is 100, at most 1000)
+	InsertBatchSize int
+
+	s3Svc             *s3.S3
+	s3Resp            *s3.CreateMultipartUploadOutput
+	s3CompletedParts  []*s3.CompletedPart
+	s3Mu              sync.Mutex
+	sink              Sink
+	rows              *sql.Rows
+	resultSetColumns  []string
+	resultSetReady    bool
+	resultSetsDone    bool
+	rowPreProcessor   CsvPreProcessorFunc
+	valuePreProcessor ValuePreProcessorFunc
+	pipeline          *Pipeline
+	masker            *Masker
+	encrypt           EncryptFunc
+	columnFormatters  map[string]ColumnFormatterFunc
+	typeFormatters    map[string]ColumnFormatterFunc
+	fixedWidthColumns map[string]FixedWidthColumn
+	formatters        []ColumnFormatterFunc
+	timeFormat        string   // TimeFormat or the default of the OutputFormat
+	timeFormats       []string // Per query column, overrides timeFormat if set
+	gzipBuf           []byte
+	partChecksums     map[int64]PartChecksum
+	result            ExportResult
+	startTime         time.Time
+	partNumber        int64
+	uploadQ           chan *obj
+	quit              chan bool
 }
 
 // CsvPreprocessorFunc is a function type for preprocessing your CSV.
@@ -67,6 +122,7 @@ type Converter struct {
 //
 // Return an outputRow of false if you want the row skipped otherwise
 // return the processed Row slice as you want it written to the CSV.
+// NULLs are NullString, a field stays NULL while its value is left unchanged.
 type CsvPreProcessorFunc func(row []string, columnNames []string) (outputRow bool, processedRow []string)
 
 // SetRowPreProcessor lets you specify a CsvPreprocessorFunc for this conversion
@@ -74,6 +130,23 @@ func (c *Converter) SetRowPreProcessor(processor CsvPreProcessorFunc) {
 	c.rowPreProcessor = processor
 }
 
+// ValuePreProcessorFunc is a function type for preprocessing the raw values
+// scanned from the database, before they are munged into strings.
+// columnTypes describes the columns of the query, in the same order as values.
+//
+// Return an outputRow of false if you want the row skipped otherwise
+// return the processed values as you want them formatted. Values can be
+// rewritten and computed columns can be appended, but values must not be
+// reordered, inserted or removed: column formatters and the column types of
+// the schema are matched to the values by their position in the query.
+type ValuePreProcessorFunc func(values []interface{}, columnTypes []*sql.ColumnType) (outputRow bool, processedValues []interface{})
+
+// SetValuePreProcessor lets you specify a ValuePreProcessorFunc for this conversion.
+// It runs before the column formatters and the CsvPreProcessorFunc.
+func (c *Converter) SetValuePreProcessor(processor ValuePreProcessorFunc) {
+	c.valuePreProcessor = processor
+}
+
 func getLogLevel() (level LogLevel) {
 	levels := map[string]LogLevel{
 		"ERROR":   Error,
@@ -125,5 +198,6 @@ func UploadConfig(rows *sql.Rows) *Converter {
 		S3Path:                os.Getenv("S3_PATH"),
 		S3Region:              os.Getenv("S3_REGION"),
 		S3Acl:                 os.Getenv("S3_ACL"),
+		S3Endpoint:            os.Getenv("S3_ENDPOINT"),
 	}
 }
@@ -1,29 +1,415 @@
 package sqltocsvgzip
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/csv"
 	"fmt"
+	"io"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
-func (c *Converter) getCSVWriter() (*csv.Writer, *bytes.Buffer) {
-	// Same size as sqlRowBatch
-	csvBuffer := bytes.NewBuffer(make([]byte, 0, c.CsvBufferSize))
+// QuoteMode tells which CSV values are quoted.
+type QuoteMode int
 
-	// CSV writer to csvBuffer
-	csvWriter := csv.NewWriter(csvBuffer)
+const (
+	// QuoteMinimal quotes the values containing the delimiter, the quote
+	// character or line breaks, or starting with a space, like encoding/csv.
+	// Values equal to NullString, e.g. empty strings, are quoted too so that
+	// they are not read as NULL, and so are records made of a single empty
+	// string, which would otherwise be a blank line skipped by readers.
+	QuoteMinimal QuoteMode = iota
+	// QuoteAll quotes every value, except NULLs.
+	QuoteAll
+	// QuoteNone never quotes values. The delimiter, line breaks and the
+	// escape character are escaped with EscapeChar (default is backslash).
+	// NullString is not escaped, e.g. \N for MySQL and Postgres.
+	QuoteNone
+)
+
+// csvWriter writes CSV records in the dialect of the Converter.
+// The default dialect is the RFC 4180 one of encoding/csv.
+type csvWriter struct {
+	buf        *bytes.Buffer
+	comma      rune
+	quote      rune
+	escape     rune
+	quoting    QuoteMode
+	useCRLF    bool
+	terminator string
+	nullString string
+}
+
+func (c *Converter) getCSVWriter(csvBuffer *bytes.Buffer) (*csvWriter, error) {
+	w := &csvWriter{
+		buf:        csvBuffer,
+		comma:      ',',
+		quote:      '"',
+		escape:     c.EscapeChar,
+		quoting:    c.Quoting,
+		useCRLF:    c.UseCRLF,
+		terminator: c.RecordTerminator,
+		nullString: c.NullString,
+	}
 
 	// Set delimiter
 	if c.Delimiter != '\x00' {
-		csvWriter.Comma = c.Delimiter
+		w.comma = c.Delimiter
+	}
+	if c.QuoteChar != 0 {
+		w.quote = c.QuoteChar
+	}
+	if w.quoting == QuoteNone && w.escape == 0 {
+		w.escape = '\\'
+	}
+	if w.terminator == "" {
+		w.terminator = "\n"
+		if w.useCRLF {
+			w.terminator = "\r\n"
+		}
+	}
+
+	for _, r := range []rune{w.comma, w.quote, w.escape} {
+		if r == '\r' || r == '\n' || !utf8.ValidRune(r) || r == utf8.RuneError {
+			return nil, fmt.Errorf("Invalid CSV dialect: %q cannot be a delimiter, quote or escape character", r)
+		}
+	}
+	if w.comma == w.quote || w.comma == w.escape || (w.quote == w.escape && w.quoting != QuoteNone) {
+		return nil, fmt.Errorf("Invalid CSV dialect: delimiter, quote and escape characters must differ")
+	}
+	return w, nil
+}
+
+// Write writes a record followed by the record terminator.
+// nulls flags the NULL fields of the record, it may be nil.
+func (w *csvWriter) Write(record []string, nulls []bool) error {
+	for n, field := range record {
+		if n > 0 {
+			w.buf.WriteRune(w.comma)
+		}
+
+		// With QuoteAll or EscapeChar, NULLs are neither quoted nor escaped
+		// so that loaders still recognize them
+		null := isNull(nulls, n)
+		raw := null && (w.quoting == QuoteAll || w.escape != 0)
+
+		quoted := !raw && (w.quoting == QuoteAll || (w.quoting == QuoteMinimal &&
+			(w.fieldNeedsQuotes(field) || (!null && field == w.nullString) ||
+				(!null && field == "" && len(record) == 1))))
+		if !quoted && (raw || w.escape == 0 || !w.fieldNeedsEscapes(field)) {
+			w.buf.WriteString(field)
+			continue
+		}
+
+		if quoted {
+			w.buf.WriteRune(w.quote)
+		}
+		for len(field) > 0 {
+			r, size := utf8.DecodeRuneInString(field)
+			switch {
+			case w.escape != 0 && r == '\n':
+				w.buf.WriteRune(w.escape)
+				w.buf.WriteByte('n')
+			case w.escape != 0 && r == '\r':
+				w.buf.WriteRune(w.escape)
+				w.buf.WriteByte('r')
+			case w.escape != 0 && (r == w.escape || (quoted && r == w.quote) || (!quoted && r == w.comma)):
+				w.buf.WriteRune(w.escape)
+				w.buf.WriteRune(r)
+			case r == w.quote:
+				w.buf.WriteRune(w.quote)
+				w.buf.WriteRune(w.quote)
+			case r == '\r' && w.useCRLF:
+				// Line breaks become \r\n
+			case r == '\n' && w.useCRLF:
+				w.buf.WriteString("\r\n")
+			default:
+				// Invalid UTF-8 is copied as is
+				w.buf.WriteString(field[:size])
+			}
+			field = field[size:]
+		}
+		if quoted {
+			w.buf.WriteRune(w.quote)
+		}
+	}
+	w.buf.WriteString(w.terminator)
+	return nil
+}
+
+// fieldNeedsQuotes reports whether field must be quoted with QuoteMinimal,
+// following encoding/csv. Line breaks are escaped instead if EscapeChar is set.
+func (w *csvWriter) fieldNeedsQuotes(field string) bool {
+	if field == "" {
+		return false
+	}
+	if field == `\.` {
+		return true
+	}
+	if strings.ContainsRune(field, w.comma) || strings.ContainsRune(field, w.quote) {
+		return true
+	}
+	if w.escape == 0 && strings.ContainsAny(field, "\r\n") {
+		return true
+	}
+	r1, _ := utf8.DecodeRuneInString(field)
+	return unicode.IsSpace(r1)
+}
+
+// fieldNeedsEscapes reports whether the unquoted field has characters to escape.
+func (w *csvWriter) fieldNeedsEscapes(field string) bool {
+	return strings.ContainsAny(field, "\r\n") || strings.ContainsRune(field, w.escape) ||
+		strings.ContainsRune(field, w.comma)
+}
+
+// csvReader reads the records of a csvWriter. Unlike encoding/csv, it tells
+// NULLs apart from the same text quoted or escaped: a field is NULL if it is
+// unquoted and equal to nullString before unescaping.
+type csvReader struct {
+	r          *bufio.Reader
+	comma      string
+	quote      string // Empty with QuoteNone
+	escape     string
+	terminator string // Empty for \n or \r\n
+	nullString string
+}
+
+// newCSVReader returns a csvReader for the dialect of config,
+// or the one of config.Schema for the fields left unset.
+func newCSVReader(r io.Reader, config *ReaderConfig) (*csvReader, error) {
+	schema := config.Schema
+	if schema == nil {
+		schema = &Schema{}
+	}
+	comma := firstRune(config.Delimiter, schema.Delimiter, ',')
+	quote := firstRune(config.QuoteChar, schema.QuoteChar, '"')
+	escape := firstRune(config.EscapeChar, schema.EscapeChar, 0)
+	quoting := config.Quoting
+	if quoting == QuoteMinimal {
+		quoting = schema.Quoting
+	}
+	if quoting == QuoteNone && escape == 0 {
+		escape = '\\'
+	}
+
+	for _, c := range []rune{comma, quote, escape} {
+		if c == '\r' || c == '\n' || !utf8.ValidRune(c) || c == utf8.RuneError {
+			return nil, fmt.Errorf("Invalid CSV dialect: %q cannot be a delimiter, quote or escape character", c)
+		}
+	}
+	if comma == quote || comma == escape || (quote == escape && quoting != QuoteNone) {
+		return nil, fmt.Errorf("Invalid CSV dialect: delimiter, quote and escape characters must differ")
+	}
+
+	reader := &csvReader{
+		r:          bufio.NewReader(r),
+		comma:      string(comma),
+		quote:      string(quote),
+		nullString: config.NullString,
+		terminator: config.RecordTerminator,
+	}
+	if escape != 0 {
+		reader.escape = string(escape)
+	}
+	if quoting == QuoteNone {
+		reader.quote = ""
+	}
+	if reader.nullString == "" {
+		reader.nullString = schema.NullString
+	}
+	if reader.terminator == "" {
+		reader.terminator = schema.RecordTerminator
+	}
+	if reader.terminator == "\n" || reader.terminator == "\r\n" {
+		reader.terminator = ""
+	}
+	return reader, nil
+}
+
+// firstRune returns the first of runes that is set.
+func firstRune(runes ...rune) rune {
+	for _, r := range runes {
+		if r != 0 {
+			return r
+		}
+	}
+	return 0
+}
+
+// Read returns the next record and flags its NULL fields,
+// or io.EOF once all records are read.
+func (r *csvReader) Read() (record []string, nulls []bool, err error) {
+	_, err = r.r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for {
+		field, null, last, err := r.readField()
+		if err != nil {
+			return nil, nil, err
+		}
+		record = append(record, field)
+		nulls = append(nulls, null)
+		if last {
+			return record, nulls, nil
+		}
+	}
+}
+
+// readField reads a field and reports whether it is the last one of the record.
+func (r *csvReader) readField() (field string, null bool, last bool, err error) {
+	if r.consume(r.quote) {
+		field, last, err = r.readQuoted()
+		return field, false, last, err
+	}
+
+	// raw is the field before unescaping
+	var value, raw strings.Builder
+	for {
+		switch {
+		case r.consume(r.comma):
+		case r.atTerminator():
+			last = true
+		case r.consume(r.escape):
+			unescaped, escaped, err := r.unescape()
+			if err != nil {
+				return "", false, false, err
+			}
+			value.WriteString(unescaped)
+			raw.WriteString(r.escape + escaped)
+			continue
+		default:
+			b, err := r.r.ReadByte()
+			if err == io.EOF {
+				last = true
+				break
+			}
+			if err != nil {
+				return "", false, false, err
+			}
+			value.WriteByte(b)
+			raw.WriteByte(b)
+			continue
+		}
+		return value.String(), raw.String() == r.nullString, last, nil
 	}
+}
 
-	return csvWriter, csvBuffer
+// readQuoted reads the rest of a quoted field.
+func (r *csvReader) readQuoted() (field string, last bool, err error) {
+	var value strings.Builder
+	for {
+		switch {
+		case r.consume(r.escape):
+			unescaped, _, err := r.unescape()
+			if err != nil {
+				return "", false, err
+			}
+			value.WriteString(unescaped)
+		case r.consume(r.quote):
+			switch {
+			case r.consume(r.quote):
+				value.WriteString(r.quote)
+			case r.consume(r.comma):
+				return value.String(), false, nil
+			case r.atTerminator():
+				return value.String(), true, nil
+			default:
+				_, err = r.r.Peek(1)
+				if err == io.EOF {
+					return value.String(), true, nil
+				}
+				if err != nil {
+					return "", false, err
+				}
+				return "", false, fmt.Errorf("Extraneous %v in quoted field", r.quote)
+			}
+		case r.terminator == "" && r.consume("\r\n"):
+			// Like encoding/csv, \r\n in quoted fields is read as \n
+			value.WriteByte('\n')
+		default:
+			b, err := r.r.ReadByte()
+			if err == io.EOF {
+				return "", false, fmt.Errorf("Missing closing %v in quoted field", r.quote)
+			}
+			if err != nil {
+				return "", false, err
+			}
+			value.WriteByte(b)
+		}
+	}
 }
 
-func (c *Converter) setCSVHeaders(csvWriter *csv.Writer) ([]string, int, error) {
+// unescape reads the character following the escape character
+// and returns it unescaped and as is.
+func (r *csvReader) unescape() (unescaped string, escaped string, err error) {
+	c, size, err := r.r.ReadRune()
+	if err == io.EOF {
+		return "", "", fmt.Errorf("Escape character %v at end of input", r.escape)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	switch {
+	case c == 'n':
+		return "\n", "n", nil
+	case c == 'r':
+		return "\r", "r", nil
+	case c == utf8.RuneError && size == 1:
+		// Invalid UTF-8 is kept as is
+		r.r.UnreadRune()
+		b, _ := r.r.ReadByte()
+		return string([]byte{b}), string([]byte{b}), nil
+	}
+	return string(c), string(c), nil
+}
+
+// consume reports whether the input continues with s, and skips s if it does.
+func (r *csvReader) consume(s string) bool {
+	if s == "" {
+		return false
+	}
+	b, _ := r.r.Peek(len(s))
+	if string(b) != s {
+		return false
+	}
+	r.r.Discard(len(s))
+	return true
+}
+
+// atTerminator reports whether the input continues with the record
+// terminator, and skips it if it does.
+func (r *csvReader) atTerminator() bool {
+	if r.terminator == "" {
+		return r.consume("\n") || r.consume("\r\n")
+	}
+	return r.consume(r.terminator)
+}
+
+// SetExcelCSV sets up the CSV for spreadsheet applications: UTF-8 byte order mark,
+// CRLF line endings and formula injection guard. Pass ';' as delimiter for
+// locales using the comma as decimal separator.
+func (c *Converter) SetExcelCSV(delimiter rune) {
+	c.Delimiter = delimiter
+	c.UseCRLF = true
+	c.WriteBOM = true
+	c.EscapeFormulas = true
+}
+
+// SetTSV sets up a tab separated output without quoting: tabs, line breaks
+// and backslashes in values are escaped with a backslash, as expected by
+// MySQL LOAD DATA, Postgres COPY and Hive (with serialization.escape.crlf).
+func (c *Converter) SetTSV() {
+	c.Delimiter = '\t'
+	c.Quoting = QuoteNone
+	c.EscapeChar = '\\'
+}
+
+func (c *Converter) setCSVHeaders() ([]string, int, error) {
 	var headers []string
 	columnNames, err := c.rows.Columns()
 	if err != nil {
@@ -38,65 +424,104 @@ func (c *Converter) setCSVHeaders(csvWriter *csv.Writer) ([]string, int, error)
 		headers = columnNames
 	}
 
-	// Write to CSV Buffer
-	if c.WriteHeaders {
-		err = csvWriter.Write(headers)
+	// Columns after the transform pipeline
+	outputHeaders := headers
+	if c.pipeline != nil {
+		outputHeaders, err = c.pipeline.bind(headers)
 		if err != nil {
 			return nil, 0, err
 		}
-		csvWriter.Flush()
 	}
 
-	return headers, len(headers), nil
+	c.result.Columns = outputHeaders
+	c.resultSetColumns = columnNames
+
+	return headers, len(columnNames), nil
 }
 
-func (c *Converter) stringify(values []interface{}) []string {
-	row := make([]string, len(values), len(values))
+// writeHeaders writes the output column headers, if WriteHeaders is set.
+func (c *Converter) writeHeaders(rowWriter rowWriter) error {
+	if !c.WriteHeaders {
+		return nil
+	}
+	return rowWriter.writeHeader(c.result.Columns)
+}
+
+// stringify formats the values of a row. nulls flags the NULL values,
+// written as NullString, and is nil if there are none.
+func (c *Converter) stringify(values []interface{}) (row []string, nulls []bool) {
+	row = make([]string, len(values), len(values))
 
 	for i, rawValue := range values {
 		if rawValue == nil {
-			row[i] = ""
+			row[i] = c.NullString
+			if nulls == nil {
+				nulls = make([]bool, len(values))
+			}
+			nulls[i] = true
 			continue
 		}
 
-		byteArray, ok := rawValue.([]byte)
-		if ok {
-			rawValue = string(byteArray)
+		if i < len(c.formatters) && c.formatters[i] != nil {
+			row[i] = c.formatters[i](rawValue)
+			continue
 		}
 
-		switch castValue := rawValue.(type) {
-		case time.Time:
-			if c.TimeFormat != "" {
-				row[i] = castValue.Format(c.TimeFormat)
-			}
-		case bool:
-			row[i] = strconv.FormatBool(castValue)
-		case string:
-			row[i] = castValue
-		case int:
-			row[i] = strconv.FormatInt(int64(castValue), 10)
-		case int8:
-			row[i] = strconv.FormatInt(int64(castValue), 10)
-		case int16:
-			row[i] = strconv.FormatInt(int64(castValue), 10)
-		case int32:
-			row[i] = strconv.FormatInt(int64(castValue), 10)
-		case int64:
-			row[i] = strconv.FormatInt(int64(castValue), 10)
-		case uint:
-			row[i] = strconv.FormatUint(uint64(castValue), 10)
-		case uint8:
-			row[i] = strconv.FormatUint(uint64(castValue), 10)
-		case uint16:
-			row[i] = strconv.FormatUint(uint64(castValue), 10)
-		case uint32:
-			row[i] = strconv.FormatUint(uint64(castValue), 10)
-		case uint64:
-			row[i] = strconv.FormatUint(uint64(castValue), 10)
-		default:
-			row[i] = fmt.Sprintf("%v", castValue)
+		timeFormat := c.timeFormat
+		if i < len(c.timeFormats) {
+			timeFormat = c.timeFormats[i]
 		}
+		row[i] = formatValue(rawValue, timeFormat)
+	}
+
+	return row, nulls
+}
+
+// isNull reports whether field i is flagged NULL.
+func isNull(nulls []bool, i int) bool {
+	return i < len(nulls) && nulls[i]
+}
+
+// formatValue converts a single non-NULL value into its CSV representation.
+// []byte values are written as text, invalid UTF-8 being handled by InvalidChars:
+// binary columns need FormatHex or FormatBase64.
+func formatValue(rawValue interface{}, timeFormat string) string {
+	byteArray, ok := rawValue.([]byte)
+	if ok {
+		rawValue = string(byteArray)
 	}
 
-	return row
+	switch castValue := rawValue.(type) {
+	case time.Time:
+		if timeFormat != "" {
+			return castValue.Format(timeFormat)
+		}
+		return ""
+	case bool:
+		return strconv.FormatBool(castValue)
+	case string:
+		return castValue
+	case int:
+		return strconv.FormatInt(int64(castValue), 10)
+	case int8:
+		return strconv.FormatInt(int64(castValue), 10)
+	case int16:
+		return strconv.FormatInt(int64(castValue), 10)
+	case int32:
+		return strconv.FormatInt(int64(castValue), 10)
+	case int64:
+		return strconv.FormatInt(int64(castValue), 10)
+	case uint:
+		return strconv.FormatUint(uint64(castValue), 10)
+	case uint8:
+		return strconv.FormatUint(uint64(castValue), 10)
+	case uint16:
+		return strconv.FormatUint(uint64(castValue), 10)
+	case uint32:
+		return strconv.FormatUint(uint64(castValue), 10)
+	case uint64:
+		return strconv.FormatUint(uint64(castValue), 10)
+	default:
+		return fmt.Sprintf("%v", castValue)
+	}
 }
@@ -0,0 +1,359 @@
+package sqltocsvgzip
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// Values needing quotes, or not, in encoding/csv
+var csvTestRecords = [][]string{
+	{"plain", "with,comma", `with "quotes"`, "é unicode"},
+	{`\.`, " leading space", "\tleading tab", "trailing space "},
+	{"line\nbreak", "carriage\rreturn", "crlf\r\nline", `back\slash`},
+	{"\"", ",", "\n", "x"},
+	{"only"},
+}
+
+func TestCSVWriterMatchesEncodingCSV(t *testing.T) {
+	for _, useCRLF := range []bool{false, true} {
+		var expected bytes.Buffer
+		cw := csv.NewWriter(&expected)
+		cw.UseCRLF = useCRLF
+		err := cw.WriteAll(csvTestRecords)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		w, err := (&Converter{UseCRLF: useCRLF}).getCSVWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, record := range csvTestRecords {
+			err = w.Write(record, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if buf.String() != expected.String() {
+			t.Errorf("UseCRLF %v:\ngot      %q\nexpected %q", useCRLF, buf.String(), expected.String())
+		}
+	}
+}
+
+func TestCSVWriterNulls(t *testing.T) {
+	tests := []struct {
+		converter *Converter
+		record    []string
+		nulls     []bool
+		expected  string
+	}{
+		{&Converter{}, []string{"", "", "x"}, []bool{true, false, false}, `,"",x` + "\n"},
+		{&Converter{NullString: "NULL"}, []string{"NULL", "", "NULL"}, []bool{true, false, false}, `NULL,,"NULL"` + "\n"},
+		{&Converter{Quoting: QuoteAll}, []string{"", "", "x"}, []bool{true, false, false}, `,"","x"` + "\n"},
+		{&Converter{Quoting: QuoteAll, NullString: "NULL"}, []string{"NULL", "", "NULL"}, []bool{true, false, false}, `NULL,"","NULL"` + "\n"},
+		// Not a blank line
+		{&Converter{NullString: "NULL"}, []string{""}, nil, `""` + "\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w, err := test.converter.getCSVWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Write(test.record, test.nulls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("Quoting %v, NullString %q: got %q, expected %q",
+				test.converter.Quoting, test.converter.NullString, buf.String(), test.expected)
+		}
+	}
+}
+
+func TestCSVWriterEscapeChar(t *testing.T) {
+	record := []string{"plain", "tab\there", "comma,here", "line\nbreak\rreturn", `back\slash`, `"quote"`, `\N`, `\N`}
+	nulls := []bool{false, false, false, false, false, false, true, false}
+	tests := []struct {
+		name      string
+		converter *Converter
+		expected  string
+	}{
+		{
+			name:      "SetTSV",
+			converter: &Converter{Delimiter: '\t', Quoting: QuoteNone, EscapeChar: '\\', NullString: `\N`},
+			expected:  "plain\ttab\\\there\tcomma,here\tline\\nbreak\\rreturn\tback\\\\slash\t\"quote\"\t\\N\t\\\\N\n",
+		},
+		{
+			name:      "QuoteNone with the default escape character",
+			converter: &Converter{Quoting: QuoteNone, NullString: `\N`},
+			expected:  "plain,tab\there,comma\\,here,line\\nbreak\\rreturn,back\\\\slash,\"quote\",\\N,\\\\N\n",
+		},
+		{
+			name:      "QuoteMinimal with EscapeChar",
+			converter: &Converter{EscapeChar: '\\', NullString: `\N`},
+			expected:  "plain,tab\there,\"comma,here\",line\\nbreak\\rreturn,back\\\\slash,\"\\\"quote\\\"\",\\N,\"\\\\N\"\n",
+		},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w, err := test.converter.getCSVWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Write(record, nulls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("%v:\ngot      %q\nexpected %q", test.name, buf.String(), test.expected)
+		}
+	}
+}
+
+func TestCSVWriterInvalidDialect(t *testing.T) {
+	for _, c := range []*Converter{
+		{Delimiter: '"'},
+		{Delimiter: '\n'},
+		{QuoteChar: '\r'},
+		{EscapeChar: '"'},
+		{Delimiter: '\\', Quoting: QuoteNone},
+	} {
+		_, err := c.getCSVWriter(&bytes.Buffer{})
+		if err == nil {
+			t.Errorf("Expected an error for delimiter %q, quote %q, escape %q", c.Delimiter, c.QuoteChar, c.EscapeChar)
+		}
+	}
+}
+
+func TestCSVRoundTrip(t *testing.T) {
+	values := []interface{}{"", nil, "NULL", `\N`, `\.`, " space", "a,b", "a;b", `"q"`, "'s'",
+		"line\nbreak", "crlf\r\nline", "tab\tx", `back\slash`, "é"}
+	tests := []struct {
+		name  string
+		setup func(c *Converter)
+		crlf  string // Expected value of "crlf\r\nline"
+	}{
+		{"Default", func(c *Converter) {}, "crlf\nline"},
+		{"NullString and CRLF", func(c *Converter) {
+			c.NullString = "NULL"
+			c.UseCRLF = true
+		}, "crlf\nline"},
+		{"TSV", func(c *Converter) {
+			c.SetTSV()
+			c.NullString = `\N`
+		}, "crlf\r\nline"},
+		{"QuoteAll and EscapeChar", func(c *Converter) {
+			c.Quoting = QuoteAll
+			c.EscapeChar = '\\'
+			c.NullString = "NULL"
+		}, "crlf\r\nline"},
+		{"QuoteChar and RecordTerminator", func(c *Converter) {
+			c.Delimiter = ';'
+			c.QuoteChar = '\''
+			c.RecordTerminator = "\x1e"
+		}, "crlf\r\nline"},
+		{"Excel", func(c *Converter) { c.SetExcelCSV(';') }, "crlf\nline"},
+		{"UTF-16", func(c *Converter) {
+			c.OutputEncoding = unicode.UTF16(unicode.LittleEndian, unicode.UseBOM)
+		}, "crlf\nline"},
+		{"Windows-1252", func(c *Converter) { c.OutputEncoding = charmap.Windows1252 }, "crlf\nline"},
+	}
+
+	for _, test := range tests {
+		db, err := sql.Open("test", "roundtrip")
+		if err != nil {
+			t.Fatal(err)
+		}
+		exec(t, db, "WIPE")
+		exec(t, db, "CREATE|values|v=nullstring")
+		for _, value := range values {
+			exec(t, db, "INSERT|values|v=?", value)
+		}
+		rows, err := db.Query("SELECT|values|v|")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := WriteConfig(rows)
+		c.LogLevel = Error
+		c.SchemaFormat = CSVW
+		test.setup(c)
+		fileName := filepath.Join(t.TempDir(), "values.csv.gz")
+		_, err = c.WriteFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The dialect comes from the CSVW sidecar
+		schema, err := ReadSchemaFile(fileName + "-metadata.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := OpenFile(fileName, &ReaderConfig{Schema: schema})
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		for i, value := range values {
+			record, err := reader.Read()
+			if err != nil {
+				t.Fatalf("%v: row %v: %v", test.name, i+1, err)
+			}
+			switch {
+			case value == nil:
+				if !reader.IsNull(0) {
+					t.Errorf("%v: row %v: %q is not NULL", test.name, i+1, record[0])
+				}
+			case reader.IsNull(0):
+				t.Errorf("%v: row %v: %q is NULL", test.name, i+1, value)
+			case value == "crlf\r\nline":
+				if record[0] != test.crlf {
+					t.Errorf("%v: row %v: got %q, expected %q", test.name, i+1, record[0], test.crlf)
+				}
+			case record[0] != value:
+				t.Errorf("%v: row %v: got %q, expected %q", test.name, i+1, record[0], value)
+			}
+		}
+		if _, err = reader.Read(); err != io.EOF {
+			t.Errorf("%v: expected io.EOF, got %v", test.name, err)
+		}
+		reader.Close()
+	}
+}
+
+func TestReaderDefaultNullString(t *testing.T) {
+	// Empty strings are quoted, NULLs are not
+	reader, err := NewReader(strings.NewReader("a,b,c\n\"\",,x\n"), &ReaderConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := reader.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nulls := []bool{reader.IsNull(0), reader.IsNull(1), reader.IsNull(2)}
+	if !reflect.DeepEqual(record, []string{"", "", "x"}) || !reflect.DeepEqual(nulls, []bool{false, true, false}) {
+		t.Errorf("Got %q with NULLs %v", record, nulls)
+	}
+
+	// A blank line is a single NULL
+	reader, err = NewReader(strings.NewReader("a\n\n\"\"\n"), &ReaderConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, null := range []bool{true, false} {
+		record, err = reader.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record[0] != "" || reader.IsNull(0) != null {
+			t.Errorf("Got %q, expected NULL to be %v", record, null)
+		}
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	reader, err := NewReader(strings.NewReader("a,b\n1,2,3\n"), &ReaderConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = reader.Read()
+	if err == nil {
+		t.Error("Expected an error for a row of 3 fields")
+	}
+
+	_, err = NewReader(strings.NewReader("a\n"), &ReaderConfig{Schema: &Schema{Encoding: "UTF-8-BOM"}})
+	if err == nil {
+		t.Error("Expected an error for an unknown encoding")
+	}
+	_, err = NewReader(strings.NewReader("a\n"), &ReaderConfig{Delimiter: '"'})
+	if err == nil {
+		t.Error("Expected an error for an invalid dialect")
+	}
+}
+
+func TestEscapeFormulas(t *testing.T) {
+	row := []string{"=SUM(A1:A9)", "+1", "-1.5", "-x", "@cmd", "\tx", "\rx", "", "a=b", "+33 6 12 34 56 78", "=NULL"}
+	nulls := make([]bool, len(row))
+	nulls[len(row)-1] = true
+	expected := []string{"'=SUM(A1:A9)", "+1", "-1.5", "'-x", "'@cmd", "'\tx", "'\rx", "", "a=b", "'+33 6 12 34 56 78", "=NULL"}
+
+	escaped := escapeFormulas(row, nulls)
+	if !reflect.DeepEqual(escaped, expected) {
+		t.Errorf("Got %q, expected %q", escaped, expected)
+	}
+	if row[0] != "=SUM(A1:A9)" {
+		t.Error("The row was modified in place")
+	}
+}
+
+func TestExcelCSV(t *testing.T) {
+	db, err := sql.Open("test", "excel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, db, "WIPE")
+	exec(t, db, "CREATE|sheet|formula=nullstring,text=string")
+	exec(t, db, "INSERT|sheet|formula=?,text=?", "=HYPERLINK(\"http://x\")", "a;b")
+	exec(t, db, "INSERT|sheet|formula=?,text=?", "-1", "line\nbreak")
+	exec(t, db, "INSERT|sheet|formula=?,text=?", nil, "é")
+	rows, err := db.Query("SELECT|sheet|formula,text|")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := WriteConfig(rows)
+	c.LogLevel = Error
+	c.SetExcelCSV(';')
+	var buf bytes.Buffer
+	err = c.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "\ufeffformula;text\r\n" +
+		"\"'=HYPERLINK(\"\"http://x\"\")\";\"a;b\"\r\n" +
+		"-1;\"line\r\nbreak\"\r\n" +
+		";é\r\n"
+	if got := gunzipString(t, buf.Bytes()); got != expected {
+		t.Fatalf("Got %q, expected %q", got, expected)
+	}
+
+	// The byte order mark is skipped when reading back
+	reader, err := NewReader(&buf, &ReaderConfig{Delimiter: ';'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if columns := reader.Columns(); !reflect.DeepEqual(columns, []string{"formula", "text"}) {
+		t.Errorf("Got columns %q", columns)
+	}
+	record, err := reader.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record[0] != "'=HYPERLINK(\"http://x\")" {
+		t.Errorf("Got %q", record[0])
+	}
+
+	// WriteBOM is for UTF-8 only
+	c = WriteConfig(testRows(t, "people", "alice"))
+	c.LogLevel = Error
+	c.SetExcelCSV(',')
+	c.OutputEncoding = unicode.UTF16(unicode.LittleEndian, unicode.UseBOM)
+	err = c.Write(&bytes.Buffer{})
+	if err == nil {
+		t.Error("Expected an error for WriteBOM with OutputEncoding")
+	}
+}
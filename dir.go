@@ -0,0 +1,271 @@
+package sqltocsvgzip
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultNameTemplate = "{query}_{timestamp}_{seq}"
+
+// DirConfig describes the files written by WriteDir.
+type DirConfig struct {
+	Dir          string
+	Query        string        // Name of the query, used in file names (default is "export")
+	NameTemplate string        // File name with {query}, {timestamp} and {seq} placeholders (default is "{query}_{timestamp}_{seq}" and the extension of the OutputFormat)
+	MaxFileRows  int64         // Start a new file once that many rows are written (default is no limit)
+	MaxFileBytes int64         // Start a new file once the compressed file reaches that size (default is no limit)
+	MaxAge       time.Duration // Delete files of the query older than that after the export (default is keep all)
+	MaxFiles     int           // Keep only the newest files of the query after the export (default is keep all)
+}
+
+// rotatingWriter is implemented by writers splitting the output into several files.
+// Write starts every file with its own gzip stream and headers.
+type rotatingWriter interface {
+	// full reports whether the current file, with rows rows written so far, is complete.
+	full(rows int64) bool
+	// rotate closes the current file and starts the next one.
+	rotate() error
+}
+
+// WriteDir writes the csv.gzip to one or more files in a directory.
+// Files are named after NameTemplate: {query} is replaced by Query,
+// {timestamp} by the UTC start time of the export and {seq} by the
+// sequence number of the file (0001, 0002, ...).
+// A new file is started whenever MaxFileRows or MaxFileBytes is reached.
+//
+// Every file is written atomically like WriteFile, using FileMode and
+// NoOverwrite. Once the export succeeds, older files of the same query
+// are pruned according to MaxAge and MaxFiles.
+func (c *Converter) WriteDir(config *DirConfig) (*ExportResult, error) {
+	c.startTimer()
+
+	// Explicitely unset s3 upload
+	c.S3Upload = false
+
+	if config.NameTemplate == "" {
+		dirConfig := *config
+		dirConfig.NameTemplate = defaultNameTemplate + c.OutputFormat.Extension()
+		config = &dirConfig
+	}
+
+	d := &dirWriter{
+		c:         c,
+		config:    config,
+		timestamp: c.startTime.UTC().Format("20060102T150405Z"),
+	}
+	err := d.open()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.Write(d)
+	if err == nil {
+		err = d.commit()
+	}
+	if err != nil {
+		d.abort()
+		return nil, err
+	}
+
+	err = config.prune(d.files)
+	if err != nil {
+		c.writeLog(Warn, fmt.Sprintf("Could not prune %v: %v", config.Dir, err))
+	}
+
+	c.result.Files = d.files
+	c.result.FileChecksumsSHA256 = d.checksums
+	c.stopTimer()
+	return c.Result(), nil
+}
+
+// dirWriter writes to the current temporary file of WriteDir.
+type dirWriter struct {
+	c         *Converter
+	config    *DirConfig
+	timestamp string
+	seq       int
+	file      *os.File
+	fileName  string
+	written   int64
+	hash      hash.Hash
+	files     []string
+	checksums []string
+}
+
+func (d *dirWriter) Write(p []byte) (int, error) {
+	n, err := d.file.Write(p)
+	d.written += int64(n)
+	d.hash.Write(p[:n])
+	return n, err
+}
+
+func (d *dirWriter) full(rows int64) bool {
+	if d.config.MaxFileRows > 0 && rows >= d.config.MaxFileRows {
+		return true
+	}
+	return d.config.MaxFileBytes > 0 && d.written >= d.config.MaxFileBytes
+}
+
+func (d *dirWriter) rotate() error {
+	err := d.commit()
+	if err != nil {
+		return err
+	}
+	return d.open()
+}
+
+// open creates the temporary file of the next file.
+func (d *dirWriter) open() error {
+	d.seq++
+	d.fileName = filepath.Join(d.config.Dir, d.config.fileName(d.timestamp, fmt.Sprintf("%04d", d.seq)))
+	d.written = 0
+	d.hash = sha256.New()
+
+	if d.c.NoOverwrite {
+		_, err := os.Lstat(d.fileName)
+		if err == nil {
+			return fmt.Errorf("File %v already exists", d.fileName)
+		}
+	}
+
+	f, err := createTempFile(d.fileName, d.c.FileMode)
+	if err != nil {
+		return err
+	}
+	d.file = f
+	return nil
+}
+
+// commit renames the current temporary file to its final name.
+func (d *dirWriter) commit() error {
+	err := d.file.Sync()
+	if closeErr := d.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = commitTempFile(d.file.Name(), d.fileName, d.c.NoOverwrite)
+	}
+	if err != nil {
+		return err
+	}
+
+	if d.c.SchemaFormat != NoSchema {
+		err = d.c.writeSchemaFile(d.fileName)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.c.writeLog(Info, "Successfully wrote file: "+d.fileName)
+	d.files = append(d.files, d.fileName)
+	d.checksums = append(d.checksums, hex.EncodeToString(d.hash.Sum(nil)))
+	return nil
+}
+
+// abort removes the current temporary file.
+// Files already committed are complete and are left in place.
+func (d *dirWriter) abort() {
+	d.file.Close()
+	os.Remove(d.file.Name())
+}
+
+// fileName expands NameTemplate.
+func (config *DirConfig) fileName(timestamp, seq string) string {
+	return strings.NewReplacer("{query}", config.query(), "{timestamp}", timestamp, "{seq}", seq).Replace(config.nameTemplate())
+}
+
+// filePattern matches the file names NameTemplate expands to for Query,
+// whatever their timestamp and sequence number.
+func (config *DirConfig) filePattern() (*regexp.Regexp, error) {
+	pattern := strings.NewReplacer(
+		regexp.QuoteMeta("{query}"), regexp.QuoteMeta(config.query()),
+		regexp.QuoteMeta("{timestamp}"), `\d{8}T\d{6}Z`,
+		regexp.QuoteMeta("{seq}"), `\d{4,}`,
+	).Replace(regexp.QuoteMeta(config.nameTemplate()))
+	return regexp.Compile("^" + pattern + "$")
+}
+
+func (config *DirConfig) nameTemplate() string {
+	if config.NameTemplate == "" {
+		return defaultNameTemplate + CSV.Extension()
+	}
+	return config.NameTemplate
+}
+
+func (config *DirConfig) query() string {
+	if config.Query == "" {
+		return "export"
+	}
+	return config.Query
+}
+
+// Extensions of the schema sidecars, which are pruned with their file.
+var sidecarExtensions = []string{JSONSchema.Extension(), CSVW.Extension(), BigQueryDDL.Extension()}
+
+// prune deletes the files of the query beyond MaxFiles or older than MaxAge,
+// and their schema sidecars. Files of the query are the ones matching
+// NameTemplate; the files just written are always kept.
+func (config *DirConfig) prune(written []string) error {
+	if config.MaxAge <= 0 && config.MaxFiles <= 0 {
+		return nil
+	}
+
+	pattern, err := config.filePattern()
+	if err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(config.Dir)
+	if err != nil {
+		return err
+	}
+
+	keep := make(map[string]bool, len(written))
+	for _, fileName := range written {
+		keep[filepath.Base(fileName)] = true
+	}
+
+	files := make([]os.FileInfo, 0, len(entries))
+	for _, fi := range entries {
+		if fi.Mode().IsRegular() && pattern.MatchString(fi.Name()) {
+			files = append(files, fi)
+		}
+	}
+
+	// Newest first
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].ModTime().Equal(files[j].ModTime()) {
+			return files[i].Name() > files[j].Name()
+		}
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+
+	for i, fi := range files {
+		if keep[fi.Name()] {
+			continue
+		}
+		expired := config.MaxAge > 0 && time.Since(fi.ModTime()) > config.MaxAge
+		if expired || (config.MaxFiles > 0 && i >= config.MaxFiles) {
+			fileName := filepath.Join(config.Dir, fi.Name())
+			err = os.Remove(fileName)
+			if err != nil {
+				return err
+			}
+			for _, extension := range sidecarExtensions {
+				err = os.Remove(fileName + extension)
+				if err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package sqltocsvgzip
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestWriteDirChecksums(t *testing.T) {
+	dir := t.TempDir()
+	c := WriteConfig(testRows(t, "people", "alice", "bob", "carol"))
+	c.LogLevel = Error
+	result, err := c.WriteDir(&DirConfig{Dir: dir, Query: "people", MaxFileRows: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Files) != 2 || len(result.FileChecksumsSHA256) != 2 {
+		t.Fatalf("Expected 2 files and checksums, got %v and %v", result.Files, result.FileChecksumsSHA256)
+	}
+	whole := sha256.New()
+	for i, fileName := range result.Files {
+		b, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		whole.Write(b)
+		sum := sha256.Sum256(b)
+		if checksum := hex.EncodeToString(sum[:]); result.FileChecksumsSHA256[i] != checksum {
+			t.Errorf("Checksum of %v is %v, expected %v", fileName, result.FileChecksumsSHA256[i], checksum)
+		}
+	}
+	if checksum := hex.EncodeToString(whole.Sum(nil)); result.ChecksumSHA256 != checksum {
+		t.Errorf("ChecksumSHA256 is %v, expected %v", result.ChecksumSHA256, checksum)
+	}
+}
+
+func TestWriteDirPruneSidecars(t *testing.T) {
+	for _, nameTemplate := range []string{"", "{query}_{timestamp}_{seq}"} {
+		dir := t.TempDir()
+		old := time.Now().Add(-48 * time.Hour)
+		for _, fileName := range []string{
+			"people_20210101T000000Z_0001.csv.gz",
+			"people_20210101T000000Z_0001.csv.gz.schema.json",
+			"people_20210101T000000Z_0001",
+			"people_20210101T000000Z_0001.schema.json",
+			"people_20210101T000000Z_0001-metadata.json",
+			"other_20210101T000000Z_0001.csv.gz",
+			"people_archive_20210101T000000Z_0001.csv.gz",
+			"people_20210101T000000Z_0001.csv.gz.bak",
+		} {
+			fileName = filepath.Join(dir, fileName)
+			err := ioutil.WriteFile(fileName, []byte("old"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			os.Chtimes(fileName, old, old)
+		}
+
+		c := WriteConfig(testRows(t, "people", "alice"))
+		c.LogLevel = Error
+		c.SchemaFormat = JSONSchema
+		result, err := c.WriteDir(&DirConfig{Dir: dir, Query: "people", NameTemplate: nameTemplate, MaxAge: 24 * time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, fi := range files {
+			names = append(names, fi.Name())
+		}
+		written := filepath.Base(result.Files[0])
+		// Files of other queries sharing the prefix are not files of the query
+		expected := []string{
+			"other_20210101T000000Z_0001.csv.gz",
+			"people_archive_20210101T000000Z_0001.csv.gz",
+			"people_20210101T000000Z_0001.csv.gz.bak",
+			written,
+			written + ".schema.json",
+		}
+		// Files of another template are not files of the query
+		if nameTemplate == "" {
+			expected = append(expected, "people_20210101T000000Z_0001", "people_20210101T000000Z_0001-metadata.json", "people_20210101T000000Z_0001.schema.json")
+		} else {
+			expected = append(expected, "people_20210101T000000Z_0001.csv.gz", "people_20210101T000000Z_0001.csv.gz.schema.json")
+		}
+		sort.Strings(expected)
+		if len(names) != len(expected) {
+			t.Fatalf("Template %q left %v, expected %v", nameTemplate, names, expected)
+		}
+		for i := range names {
+			if names[i] != expected[i] {
+				t.Fatalf("Template %q left %v, expected %v", nameTemplate, names, expected)
+			}
+		}
+	}
+}
+
+func TestDirFilePattern(t *testing.T) {
+	tests := []struct {
+		config   DirConfig
+		fileName string
+		matches  bool
+	}{
+		{DirConfig{Query: "people"}, "people_20210101T000000Z_0001.csv.gz", true},
+		{DirConfig{Query: "people"}, "people_20210101T000000Z_12345.csv.gz", true},
+		{DirConfig{Query: "people"}, "people_archive_20210101T000000Z_0001.csv.gz", false},
+		{DirConfig{Query: "people"}, "daily_people_20210101T000000Z_0001.csv.gz", false},
+		{DirConfig{Query: "people"}, "people_2021-01-01_0001.csv.gz", false},
+		{DirConfig{Query: "people"}, "people_20210101T000000Z_1.csv.gz", false},
+		{DirConfig{Query: "people"}, "people_20210101T000000Z_0001.csv.gz.tmp", false},
+		{DirConfig{}, "export_20210101T000000Z_0001.csv.gz", true},
+		// Not glob or regexp patterns
+		{DirConfig{Query: "people*"}, "people_x_20210101T000000Z_0001.csv.gz", false},
+		{DirConfig{Query: "people*"}, "people*_20210101T000000Z_0001.csv.gz", true},
+		{DirConfig{Query: "p.ople"}, "people_20210101T000000Z_0001.csv.gz", false},
+		{DirConfig{Query: "people", NameTemplate: "{seq}-{query}.tsv"}, "0001-people.tsv", true},
+		{DirConfig{Query: "people", NameTemplate: "{seq}-{query}.tsv"}, "0001-people.tsv.schema.json", false},
+	}
+	for _, test := range tests {
+		pattern, err := test.config.filePattern()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pattern.MatchString(test.fileName) != test.matches {
+			t.Errorf("Query %q, template %q: expected match of %v to be %v", test.config.Query, test.config.NameTemplate, test.fileName, test.matches)
+		}
+	}
+}
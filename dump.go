@@ -0,0 +1,324 @@
+package sqltocsvgzip
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// ArchiveFormat is the format of a Dump archive.
+type ArchiveFormat int
+
+const (
+	// Zip streams every table straight into the archive.
+	Zip ArchiveFormat = iota
+	// Tar spools every table to a temporary file in SpoolDir first,
+	// as tar headers need the size of the entry.
+	Tar
+)
+
+// DumpConfig describes the tables written by Dump.
+type DumpConfig struct {
+	Tables   []string      // Tables to dump, e.g. "public.users", quoted by Dump
+	Schema   string        // Dump every table of the schema, listed from information_schema, if Tables is empty
+	Format   ArchiveFormat // Zip or Tar (default is Zip)
+	SpoolDir string        // Directory of the temporary files of the Tar entries, required by Tar
+	DDL      bool          // Add a CREATE TABLE statement built from the column types of every table
+
+	// Query returns the query dumping table (default is "SELECT * FROM <table>", the table being quoted).
+	Query func(table string) string
+	// Configure lets you customize the Converter of every table,
+	// e.g. to set up masking or encryption.
+	Configure func(table string, c *Converter)
+}
+
+// DumpManifest describes the content of a Dump archive.
+// It is stored as manifest.json at the end of the archive.
+type DumpManifest struct {
+	CreatedAt time.Time   `json:"createdAt"`
+	Tables    []DumpTable `json:"tables"`
+}
+
+// DumpTable describes a table of a Dump archive.
+type DumpTable struct {
+	Name              string   `json:"name"`
+	File              string   `json:"file"`
+	DDLFile           string   `json:"ddlFile,omitempty"`
+	Columns           []string `json:"columns"`
+	RowCount          int64    `json:"rowCount"`
+	CompressedBytes   int64    `json:"compressedBytes"`
+	UncompressedBytes int64    `json:"uncompressedBytes"`
+	ChecksumSHA256    string   `json:"checksumSHA256"`
+}
+
+// Dump writes every table to its own csv.gzip inside a single zip or tar archive,
+// followed by a manifest.json. A zip archive is streamed to w; a tar archive
+// needs local storage, every entry being spooled to SpoolDir first.
+func Dump(db *sql.DB, w io.Writer, config *DumpConfig) (*DumpManifest, error) {
+	if config.Format == Tar && config.SpoolDir == "" {
+		return nil, fmt.Errorf("SpoolDir is needed to spool the entries of a Tar archive")
+	}
+
+	dialect := detectDialect(db)
+	tables := config.Tables
+	if len(tables) == 0 {
+		if config.Schema == "" {
+			return nil, fmt.Errorf("Either Tables or Schema is needed to dump a database")
+		}
+		var err error
+		tables, err = schemaTables(db, dialect, config.Schema)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	archive := newArchiveWriter(w, config.Format, config.SpoolDir)
+	manifest := &DumpManifest{CreatedAt: time.Now().UTC()}
+	for _, table := range tables {
+		dumpTable, err := config.dumpTable(db, dialect, archive, table)
+		if err != nil {
+			archive.abort()
+			return nil, fmt.Errorf("Dump %v: %v", table, err)
+		}
+		manifest.Tables = append(manifest.Tables, *dumpTable)
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		archive.abort()
+		return nil, err
+	}
+	err = archive.add("manifest.json", manifestJSON)
+	if err != nil {
+		archive.abort()
+		return nil, err
+	}
+
+	err = archive.close()
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func (config *DumpConfig) dumpTable(db *sql.DB, dialect sqlDialect, archive *archiveWriter, table string) (*DumpTable, error) {
+	query := "SELECT * FROM " + dialect.quoteIdentifier(table)
+	if config.Query != nil {
+		query = config.Query(table)
+	}
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dumpTable := &DumpTable{Name: table}
+
+	if config.DDL {
+		columnTypes, err := rows.ColumnTypes()
+		if err != nil {
+			return nil, err
+		}
+		dumpTable.DDLFile = table + ".sql"
+		err = archive.add(dumpTable.DDLFile, []byte(createTableDDL(dialect, table, columnTypes)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c := WriteConfig(rows)
+	if config.Configure != nil {
+		config.Configure(table, c)
+	}
+
+	dumpTable.File = table + c.OutputFormat.Extension()
+	entry, err := archive.create(dumpTable.File)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Write(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	result := c.Result()
+	dumpTable.Columns = result.Columns
+	dumpTable.RowCount = result.RowCount
+	dumpTable.CompressedBytes = result.CompressedBytes
+	dumpTable.UncompressedBytes = result.UncompressedBytes
+	dumpTable.ChecksumSHA256 = result.ChecksumSHA256
+	return dumpTable, nil
+}
+
+// schemaTables lists the tables of schema from information_schema.
+func schemaTables(db *sql.DB, dialect sqlDialect, schema string) ([]string, error) {
+	rows, err := db.Query("SELECT table_name FROM information_schema.tables"+
+		" WHERE table_schema = "+dialect.placeholder(1)+" AND table_type = 'BASE TABLE'"+
+		" ORDER BY table_name", schema)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		err = rows.Scan(&table)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, schema+"."+table)
+	}
+	return tables, rows.Err()
+}
+
+// createTableDDL returns a simple CREATE TABLE statement for the columns.
+// Types are the ones reported by the driver, so the statement targets the
+// source database.
+func createTableDDL(dialect sqlDialect, table string, columnTypes []*sql.ColumnType) string {
+	var ddl strings.Builder
+	ddl.WriteString("CREATE TABLE " + dialect.quoteIdentifier(table) + " (\n")
+	for i, columnType := range columnTypes {
+		ddl.WriteString("    " + dialect.quote(columnType.Name()) + " " + columnDDLType(columnType))
+		if nullable, ok := columnType.Nullable(); ok && !nullable {
+			ddl.WriteString(" NOT NULL")
+		}
+		if i < len(columnTypes)-1 {
+			ddl.WriteString(",")
+		}
+		ddl.WriteString("\n")
+	}
+	ddl.WriteString(");\n")
+	return ddl.String()
+}
+
+func columnDDLType(columnType *sql.ColumnType) string {
+	typeName := columnType.DatabaseTypeName()
+	if typeName == "" {
+		typeName = "TEXT"
+	}
+	if precision, scale, ok := columnType.DecimalSize(); ok {
+		return fmt.Sprintf("%v(%v,%v)", typeName, precision, scale)
+	}
+	// Unbounded types report the maximum int64 as length
+	if length, ok := columnType.Length(); ok && length > 0 && length < 1<<31 {
+		return fmt.Sprintf("%v(%v)", typeName, length)
+	}
+	return typeName
+}
+
+// archiveWriter adds entries to a zip or tar archive.
+// The writer returned by create is valid until the next call.
+type archiveWriter struct {
+	format   ArchiveFormat
+	zw       *zip.Writer
+	tw       *tar.Writer
+	spoolDir string
+	pending  *os.File // Tar entry being spooled
+	name     string
+	modTime  time.Time
+}
+
+func newArchiveWriter(w io.Writer, format ArchiveFormat, spoolDir string) *archiveWriter {
+	a := &archiveWriter{format: format, spoolDir: spoolDir, modTime: time.Now()}
+	if format == Tar {
+		a.tw = tar.NewWriter(w)
+	} else {
+		a.zw = zip.NewWriter(w)
+	}
+	return a
+}
+
+// create starts a new entry.
+func (a *archiveWriter) create(name string) (io.Writer, error) {
+	err := a.flush()
+	if err != nil {
+		return nil, err
+	}
+
+	if a.format != Tar {
+		// Entries are compressed already
+		return a.zw.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Store,
+			Modified: a.modTime,
+		})
+	}
+
+	f, err := ioutil.TempFile(a.spoolDir, "sqltocsvgzip-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	a.pending = f
+	a.name = name
+	return f, nil
+}
+
+// add adds an entry with the given content.
+func (a *archiveWriter) add(name string, content []byte) error {
+	entry, err := a.create(name)
+	if err != nil {
+		return err
+	}
+	_, err = entry.Write(content)
+	return err
+}
+
+// flush copies the spooled tar entry into the archive.
+func (a *archiveWriter) flush() error {
+	if a.pending == nil {
+		return nil
+	}
+	f := a.pending
+	a.pending = nil
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = a.tw.WriteHeader(&tar.Header{
+		Name:    a.name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: a.modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(a.tw, f)
+	return err
+}
+
+func (a *archiveWriter) close() error {
+	if a.format != Tar {
+		return a.zw.Close()
+	}
+	err := a.flush()
+	if err != nil {
+		return err
+	}
+	return a.tw.Close()
+}
+
+// abort removes the spooled tar entry, if any.
+func (a *archiveWriter) abort() {
+	if a.pending != nil {
+		a.pending.Close()
+		os.Remove(a.pending.Name())
+		a.pending = nil
+	}
+}
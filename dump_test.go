@@ -0,0 +1,131 @@
+package sqltocsvgzip
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func newDumpDB(t *testing.T) *sql.DB {
+	testRows(t, "people", "alice", "bob").Close()
+	db, err := sql.Open("test", "people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestDumpZip(t *testing.T) {
+	db := newDumpDB(t)
+	var queried []string
+	var buf bytes.Buffer
+	manifest, err := Dump(db, &buf, &DumpConfig{
+		Tables: []string{"public.people", `odd"name`},
+		DDL:    true,
+		Query: func(table string) string {
+			queried = append(queried, table)
+			return "SELECT|people|name|"
+		},
+		Configure: func(table string, c *Converter) {
+			c.LogLevel = Error
+			if table == `odd"name` {
+				c.OutputFormat = SQLInsert
+				c.SchemaTable = "people"
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifest.Tables) != 2 || manifest.Tables[0].File != "public.people.csv.gz" || manifest.Tables[1].File != `odd"name.sql.gz` {
+		t.Fatalf("Unexpected manifest: %+v", manifest.Tables)
+	}
+	if manifest.Tables[0].RowCount != 2 {
+		t.Errorf("RowCount is %v, expected 2", manifest.Tables[0].RowCount)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[f.Name], _ = ioutil.ReadAll(rc)
+		rc.Close()
+	}
+	if got := gunzipString(t, entries["public.people.csv.gz"]); got != "name\nalice\nbob\n" {
+		t.Errorf("Unexpected entry: %q", got)
+	}
+	if ddl := string(entries["public.people.sql"]); !strings.HasPrefix(ddl, `CREATE TABLE "public"."people" (`+"\n"+`    "name" `) {
+		t.Errorf("Unexpected DDL: %q", ddl)
+	}
+	if ddl := string(entries[`odd"name.sql`]); !strings.HasPrefix(ddl, `CREATE TABLE "odd""name" (`) {
+		t.Errorf("Unexpected DDL: %q", ddl)
+	}
+	if _, ok := entries["manifest.json"]; !ok {
+		t.Error("manifest.json is missing")
+	}
+}
+
+func TestDumpQuotesTables(t *testing.T) {
+	db := newDumpDB(t)
+	// The fake driver fails every query but shows the one it got
+	_, err := Dump(db, ioutil.Discard, &DumpConfig{Tables: []string{"public.people; DROP TABLE people"}})
+	if err == nil || !strings.Contains(err.Error(), `"SELECT * FROM \"public\".\"people; DROP TABLE people\""`) {
+		t.Fatalf("Expected the quoted query in the error, got %v", err)
+	}
+}
+
+func TestDumpTar(t *testing.T) {
+	db := newDumpDB(t)
+	config := &DumpConfig{
+		Tables: []string{"people"},
+		Format: Tar,
+		Query:  func(table string) string { return "SELECT|people|name|" },
+		Configure: func(table string, c *Converter) {
+			c.LogLevel = Error
+		},
+	}
+	_, err := Dump(db, ioutil.Discard, config)
+	if err == nil {
+		t.Fatal("Expected an error without SpoolDir")
+	}
+
+	spoolDir := t.TempDir()
+	config.SpoolDir = spoolDir
+	var buf bytes.Buffer
+	_, err = Dump(db, &buf, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(&buf)
+	var names []string
+	var manifest DumpManifest
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, header.Name)
+		if header.Name == "manifest.json" {
+			json.NewDecoder(tr).Decode(&manifest)
+		}
+	}
+	if strings.Join(names, ",") != "people.csv.gz,manifest.json" || len(manifest.Tables) != 1 {
+		t.Errorf("Unexpected entries %v, manifest %+v", names, manifest)
+	}
+	if files, _ := ioutil.ReadDir(spoolDir); len(files) != 0 {
+		t.Errorf("%v spooled files left", len(files))
+	}
+}
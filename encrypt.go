@@ -0,0 +1,298 @@
+package sqltocsvgzip
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	aesGCMMagic     = "SQLGZAES"
+	aesGCMVersion   = 2
+	aesGCMChunkSize = 64 * 1024
+	aesGCMNonceSize = 7
+	aesGCMSaltSize  = 16
+	// magic + version + chunk size + salt
+	aesGCMHeaderSize = len(aesGCMMagic) + 1 + 4 + aesGCMSaltSize
+	aesGCMKeyInfo    = "sqltocsvgzip AES-256-GCM stream key"
+)
+
+// EncryptFunc wraps the compressed output in an encrypted stream.
+// The returned WriteCloser is closed once all data has been written.
+type EncryptFunc func(w io.Writer) (io.WriteCloser, error)
+
+// SetEncryption lets you specify an EncryptFunc for this conversion.
+// The compressed stream is encrypted before it reaches the io.Writer
+// or the S3 part buffers.
+func (c *Converter) SetEncryption(encrypt EncryptFunc) {
+	c.encrypt = encrypt
+}
+
+// AgeEncryption returns an EncryptFunc which encrypts the output
+// to the given age X25519 recipients ("age1...").
+// The output can be decrypted with the age CLI or NewAgeReader.
+func AgeEncryption(recipients ...string) (EncryptFunc, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("At least one age recipient is required")
+	}
+
+	ageRecipients := make([]age.Recipient, len(recipients))
+	for i, recipient := range recipients {
+		r, err := age.ParseX25519Recipient(recipient)
+		if err != nil {
+			return nil, err
+		}
+		ageRecipients[i] = r
+	}
+
+	return func(w io.Writer) (io.WriteCloser, error) {
+		return age.Encrypt(w, ageRecipients...)
+	}, nil
+}
+
+// NewAgeReader decrypts a stream encrypted with AgeEncryption
+// using the given age X25519 identities ("AGE-SECRET-KEY-1...").
+func NewAgeReader(r io.Reader, identities ...string) (io.Reader, error) {
+	ageIdentities := make([]age.Identity, len(identities))
+	for i, identity := range identities {
+		id, err := age.ParseX25519Identity(identity)
+		if err != nil {
+			return nil, err
+		}
+		ageIdentities[i] = id
+	}
+	return age.Decrypt(r, ageIdentities...)
+}
+
+// AESGCMEncryption returns an EncryptFunc which encrypts the output with
+// AES-256-GCM using a caller supplied 32 byte key.
+// The output is split into 64Kb chunks, each sealed separately, so it can be
+// streamed and decrypted without buffering. Use NewAESGCMReader to decrypt it.
+//
+// Format: "SQLGZAES" | version (1 byte) | chunk size (uint32) | salt (16 bytes) | chunks...
+// Every stream is encrypted with its own key, derived from key and the random
+// salt with HKDF-SHA256. The nonce of each chunk is a uint32 chunk counter,
+// preceded by 7 zero bytes, and a byte set to 1 for the last chunk.
+// The header is authenticated with every chunk.
+func AESGCMEncryption(key []byte) (EncryptFunc, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("AES-256-GCM requires a 32 byte key. Got %v bytes", len(key))
+	}
+	key = append([]byte(nil), key...)
+
+	return func(w io.Writer) (io.WriteCloser, error) {
+		header := make([]byte, aesGCMHeaderSize)
+		copy(header, aesGCMMagic)
+		header[len(aesGCMMagic)] = aesGCMVersion
+		binary.BigEndian.PutUint32(header[len(aesGCMMagic)+1:], aesGCMChunkSize)
+		salt := header[len(aesGCMMagic)+5:]
+		_, err := io.ReadFull(rand.Reader, salt)
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := newAESGCMStream(key, salt)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = w.Write(header)
+		if err != nil {
+			return nil, err
+		}
+
+		return &aesGCMWriter{
+			w:      w,
+			aead:   aead,
+			header: header,
+			buf:    make([]byte, 0, aesGCMChunkSize),
+		}, nil
+	}, nil
+}
+
+// NewAESGCMReader decrypts a stream encrypted with AESGCMEncryption.
+// An error is returned if the stream was modified or truncated.
+func NewAESGCMReader(r io.Reader, key []byte) (io.Reader, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("AES-256-GCM requires a 32 byte key. Got %v bytes", len(key))
+	}
+
+	header := make([]byte, aesGCMHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read encryption header: %v", err)
+	}
+	if string(header[:len(aesGCMMagic)]) != aesGCMMagic {
+		return nil, fmt.Errorf("Not an AES-GCM encrypted stream")
+	}
+	if version := header[len(aesGCMMagic)]; version != aesGCMVersion {
+		return nil, fmt.Errorf("Unsupported encryption version: %v", version)
+	}
+
+	// The header is only authenticated with the chunks, do not trust the chunk size
+	chunkSize := binary.BigEndian.Uint32(header[len(aesGCMMagic)+1:])
+	if chunkSize != aesGCMChunkSize {
+		return nil, fmt.Errorf("Unsupported encryption chunk size: %v", chunkSize)
+	}
+
+	aead, err := newAESGCMStream(key, header[len(aesGCMMagic)+5:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &aesGCMReader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		header: header,
+		chunk:  make([]byte, aesGCMChunkSize+aead.Overhead()),
+	}, nil
+}
+
+// newAESGCMStream returns the AEAD of a stream, keyed with HKDF-SHA256(key, salt).
+func newAESGCMStream(key, salt []byte) (cipher.AEAD, error) {
+	streamKey := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(aesGCMKeyInfo)), streamKey)
+	if err != nil {
+		return nil, err
+	}
+	return newAESGCM(streamKey)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("AES-256-GCM requires a 32 byte key. Got %v bytes", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// aesGCMNonce builds the nonce for the chunk with the given counter.
+func aesGCMNonce(counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[aesGCMNonceSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type aesGCMWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte
+	counter uint32
+	closed  bool
+}
+
+func (a *aesGCMWriter) Write(p []byte) (n int, err error) {
+	if a.closed {
+		return 0, fmt.Errorf("Write to closed encryption stream")
+	}
+
+	n = len(p)
+	for len(p) > 0 {
+		// Only seal a full chunk once more data follows,
+		// so that the last chunk is always sealed by Close.
+		if len(a.buf) == aesGCMChunkSize {
+			err = a.seal(false)
+			if err != nil {
+				return 0, err
+			}
+		}
+		free := aesGCMChunkSize - len(a.buf)
+		if free > len(p) {
+			free = len(p)
+		}
+		a.buf = append(a.buf, p[:free]...)
+		p = p[free:]
+	}
+	return n, nil
+}
+
+// Close seals the last chunk. It does not close the underlying writer.
+func (a *aesGCMWriter) Close() error {
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	return a.seal(true)
+}
+
+func (a *aesGCMWriter) seal(last bool) error {
+	if a.counter == ^uint32(0) {
+		return fmt.Errorf("Encryption stream exceeds maximum number of chunks")
+	}
+	nonce := aesGCMNonce(a.counter, last)
+	_, err := a.w.Write(a.aead.Seal(nil, nonce, a.buf, a.header))
+	if err != nil {
+		return err
+	}
+	a.counter++
+	a.buf = a.buf[:0]
+	return nil
+}
+
+type aesGCMReader struct {
+	r         *bufio.Reader
+	aead      cipher.AEAD
+	header    []byte
+	chunk     []byte
+	plaintext bytes.Reader
+	counter   uint32
+	done      bool
+}
+
+func (a *aesGCMReader) Read(p []byte) (int, error) {
+	for a.plaintext.Len() == 0 {
+		if a.done {
+			return 0, io.EOF
+		}
+		err := a.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return a.plaintext.Read(p)
+}
+
+// open reads and decrypts the next chunk.
+func (a *aesGCMReader) open() error {
+	n, err := io.ReadFull(a.r, a.chunk)
+	last := false
+	switch err {
+	case nil:
+		// A full chunk is the last one only if nothing follows it
+		if _, peekErr := a.r.Peek(1); peekErr == io.EOF {
+			last = true
+		}
+	case io.ErrUnexpectedEOF:
+		last = true
+	case io.EOF:
+		return fmt.Errorf("Encrypted stream is truncated")
+	default:
+		return err
+	}
+
+	nonce := aesGCMNonce(a.counter, last)
+	plaintext, err := a.aead.Open(nil, nonce, a.chunk[:n], a.header)
+	if err != nil {
+		return fmt.Errorf("Unable to decrypt chunk #%v: %v", a.counter, err)
+	}
+	a.counter++
+	a.done = last
+	a.plaintext.Reset(plaintext)
+	return nil
+}
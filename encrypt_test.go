@@ -0,0 +1,233 @@
+package sqltocsvgzip
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func newTestAESKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func encryptAESGCM(t *testing.T, key, plaintext []byte) []byte {
+	t.Helper()
+	encrypt, err := AESGCMEncryption(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w, err := encrypt(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Odd sized writes, across chunk boundaries
+	for len(plaintext) > 0 {
+		n := 10000
+		if n > len(plaintext) {
+			n = len(plaintext)
+		}
+		_, err = w.Write(plaintext[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext = plaintext[n:]
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decryptAESGCM(key, ciphertext []byte) ([]byte, error) {
+	r, err := NewAESGCMReader(bytes.NewReader(ciphertext), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestAESGCMRoundTrip(t *testing.T) {
+	key := newTestAESKey(t)
+	for _, size := range []int{0, 1, aesGCMChunkSize - 1, aesGCMChunkSize, aesGCMChunkSize + 1, 3*aesGCMChunkSize + 123} {
+		plaintext := make([]byte, size)
+		_, err := rand.Read(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ciphertext := encryptAESGCM(t, key, plaintext)
+		got, err := decryptAESGCM(key, ciphertext)
+		if err != nil {
+			t.Fatalf("Size %v: %v", size, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("Size %v: decrypted data differs", size)
+		}
+
+		// Every stream has its own salt
+		if size > 0 && bytes.Equal(ciphertext, encryptAESGCM(t, key, plaintext)) {
+			t.Errorf("Size %v: same ciphertext twice", size)
+		}
+	}
+}
+
+func TestAESGCMInvalidKey(t *testing.T) {
+	_, err := AESGCMEncryption(make([]byte, 16))
+	if err == nil {
+		t.Error("Expected an error for a 16 byte key")
+	}
+	_, err = NewAESGCMReader(&bytes.Buffer{}, make([]byte, 31))
+	if err == nil {
+		t.Error("Expected an error for a 31 byte key")
+	}
+
+	ciphertext := encryptAESGCM(t, newTestAESKey(t), []byte("secret"))
+	_, err = decryptAESGCM(newTestAESKey(t), ciphertext)
+	if err == nil {
+		t.Error("Expected an error with the wrong key")
+	}
+}
+
+func TestAESGCMTruncated(t *testing.T) {
+	key := newTestAESKey(t)
+	plaintext := make([]byte, 2*aesGCMChunkSize+100)
+	ciphertext := encryptAESGCM(t, key, plaintext)
+	sealedChunk := aesGCMChunkSize + 16
+
+	for _, size := range []int{
+		0,
+		aesGCMHeaderSize - 1,
+		aesGCMHeaderSize,                      // no chunk at all
+		aesGCMHeaderSize + sealedChunk,        // last chunks dropped
+		aesGCMHeaderSize + 2*sealedChunk,      // last chunk dropped
+		aesGCMHeaderSize + 2*sealedChunk + 50, // last chunk cut
+		len(ciphertext) - 1,
+	} {
+		got, err := decryptAESGCM(key, ciphertext[:size])
+		if err == nil {
+			t.Errorf("Truncated to %v bytes: expected an error, decrypted %v bytes", size, len(got))
+		}
+	}
+}
+
+func TestAESGCMTampered(t *testing.T) {
+	key := newTestAESKey(t)
+	plaintext := make([]byte, 2*aesGCMChunkSize+100)
+	ciphertext := encryptAESGCM(t, key, plaintext)
+	sealedChunk := aesGCMChunkSize + 16
+
+	tamper := func(name string, modify func(b []byte) []byte) {
+		b := modify(append([]byte(nil), ciphertext...))
+		_, err := decryptAESGCM(key, b)
+		if err == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+	}
+	tamper("Salt", func(b []byte) []byte {
+		b[aesGCMHeaderSize-1] ^= 1
+		return b
+	})
+	tamper("Version 1", func(b []byte) []byte {
+		b[len(aesGCMMagic)] = 1
+		return b
+	})
+	tamper("Chunk size", func(b []byte) []byte {
+		b[len(aesGCMMagic)+4] ^= 1
+		return b
+	})
+	tamper("First chunk", func(b []byte) []byte {
+		b[aesGCMHeaderSize+10] ^= 1
+		return b
+	})
+	tamper("Last chunk", func(b []byte) []byte {
+		b[len(b)-1] ^= 1
+		return b
+	})
+	tamper("Swapped chunks", func(b []byte) []byte {
+		first := b[aesGCMHeaderSize : aesGCMHeaderSize+sealedChunk]
+		second := b[aesGCMHeaderSize+sealedChunk : aesGCMHeaderSize+2*sealedChunk]
+		swapped := append([]byte(nil), b[:aesGCMHeaderSize]...)
+		swapped = append(swapped, second...)
+		swapped = append(swapped, first...)
+		return append(swapped, b[aesGCMHeaderSize+2*sealedChunk:]...)
+	})
+	tamper("Appended data", func(b []byte) []byte {
+		return append(b, 0)
+	})
+}
+
+func TestAgeRoundTrip(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = AgeEncryption()
+	if err == nil {
+		t.Error("Expected an error without recipients")
+	}
+	encrypt, err := AgeEncryption(identity.Recipient().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w, err := encrypt(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "secret")
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewAgeReader(&buf, identity.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil || string(got) != "secret" {
+		t.Errorf("Got %q, %v", got, err)
+	}
+}
+
+func TestWriteEncrypted(t *testing.T) {
+	key := newTestAESKey(t)
+	encrypt, err := AESGCMEncryption(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := WriteConfig(testRows(t, "people", "alice", "bob"))
+	c.LogLevel = Error
+	c.SetEncryption(encrypt)
+	var buf bytes.Buffer
+	err = c.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "alice") || !strings.HasPrefix(buf.String(), aesGCMMagic) {
+		t.Fatalf("Output is not encrypted: %q", buf.String())
+	}
+
+	compressed, err := decryptAESGCM(key, buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gunzipString(t, compressed); got != "name\nalice\nbob\n" {
+		t.Errorf("Got %q", got)
+	}
+}
@@ -122,6 +122,8 @@ type fakeStmt struct {
 	whereCol []string // used by SELECT (all placeholders)
 
 	placeholderConverter []driver.ValueConverter // used by INSERT
+
+	next *fakeStmt // next SELECT of a query returning several result sets
 }
 
 var fdriver driver.Driver = &fakeDriver{}
@@ -442,6 +444,9 @@ func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
 	if c.db == nil {
 		panic("nil c.db; conn = " + fmt.Sprintf("%#v", c))
 	}
+	if strings.HasPrefix(query, "SELECT|") && strings.Contains(query, ";") {
+		return c.prepareResultSets(query)
+	}
 	parts := strings.Split(query, "|")
 	if len(parts) < 1 {
 		return nil, errf("empty query")
@@ -470,6 +475,34 @@ func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
 	return stmt, nil
 }
 
+// prepareResultSets prepares SELECTs separated by ";",
+// each of them returning one result set.
+func (c *fakeConn) prepareResultSets(query string) (driver.Stmt, error) {
+	var first, last *fakeStmt
+	for _, q := range strings.Split(query, ";") {
+		if !strings.HasPrefix(q, "SELECT|") {
+			if first != nil {
+				first.Close()
+			}
+			return nil, errf("only SELECT queries can return several result sets, got %q", q)
+		}
+		stmt, err := c.Prepare(q)
+		if err != nil {
+			if first != nil {
+				first.Close()
+			}
+			return nil, err
+		}
+		if first == nil {
+			first = stmt.(*fakeStmt)
+		} else {
+			last.next = stmt.(*fakeStmt)
+		}
+		last = stmt.(*fakeStmt)
+	}
+	return first, nil
+}
+
 func (s *fakeStmt) ColumnConverter(idx int) driver.ValueConverter {
 	if len(s.placeholderConverter) == 0 {
 		return driver.DefaultParameterConverter
@@ -488,6 +521,9 @@ func (s *fakeStmt) Close() error {
 		s.c.incrStat(&s.c.stmtsClosed)
 		s.closed = true
 	}
+	if s.next != nil {
+		return s.next.Close()
+	}
 	return nil
 }
 
@@ -577,12 +613,28 @@ func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
 	if err != nil {
 		return nil, err
 	}
-
-	db := s.c.db
-	if len(args) != s.placeholders {
+	if len(args) != s.NumInput() {
 		panic("error in pkg db; should only get here if size is correct")
 	}
 
+	cursor, err := s.query(args[:s.placeholders])
+	if err != nil {
+		return nil, err
+	}
+	if s.next != nil {
+		next, err := s.next.Query(args[s.placeholders:])
+		if err != nil {
+			return nil, err
+		}
+		cursor.next = next.(*rowsCursor)
+	}
+	return cursor, nil
+}
+
+// query returns the result set of a single SELECT.
+func (s *fakeStmt) query(args []driver.Value) (*rowsCursor, error) {
+	db := s.c.db
+
 	db.mu.Lock()
 	t, ok := db.table(s.table)
 	db.mu.Unlock()
@@ -637,16 +689,25 @@ rows:
 		mrows = append(mrows, mrow)
 	}
 
+	types := make([]string, len(s.colName))
+	for i, name := range s.colName {
+		types[i] = t.coltype[colIdx[name]]
+	}
+
 	cursor := &rowsCursor{
 		pos:    -1,
 		rows:   mrows,
 		cols:   s.colName,
+		types:  types,
 		errPos: -1,
 	}
 	return cursor, nil
 }
 
 func (s *fakeStmt) NumInput() int {
+	if s.next != nil {
+		return s.placeholders + s.next.NumInput()
+	}
 	return s.placeholders
 }
 
@@ -662,6 +723,7 @@ func (tx *fakeTx) Rollback() error {
 
 type rowsCursor struct {
 	cols   []string
+	types  []string
 	pos    int
 	rows   []*row
 	closed bool
@@ -674,6 +736,8 @@ type rowsCursor struct {
 	// the original slice's first byte address.  we clone them
 	// just so we're able to corrupt them on close.
 	bytesClone map[*byte][]byte
+
+	next *rowsCursor // next result set
 }
 
 func (rc *rowsCursor) Close() error {
@@ -690,6 +754,27 @@ func (rc *rowsCursor) Columns() []string {
 	return rc.cols
 }
 
+func (rc *rowsCursor) HasNextResultSet() bool {
+	return rc.next != nil
+}
+
+// NextResultSet moves on to the next result set, keeping the byte clones
+// of the previous ones so that they are corrupted on close.
+func (rc *rowsCursor) NextResultSet() error {
+	if rc.next == nil {
+		return io.EOF
+	}
+	next := rc.next
+	rc.cols, rc.types, rc.rows, rc.pos, rc.next = next.cols, next.types, next.rows, next.pos, next.next
+	rc.errPos, rc.err = next.errPos, next.err
+	return nil
+}
+
+// ColumnTypeDatabaseTypeName returns the fakedb type of the column in upper case, e.g. BLOB.
+func (rc *rowsCursor) ColumnTypeDatabaseTypeName(index int) string {
+	return strings.ToUpper(rc.types[index])
+}
+
 func (rc *rowsCursor) Next(dest []driver.Value) error {
 	if rc.closed {
 		return errors.New("fakedb: cursor is closed")
@@ -772,8 +857,10 @@ func converterForType(typ string) driver.ValueConverter {
 	case "nullfloat64":
 		// TODO(coopernurse): add type-specific converter
 		return driver.Null{Converter: driver.DefaultParameterConverter}
-	case "datetime":
+	case "datetime", "timestamptz":
 		return driver.DefaultParameterConverter
+	case "blob":
+		return driver.Null{Converter: fakeDriverString{}}
 	}
 	panic("invalid fakedb column type of " + typ)
 }
@@ -0,0 +1,81 @@
+package sqltocsvgzip
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// createTempFile creates a hidden, unique file next to fileName.
+// mode is applied as is; the default (0) is 0666 before umask, like os.Create.
+func createTempFile(fileName string, mode os.FileMode) (*os.File, error) {
+	dir, base := filepath.Split(fileName)
+	for {
+		suffix := make([]byte, 8)
+		_, err := rand.Read(suffix)
+		if err != nil {
+			return nil, err
+		}
+		tmpName := filepath.Join(dir, fmt.Sprintf(".%v.%v.tmp", base, hex.EncodeToString(suffix)))
+
+		perm := mode
+		if perm == 0 {
+			perm = 0666
+		}
+		f, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if mode != 0 {
+			// Not subject to umask, unlike OpenFile
+			err = f.Chmod(mode)
+			if err != nil {
+				f.Close()
+				os.Remove(tmpName)
+				return nil, err
+			}
+		}
+		return f, nil
+	}
+}
+
+// commitTempFile moves the complete tmpName to fileName.
+// With noOverwrite, a hard link is used instead of a rename so that an
+// existing fileName, even one created during the export, is never replaced.
+func commitTempFile(tmpName, fileName string, noOverwrite bool) error {
+	if noOverwrite {
+		err := os.Link(tmpName, fileName)
+		if os.IsExist(err) {
+			return fmt.Errorf("File %v already exists", fileName)
+		}
+		if err != nil {
+			return err
+		}
+		os.Remove(tmpName)
+	} else {
+		err := os.Rename(tmpName, fileName)
+		if err != nil {
+			return err
+		}
+	}
+
+	syncDir(filepath.Dir(fileName))
+	return nil
+}
+
+// syncDir persists the directory entry of a renamed file.
+// Errors are ignored: not every platform can sync a directory.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
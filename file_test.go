@@ -0,0 +1,166 @@
+package sqltocsvgzip
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/unicode"
+)
+
+// dirFiles returns the names of the files in dir.
+func dirFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = f.Name()
+	}
+	return names
+}
+
+func TestWriteFileReplaces(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "people.csv.gz")
+	err := ioutil.WriteFile(fileName, []byte("previous export"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := WriteConfig(testRows(t, "people", "alice"))
+	c.LogLevel = Error
+	c.FileMode = 0600
+	_, err = c.WriteFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gunzipString(t, b); got != "name\nalice\n" {
+		t.Errorf("Unexpected file %q", got)
+	}
+	info, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("File mode is %v, expected 0600", info.Mode().Perm())
+	}
+	if files := dirFiles(t, dir); len(files) != 1 {
+		t.Errorf("Expected only people.csv.gz, found %v", files)
+	}
+}
+
+func TestWriteFileFailureKeepsExistingFile(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "people.csv.gz")
+	err := ioutil.WriteFile(fileName, []byte("previous export"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid UTF-8 fails the export half way through
+	c := WriteConfig(testRows(t, "people", "alice", "b\xffb"))
+	c.LogLevel = Error
+	c.OutputEncoding = unicode.UTF8
+	_, err = c.WriteFile(fileName)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil || string(b) != "previous export" {
+		t.Errorf("Existing file was modified: %q, %v", b, err)
+	}
+	if files := dirFiles(t, dir); len(files) != 1 {
+		t.Errorf("Expected the temporary file to be removed, found %v", files)
+	}
+}
+
+func TestWriteFileNoOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "people.csv.gz")
+
+	c := WriteConfig(testRows(t, "people", "alice"))
+	c.LogLevel = Error
+	c.NoOverwrite = true
+	_, err := c.WriteFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c = WriteConfig(testRows(t, "people", "bob"))
+	c.LogLevel = Error
+	c.NoOverwrite = true
+	_, err = c.WriteFile(fileName)
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("Expected the file to exist, got %v", err)
+	}
+
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gunzipString(t, b); got != "name\nalice\n" {
+		t.Errorf("Existing file was replaced: %q", got)
+	}
+	if files := dirFiles(t, dir); len(files) != 1 {
+		t.Errorf("Expected only people.csv.gz, found %v", files)
+	}
+}
+
+func TestCommitTempFileNoOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "people.csv.gz")
+	f, err := createTempFile(fileName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("new export")
+	f.Close()
+
+	// Created by someone else during the export
+	err = ioutil.WriteFile(fileName, []byte("concurrent export"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commitTempFile(f.Name(), fileName, true)
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("Expected the file to exist, got %v", err)
+	}
+	b, _ := ioutil.ReadFile(fileName)
+	if string(b) != "concurrent export" {
+		t.Errorf("Existing file was replaced: %q", b)
+	}
+
+	// Without NoOverwrite, the file is replaced
+	err = commitTempFile(f.Name(), fileName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadFile(fileName)
+	if string(b) != "new export" {
+		t.Errorf("File was not replaced: %q", b)
+	}
+	if files := dirFiles(t, dir); len(files) != 1 {
+		t.Errorf("Expected only people.csv.gz, found %v", files)
+	}
+}
+
+func TestWriteFileMissingDir(t *testing.T) {
+	c := WriteConfig(testRows(t, "people", "alice"))
+	c.LogLevel = Error
+	_, err := c.WriteFile(filepath.Join(t.TempDir(), "missing", "people.csv.gz"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected a not exist error, got %v", err)
+	}
+}
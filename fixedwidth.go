@@ -0,0 +1,180 @@
+package sqltocsvgzip
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Alignment is the side a fixed-width value is aligned on.
+type Alignment int
+
+const (
+	// AlignLeft pads the value on the right.
+	AlignLeft Alignment = iota
+	// AlignRight pads the value on the left, e.g. for numbers.
+	AlignRight
+)
+
+// OverflowPolicy tells what to do with values longer than the width of their column.
+type OverflowPolicy int
+
+const (
+	// OverflowError fails the export.
+	OverflowError OverflowPolicy = iota
+	// OverflowTruncate keeps the first characters of the value.
+	OverflowTruncate
+)
+
+// LineBreakPolicy tells what to do with values containing line breaks or the
+// RecordTerminator, which would break the layout of the FixedWidth output.
+type LineBreakPolicy int
+
+const (
+	// LineBreakError fails the export.
+	LineBreakError LineBreakPolicy = iota
+	// LineBreakReplace replaces every line break and RecordTerminator with a space.
+	LineBreakReplace
+)
+
+// FixedWidthColumn describes a column of the FixedWidth output.
+type FixedWidthColumn struct {
+	Width int       // Width in characters (default is the length of the column, see SetFixedWidthColumn)
+	Align Alignment // AlignLeft or AlignRight (default is AlignLeft)
+	Pad   rune      // Padding character (default is space)
+}
+
+// SetFixedWidthColumn sets the layout of the column with the given name in the FixedWidth output.
+// Columns without a layout are left aligned, padded with spaces, and as wide as
+// ColumnType.Length() or, for decimals, their precision plus sign and decimal point.
+func (c *Converter) SetFixedWidthColumn(columnName string, column FixedWidthColumn) {
+	if c.fixedWidthColumns == nil {
+		c.fixedWidthColumns = make(map[string]FixedWidthColumn)
+	}
+	c.fixedWidthColumns[columnName] = column
+}
+
+type fixedWidthWriter struct {
+	buf        *bytes.Buffer
+	line       []byte
+	layout     []FixedWidthColumn
+	columns    []string
+	overflow   OverflowPolicy
+	lineBreaks LineBreakPolicy
+	terminator string
+	replacer   *strings.Replacer // Replaces line breaks and the terminator with a space
+	transcoder *transcoder
+}
+
+// newFixedWidthWriter resolves the layout of every output column.
+func (c *Converter) newFixedWidthWriter(buf *bytes.Buffer) (*fixedWidthWriter, error) {
+	if c.WriteBOM {
+		return nil, fmt.Errorf("WriteBOM is not supported by the FixedWidth output")
+	}
+
+	w := &fixedWidthWriter{
+		buf:        buf,
+		columns:    c.result.Columns,
+		overflow:   c.FixedWidthOverflow,
+		lineBreaks: c.FixedWidthLineBreaks,
+		terminator: c.RecordTerminator,
+		transcoder: c.newTranscoder(),
+	}
+	if w.terminator == "" {
+		w.terminator = "\n"
+		if c.UseCRLF {
+			w.terminator = "\r\n"
+		}
+	}
+	w.replacer = strings.NewReplacer(w.terminator, " ", "\r\n", " ", "\r", " ", "\n", " ")
+
+	for i, name := range c.result.Columns {
+		column, ok := c.fixedWidthColumns[name]
+		if column.Width == 0 && c.result.Schema != nil && i < len(c.result.Schema.Columns) {
+			schema := c.result.Schema.Columns[i]
+			if schema.Length > 0 {
+				column.Width = int(schema.Length)
+			} else if schema.Precision > 0 {
+				column.Width = int(schema.Precision) + 2
+			}
+		}
+		if column.Width <= 0 {
+			if ok {
+				return nil, fmt.Errorf("Invalid width %v for column %v", column.Width, name)
+			}
+			return nil, fmt.Errorf("Width of column %v is unknown, set it with SetFixedWidthColumn", name)
+		}
+		if column.Pad == 0 {
+			column.Pad = ' '
+		}
+		w.layout = append(w.layout, column)
+	}
+	return w, nil
+}
+
+// writeHeader writes the column names, truncated to the width of their column.
+func (w *fixedWidthWriter) writeHeader(columns []string) error {
+	err := w.write(columns, true)
+	if err == errSkipRow {
+		return fmt.Errorf("The header cannot be encoded to OutputEncoding")
+	}
+	return err
+}
+
+// writeRow writes the row, NULLs being NullString.
+func (w *fixedWidthWriter) writeRow(row []string, nulls []bool) error {
+	return w.write(row, false)
+}
+
+func (w *fixedWidthWriter) write(row []string, truncate bool) error {
+	if len(row) != len(w.layout) {
+		return fmt.Errorf("Expected %v fields, got %v", len(w.layout), len(row))
+	}
+
+	row, err := w.transcoder.checkUTF8(row, w.columns, nil)
+	if err != nil {
+		return err
+	}
+
+	w.line = w.line[:0]
+	for i, value := range row {
+		column := w.layout[i]
+		if strings.ContainsAny(value, "\r\n") || strings.Contains(value, w.terminator) {
+			if w.lineBreaks != LineBreakReplace {
+				return fmt.Errorf("Value of column %v contains a line break or the RecordTerminator: %q", w.columns[i], value)
+			}
+			value = w.replacer.Replace(value)
+		}
+
+		length := utf8.RuneCountInString(value)
+		if length > column.Width {
+			if !truncate && w.overflow != OverflowTruncate {
+				return fmt.Errorf("Value of column %v is longer than %v characters: %q", w.columns[i], column.Width, value)
+			}
+			value = string([]rune(value)[:column.Width])
+			length = column.Width
+		}
+
+		padding := strings.Repeat(string(column.Pad), column.Width-length)
+		if column.Align == AlignRight {
+			w.line = append(w.line, padding...)
+			w.line = append(w.line, value...)
+		} else {
+			w.line = append(w.line, value...)
+			w.line = append(w.line, padding...)
+		}
+	}
+	w.line = append(w.line, w.terminator...)
+
+	line, err := w.transcoder.encode(w.line)
+	if err != nil {
+		return err
+	}
+	_, err = w.buf.Write(line)
+	return err
+}
+
+func (w *fixedWidthWriter) close() error {
+	return nil
+}
@@ -0,0 +1,59 @@
+package sqltocsvgzip
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFixedWidth(t *testing.T) {
+	c := WriteConfig(testRows(t, "people", "alice", "bob"))
+	c.LogLevel = Error
+	c.OutputFormat = FixedWidth
+	c.SetFixedWidthColumn("name", FixedWidthColumn{Width: 6, Align: AlignRight, Pad: '.'})
+	var buf bytes.Buffer
+	err := c.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gunzipString(t, buf.Bytes()); got != "..name\n.alice\n...bob\n" {
+		t.Errorf("Unexpected output %q", got)
+	}
+}
+
+func TestFixedWidthLineBreaks(t *testing.T) {
+	tests := []struct {
+		policy     LineBreakPolicy
+		terminator string
+		expected   string
+	}{
+		{LineBreakError, "", ""},
+		{LineBreakError, "|", ""},
+		{LineBreakReplace, "", "a b   \nc d e \nf|g   \n"},
+		{LineBreakReplace, "|", "a b   |c d e |f g   |"},
+	}
+	for _, test := range tests {
+		c := WriteConfig(testRows(t, "people", "a\nb", "c\r\nd\re", "f|g"))
+		c.LogLevel = Error
+		c.WriteHeaders = false
+		c.OutputFormat = FixedWidth
+		c.FixedWidthLineBreaks = test.policy
+		c.RecordTerminator = test.terminator
+		c.SetFixedWidthColumn("name", FixedWidthColumn{Width: 6})
+		var buf bytes.Buffer
+		err := c.Write(&buf)
+
+		if test.policy == LineBreakError {
+			if err == nil || !strings.Contains(err.Error(), "line break") {
+				t.Errorf("Terminator %q: expected a line break error, got %v", test.terminator, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := gunzipString(t, buf.Bytes()); got != test.expected {
+			t.Errorf("Terminator %q: got %q, expected %q", test.terminator, got, test.expected)
+		}
+	}
+}
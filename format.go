@@ -0,0 +1,210 @@
+package sqltocsvgzip
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const utf8BOM = "\ufeff"
+
+// OutputFormat is the format of the output.
+type OutputFormat int
+
+const (
+	// CSV is a gzip compressed CSV.
+	CSV OutputFormat = iota
+	// XLSX is an Excel workbook. It is not gzip compressed,
+	// the workbook is a zip archive already.
+	XLSX
+	// FixedWidth is a gzip compressed text file with a fixed width per column,
+	// see SetFixedWidthColumn.
+	FixedWidth
+	// SQLInsert is a gzip compressed SQL script of multi-row INSERT statements
+	// into SchemaTable, see InsertDialect.
+	SQLInsert
+)
+
+// Extension returns the usual file extension of the format.
+func (f OutputFormat) Extension() string {
+	switch f {
+	case XLSX:
+		return ".xlsx"
+	case FixedWidth:
+		return ".txt.gz"
+	case SQLInsert:
+		return ".sql.gz"
+	}
+	return ".csv.gz"
+}
+
+// outputTimeFormat returns TimeFormat or, if not set, the default time format of the OutputFormat.
+func (c *Converter) outputTimeFormat() string {
+	if c.TimeFormat != "" {
+		return c.TimeFormat
+	}
+	switch c.OutputFormat {
+	case XLSX:
+		return xlsxTimeFormat
+	case SQLInsert:
+		return c.InsertDialect.timeFormat(false)
+	}
+	return ""
+}
+
+func (f OutputFormat) contentType() string {
+	switch f {
+	case XLSX:
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	}
+	// Filetype ref: https://mimesniff.spec.whatwg.org/#matching-an-archive-type-pattern
+	return "application/x-gzip"
+}
+
+// compressed reports whether the output is gzip compressed by the Converter.
+func (f OutputFormat) compressed() bool {
+	return f != XLSX
+}
+
+// rowWriter encodes the header and the rows of the output into the output buffer.
+type rowWriter interface {
+	writeHeader(columns []string) error
+	// writeRow writes a row, nulls flags its NULL fields and may be nil.
+	writeRow(row []string, nulls []bool) error
+	// close completes the output, e.g. the directory of a zip archive.
+	close() error
+}
+
+// newRowWriter returns the rowWriter of the OutputFormat writing to buf.
+func (c *Converter) newRowWriter(buf *bytes.Buffer) (rowWriter, error) {
+	switch c.OutputFormat {
+	case CSV:
+		r := &csvRowWriter{
+			buf:            buf,
+			escapeFormulas: c.EscapeFormulas,
+			nullString:     c.NullString,
+			transcoder:     c.newTranscoder(),
+			columns:        c.result.Columns,
+		}
+		// Rows are transcoded one by one, invalid ones being skipped
+		r.encoded = buf
+		if r.transcoder.encodes() {
+			r.encoded = &bytes.Buffer{}
+		}
+		var err error
+		r.w, err = c.getCSVWriter(r.encoded)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.WriteBOM {
+			if r.transcoder.encodes() {
+				return nil, fmt.Errorf("WriteBOM is for UTF-8 output, use the byte order mark of OutputEncoding instead, e.g. unicode.UseBOM")
+			}
+			buf.WriteString(utf8BOM)
+		}
+		return r, nil
+	case XLSX:
+		if c.OutputEncoding != nil {
+			return nil, fmt.Errorf("OutputEncoding is not supported by the XLSX output, which is always UTF-8")
+		}
+		return c.newXLSXWriter(buf), nil
+	case FixedWidth:
+		return c.newFixedWidthWriter(buf)
+	case SQLInsert:
+		return c.newInsertWriter(buf)
+	}
+	return nil, fmt.Errorf("Unknown output format: %v", c.OutputFormat)
+}
+
+type csvRowWriter struct {
+	w              *csvWriter
+	buf            *bytes.Buffer
+	encoded        *bytes.Buffer // Output of w, buf unless transcoding
+	escapeFormulas bool
+	nullString     string
+	transcoder     *transcoder
+	columns        []string
+}
+
+func (r *csvRowWriter) writeHeader(columns []string) error {
+	err := r.writeRow(columns, nil)
+	if err == errSkipRow {
+		return fmt.Errorf("The header cannot be encoded to OutputEncoding")
+	}
+	return err
+}
+
+func (r *csvRowWriter) writeRow(row []string, nulls []bool) error {
+	if r.escapeFormulas {
+		row = escapeFormulas(row, nulls)
+	}
+	row, err := r.transcoder.checkUTF8(row, r.columns, nil)
+	if err != nil {
+		return err
+	}
+	if !r.transcoder.encodes() {
+		return r.w.Write(row, nulls)
+	}
+
+	r.encoded.Reset()
+	err = r.w.Write(row, nulls)
+	if err != nil {
+		return err
+	}
+	encoded, err := r.transcoder.encode(r.encoded.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = r.buf.Write(encoded)
+	return err
+}
+
+func (r *csvRowWriter) close() error {
+	return nil
+}
+
+// escapeFormulas prefixes the values spreadsheet applications would run
+// as formulas with a single quote, see
+// https://owasp.org/www-community/attacks/CSV_Injection.
+// Numbers, e.g. -1, and NULL values are left as is.
+func escapeFormulas(row []string, nulls []bool) []string {
+	var escaped []string
+	for i, value := range row {
+		if value == "" || isNull(nulls, i) || !strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+			continue
+		}
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			continue
+		}
+		if escaped == nil {
+			escaped = append([]string(nil), row...)
+		}
+		escaped[i] = "'" + value
+	}
+	if escaped == nil {
+		return row
+	}
+	return escaped
+}
+
+// compressWriter compresses the output.
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// nopCompressWriter writes formats compressed already as is.
+type nopCompressWriter struct {
+	io.Writer
+}
+
+func (nopCompressWriter) Flush() error {
+	return nil
+}
+
+func (nopCompressWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,130 @@
+package sqltocsvgzip
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// ColumnFormatterFunc is a function type for formatting the values of a
+// single column. It receives the raw value scanned from the database
+// (never nil, NULLs are written as NullString) and returns the string
+// that should be passed on to the row preprocessor.
+type ColumnFormatterFunc func(value interface{}) string
+
+// SetColumnFormatter registers a ColumnFormatterFunc for the column with the given name.
+// Column formatters take precedence over type formatters.
+func (c *Converter) SetColumnFormatter(columnName string, formatter ColumnFormatterFunc) {
+	if c.columnFormatters == nil {
+		c.columnFormatters = make(map[string]ColumnFormatterFunc)
+	}
+	c.columnFormatters[columnName] = formatter
+}
+
+// SetTypeFormatter registers a ColumnFormatterFunc for every column whose
+// ColumnType.DatabaseTypeName() matches databaseTypeName (case insensitive),
+// e.g. "NUMERIC", "DATE" or "BYTEA".
+func (c *Converter) SetTypeFormatter(databaseTypeName string, formatter ColumnFormatterFunc) {
+	if c.typeFormatters == nil {
+		c.typeFormatters = make(map[string]ColumnFormatterFunc)
+	}
+	c.typeFormatters[strings.ToUpper(databaseTypeName)] = formatter
+}
+
+// setColumnFormatters resolves the registered formatters to the
+// position of each column in the result set. They apply to the values at
+// the same position after the ValuePreProcessorFunc, which only appends values.
+func (c *Converter) setColumnFormatters() error {
+	c.formatters = nil
+	if len(c.columnFormatters) == 0 && len(c.typeFormatters) == 0 {
+		return nil
+	}
+
+	columnTypes, err := c.rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+
+	c.formatters = make([]ColumnFormatterFunc, len(columnTypes))
+	for i, columnType := range columnTypes {
+		if formatter, ok := c.columnFormatters[columnType.Name()]; ok {
+			c.formatters[i] = formatter
+			continue
+		}
+		if formatter, ok := c.typeFormatters[strings.ToUpper(columnType.DatabaseTypeName())]; ok {
+			c.formatters[i] = formatter
+		}
+	}
+
+	return nil
+}
+
+// FormatHex formats binary values as lowercase hexadecimal.
+// Without FormatHex or FormatBase64, binary values are written as text
+// and their invalid UTF-8 is handled by InvalidChars.
+func FormatHex(value interface{}) string {
+	return hex.EncodeToString(toBytes(value))
+}
+
+// FormatBase64 formats binary values using standard base64 encoding.
+func FormatBase64(value interface{}) string {
+	return base64.StdEncoding.EncodeToString(toBytes(value))
+}
+
+// FormatTime returns a ColumnFormatterFunc that converts time.Time values
+// to loc (if not nil) and formats them using layout.
+// e.g. FormatTime("2006-01-02", nil) for DATE columns or
+// FormatTime(time.RFC3339, time.UTC) for TIMESTAMPTZ columns.
+func FormatTime(layout string, loc *time.Location) ColumnFormatterFunc {
+	return func(value interface{}) string {
+		t, ok := value.(time.Time)
+		if !ok {
+			return formatValue(value, layout)
+		}
+		if loc != nil {
+			t = t.In(loc)
+		}
+		return t.Format(layout)
+	}
+}
+
+// FormatDecimal returns a ColumnFormatterFunc that rounds numeric values
+// to a fixed number of decimal places. Values are parsed as exact decimals,
+// so NUMERIC columns scanned as []byte do not lose precision.
+// Values that cannot be parsed are written unchanged.
+func FormatDecimal(precision int) ColumnFormatterFunc {
+	return func(value interface{}) string {
+		s := formatValue(value, "")
+		r, ok := new(big.Rat).SetString(s)
+		if !ok {
+			return s
+		}
+		return r.FloatString(precision)
+	}
+}
+
+// FormatMap returns a ColumnFormatterFunc that replaces values found in
+// mapping, e.g. to map enum codes to labels. Other values are written unchanged.
+func FormatMap(mapping map[string]string) ColumnFormatterFunc {
+	return func(value interface{}) string {
+		s := formatValue(value, "")
+		if mapped, ok := mapping[s]; ok {
+			return mapped
+		}
+		return s
+	}
+}
+
+func toBytes(value interface{}) []byte {
+	switch v := value.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	default:
+		return []byte(fmt.Sprintf("%v", v))
+	}
+}
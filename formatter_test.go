@@ -0,0 +1,121 @@
+package sqltocsvgzip
+
+import (
+	"bytes"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestColumnFormatters(t *testing.T) {
+	db, err := sql.Open("test", "formatters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, db, "WIPE")
+	exec(t, db, "CREATE|items|amount=string,status=string,data=blob,at=datetime,nick=nullstring")
+	at := time.Date(2021, 10, 4, 23, 30, 0, 0, time.FixedZone("", -2*3600))
+	exec(t, db, "INSERT|items|amount=?,status=?,data=?,at=?,nick=?", "12.345", "A", []byte{0xff, 0x00, 'a'}, at, nil)
+	exec(t, db, "INSERT|items|amount=?,status=?,data=?,at=?,nick=?", "n/a", "Z", []byte("b"), at, "bob")
+	rows, err := db.Query("SELECT|items|amount,status,data,at,nick|")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := WriteConfig(rows)
+	c.LogLevel = Error
+	c.NullString = "NULL"
+	c.SetColumnFormatter("amount", FormatDecimal(2))
+	c.SetTypeFormatter("string", FormatMap(map[string]string{"A": "active"}))
+	c.SetColumnFormatter("status", FormatMap(map[string]string{"A": "archived"}))
+	c.SetTypeFormatter("BLOB", FormatHex)
+	c.SetTypeFormatter("DateTime", FormatTime("2006-01-02T15:04", time.UTC))
+	c.SetTypeFormatter("NULLSTRING", func(value interface{}) string { return "nick:" + formatValue(value, "") })
+	var buf bytes.Buffer
+	err = c.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Column formatters take precedence, NULLs are not formatted
+	expected := "amount,status,data,at,nick\n" +
+		"12.35,archived,ff0061,2021-10-05T01:30,NULL\n" +
+		"n/a,Z,62,2021-10-05T01:30,nick:bob\n"
+	if got := gunzipString(t, buf.Bytes()); got != expected {
+		t.Errorf("got      %q\nexpected %q", got, expected)
+	}
+}
+
+// Without a formatter, []byte values are written as is.
+func TestBinaryDefault(t *testing.T) {
+	db, err := sql.Open("test", "binary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, db, "WIPE")
+	exec(t, db, "CREATE|files|data=blob")
+	exec(t, db, "INSERT|files|data=?", []byte("text"))
+	exec(t, db, "INSERT|files|data=?", []byte{0xff, 0x00})
+
+	for _, test := range []struct {
+		formatter    ColumnFormatterFunc
+		invalidChars InvalidCharPolicy
+		expected     string
+	}{
+		// Invalid UTF-8 follows InvalidChars
+		{nil, InvalidCharError, ""},
+		{nil, InvalidCharReplace, "data\ntext\n\ufffd\x00\n"},
+		{nil, InvalidCharSkipRow, "data\ntext\n"},
+		{FormatBase64, InvalidCharError, "data\ndGV4dA==\n/wA=\n"},
+	} {
+		rows, err := db.Query("SELECT|files|data|")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := WriteConfig(rows)
+		c.LogLevel = Error
+		c.InvalidChars = test.invalidChars
+		if test.formatter != nil {
+			c.SetColumnFormatter("data", test.formatter)
+		}
+		var buf bytes.Buffer
+		err = c.Write(&buf)
+		if test.expected == "" {
+			if err == nil || err.Error() != "Invalid UTF-8 in column data" {
+				t.Errorf("Expected an invalid UTF-8 error, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := gunzipString(t, buf.Bytes()); got != test.expected {
+			t.Errorf("got %q, expected %q", got, test.expected)
+		}
+	}
+}
+
+func TestFormatFuncs(t *testing.T) {
+	tests := []struct {
+		formatter ColumnFormatterFunc
+		value     interface{}
+		expected  string
+	}{
+		{FormatHex, "hi", "6869"},
+		{FormatBase64, []byte{0xfb, 0xff}, "+/8="},
+		{FormatDecimal(2), []byte("1.005"), "1.01"},
+		{FormatDecimal(0), int64(42), "42"},
+		{FormatDecimal(3), "-0.5", "-0.500"},
+		{FormatDecimal(2), "NaN", "NaN"},
+		{FormatTime("2006-01-02", nil), time.Date(2021, 1, 2, 23, 0, 0, 0, time.FixedZone("", 3600)), "2021-01-02"},
+		{FormatTime(time.RFC3339, time.UTC), time.Date(2021, 1, 2, 0, 30, 0, 0, time.FixedZone("", 3600)), "2021-01-01T23:30:00Z"},
+		{FormatTime(time.RFC3339, time.UTC), "not a time", "not a time"},
+		{FormatMap(map[string]string{"1": "one"}), int64(1), "one"},
+		{FormatMap(map[string]string{"1": "one"}), int64(2), "2"},
+	}
+	for i, test := range tests {
+		if got := test.formatter(test.value); got != test.expected {
+			t.Errorf("Test %v: got %q, expected %q", i, got, test.expected)
+		}
+	}
+}
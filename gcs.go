@@ -0,0 +1,333 @@
+package sqltocsvgzip
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	gcsDefaultEndpoint = "https://storage.googleapis.com"
+	// Every chunk of a resumable upload but the last one
+	// must be a multiple of 256Kb.
+	gcsChunkMultiple = 256 * 1024
+)
+
+// GCSSink uploads to Google Cloud Storage using a resumable upload.
+//
+// Resumable uploads are sequential: parts are still queued concurrently,
+// but they are sent to GCS one after the other in part order.
+type GCSSink struct {
+	Bucket   string
+	Object   string
+	Endpoint string       // Default is https://storage.googleapis.com. e.g. http://localhost:4443 for fake-gcs-server
+	Client   *http.Client // Authenticated client, e.g. from golang.org/x/oauth2/google (default is http.DefaultClient)
+
+	sessionURI string
+	mu         sync.Mutex
+	turn       *sync.Cond
+	nextPart   int64
+	pending    []byte
+	offset     int64
+	md5        hash.Hash
+	err        error
+}
+
+// gcsObject is the subset of the GCS object resource returned by uploads.
+type gcsObject struct {
+	Bucket     string `json:"bucket"`
+	Name       string `json:"name"`
+	Generation string `json:"generation"`
+	MD5Hash    string `json:"md5Hash"`
+	ETag       string `json:"etag"`
+	SelfLink   string `json:"selfLink"`
+}
+
+// NewGCSSink returns a GCSSink uploading to bucket/object using client.
+func NewGCSSink(bucket, object string, client *http.Client) *GCSSink {
+	return &GCSSink{
+		Bucket: bucket,
+		Object: object,
+		Client: client,
+	}
+}
+
+// Create starts a resumable upload session.
+// The state of a previous upload with the same sink is discarded.
+func (g *GCSSink) Create(contentType string) error {
+	g.mu.Lock()
+	g.turn = sync.NewCond(&g.mu)
+	g.nextPart = 1
+	g.pending = nil
+	g.offset = 0
+	g.md5 = md5.New()
+	g.err = nil
+	g.sessionURI = ""
+	g.mu.Unlock()
+
+	body, err := json.Marshal(map[string]string{
+		"name":        g.Object,
+		"contentType": contentType,
+	})
+	if err != nil {
+		return err
+	}
+
+	return retry("Create resumable upload", func() error {
+		req, err := http.NewRequest(http.MethodPost, g.uploadURL("resumable"), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		req.Header.Set("X-Upload-Content-Type", contentType)
+
+		resp, err := g.client().Do(req)
+		if err != nil {
+			return err
+		}
+		err = httpError(resp, http.StatusOK, http.StatusCreated)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		g.sessionURI = resp.Header.Get("Location")
+		if g.sessionURI == "" {
+			return fmt.Errorf("No session URI returned for resumable upload")
+		}
+		return nil
+	})
+}
+
+// UploadPart waits for the previous parts to be sent and sends buf,
+// rounded down to a multiple of 256Kb. The remainder is sent with the next part.
+func (g *GCSSink) UploadPart(partNumber int64, buf []byte, checksum PartChecksum) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for g.nextPart != partNumber && g.err == nil {
+		g.turn.Wait()
+	}
+	if g.err != nil {
+		return g.err
+	}
+
+	g.pending = append(g.pending, buf...)
+	n := len(g.pending) / gcsChunkMultiple * gcsChunkMultiple
+	if n > 0 {
+		_, err := g.sendChunk(g.pending[:n], false)
+		if err != nil {
+			g.err = err
+			g.turn.Broadcast()
+			return err
+		}
+		g.pending = append([]byte(nil), g.pending[n:]...)
+	}
+
+	g.nextPart++
+	g.turn.Broadcast()
+	return nil
+}
+
+// Complete sends the remaining bytes and finalizes the object.
+// The MD5 returned by GCS is compared with the one of the sent data.
+func (g *GCSSink) Complete() (*UploadOutput, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.err != nil {
+		return nil, g.err
+	}
+
+	object, err := g.sendChunk(g.pending, true)
+	if err != nil {
+		return nil, err
+	}
+	g.pending = nil
+
+	if object.MD5Hash != "" {
+		err = verifyChecksum("md5Hash", base64.StdEncoding.EncodeToString(g.md5.Sum(nil)), object.MD5Hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return g.output(object), nil
+}
+
+// Abort cancels the resumable upload session.
+func (g *GCSSink) Abort() error {
+	g.mu.Lock()
+	if g.err == nil {
+		g.err = fmt.Errorf("Upload aborted")
+	}
+	if g.turn != nil {
+		g.turn.Broadcast()
+	}
+	g.mu.Unlock()
+
+	if g.sessionURI == "" {
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, g.sessionURI, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := g.client().Do(req)
+	if err != nil {
+		return err
+	}
+	// GCS answers 499 to a cancelled upload
+	err = httpError(resp, 499, http.StatusOK, http.StatusNoContent, http.StatusNotFound)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	g.sessionURI = ""
+	return nil
+}
+
+// PutObject uploads buf with a single media upload.
+func (g *GCSSink) PutObject(buf []byte, contentType string) (*UploadOutput, error) {
+	var object gcsObject
+	err := retry("Upload object", func() error {
+		req, err := http.NewRequest(http.MethodPost, g.uploadURL("media"), bytes.NewReader(buf))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentType)
+
+		resp, err := g.client().Do(req)
+		if err != nil {
+			return err
+		}
+		err = httpError(resp, http.StatusOK, http.StatusCreated)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		return json.NewDecoder(resp.Body).Decode(&object)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	checksum := NewPartChecksum(buf)
+	if object.MD5Hash != "" {
+		err = verifyChecksum("md5Hash", base64.StdEncoding.EncodeToString(checksum.MD5), object.MD5Hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return g.output(&object), nil
+}
+
+// sendChunk sends data at the current offset of the upload session.
+// The object resource is returned once the last chunk is sent.
+func (g *GCSSink) sendChunk(data []byte, last bool) (*gcsObject, error) {
+	var object *gcsObject
+	err := retry("Upload chunk", func() error {
+		req, err := http.NewRequest(http.MethodPut, g.sessionURI, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = int64(len(data))
+
+		total := "*"
+		if last {
+			total = strconv.FormatInt(g.offset+int64(len(data)), 10)
+		}
+		if len(data) == 0 {
+			req.Header.Set("Content-Range", "bytes */"+total)
+		} else {
+			req.Header.Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", g.offset, g.offset+int64(len(data))-1, total))
+		}
+
+		resp, err := g.client().Do(req)
+		if err != nil {
+			return err
+		}
+
+		if !last {
+			// 308 Resume Incomplete. Make sure the whole chunk was persisted,
+			// GCS ignores the bytes already persisted when a chunk is sent again.
+			err = httpError(resp, http.StatusPermanentRedirect)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+
+			persisted := gcsPersistedBytes(resp.Header.Get("Range"))
+			if persisted != g.offset+int64(len(data)) {
+				return fmt.Errorf("Only %v of %v bytes persisted", persisted, g.offset+int64(len(data)))
+			}
+			return nil
+		}
+
+		err = httpError(resp, http.StatusOK, http.StatusCreated)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		object = &gcsObject{}
+		return json.NewDecoder(resp.Body).Decode(object)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	g.md5.Write(data)
+	g.offset += int64(len(data))
+	return object, nil
+}
+
+// gcsPersistedBytes parses the Range header of a 308 response ("bytes=0-1234").
+func gcsPersistedBytes(rangeHeader string) int64 {
+	i := strings.LastIndex(rangeHeader, "-")
+	if i < 0 {
+		return 0
+	}
+	last, err := strconv.ParseInt(rangeHeader[i+1:], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return last + 1
+}
+
+func (g *GCSSink) uploadURL(uploadType string) string {
+	endpoint := g.Endpoint
+	if endpoint == "" {
+		endpoint = gcsDefaultEndpoint
+	}
+	return fmt.Sprintf("%v/upload/storage/v1/b/%v/o?uploadType=%v&name=%v",
+		strings.TrimRight(endpoint, "/"), url.PathEscape(g.Bucket), uploadType, url.QueryEscape(g.Object))
+}
+
+func (g *GCSSink) client() *http.Client {
+	if g.Client == nil {
+		return http.DefaultClient
+	}
+	return g.Client
+}
+
+func (g *GCSSink) output(object *gcsObject) *UploadOutput {
+	location := object.SelfLink
+	if location == "" {
+		location = fmt.Sprintf("gs://%v/%v", g.Bucket, g.Object)
+	}
+	return &UploadOutput{
+		Bucket:    g.Bucket,
+		Key:       g.Object,
+		Location:  location,
+		ETag:      object.ETag,
+		VersionID: object.Generation,
+	}
+}
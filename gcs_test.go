@@ -0,0 +1,198 @@
+package sqltocsvgzip
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGCS implements the JSON API uploads used by GCSSink, like fake-gcs-server.
+type fakeGCS struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	sessions map[string]*fakeGCSSession
+	ranges   []string // Content-Range of every chunk
+}
+
+type fakeGCSSession struct {
+	name string
+	data []byte
+}
+
+func newFakeGCS(t *testing.T) (*fakeGCS, *httptest.Server) {
+	f := &fakeGCS{objects: map[string][]byte{}, sessions: map[string]*fakeGCSSession{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case r.Method == http.MethodPost && r.URL.Query().Get("uploadType") == "resumable":
+		id := strconv.Itoa(len(f.sessions) + 1)
+		f.sessions[id] = &fakeGCSSession{name: r.URL.Query().Get("name")}
+		w.Header().Set("Location", "http://"+r.Host+"/session/"+id)
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == http.MethodPost && r.URL.Query().Get("uploadType") == "media":
+		f.objects[r.URL.Query().Get("name")] = body
+		f.writeObject(w, r.URL.Query().Get("name"), body)
+
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/session/"):
+		session, ok := f.sessions[strings.TrimPrefix(r.URL.Path, "/session/")]
+		if !ok {
+			http.Error(w, "no such session", http.StatusNotFound)
+			return
+		}
+		contentRange := r.Header.Get("Content-Range")
+		f.ranges = append(f.ranges, contentRange)
+		var first, last int64
+		var total string
+		if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%s", &first, &last, &total); err == nil {
+			if first != int64(len(session.data)) {
+				http.Error(w, "unexpected offset "+contentRange, http.StatusBadRequest)
+				return
+			}
+		} else if !strings.HasPrefix(contentRange, "bytes */") {
+			http.Error(w, "bad Content-Range "+contentRange, http.StatusBadRequest)
+			return
+		} else {
+			total = strings.TrimPrefix(contentRange, "bytes */")
+		}
+		session.data = append(session.data, body...)
+
+		if total == "*" {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%v", len(session.data)-1))
+			w.WriteHeader(http.StatusPermanentRedirect)
+			return
+		}
+		f.objects[session.name] = session.data
+		f.writeObject(w, session.name, session.data)
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/session/"):
+		delete(f.sessions, strings.TrimPrefix(r.URL.Path, "/session/"))
+		w.WriteHeader(499)
+
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func (f *fakeGCS) writeObject(w http.ResponseWriter, name string, data []byte) {
+	sum := md5.Sum(data)
+	json.NewEncoder(w).Encode(gcsObject{
+		Bucket:     "bucket",
+		Name:       name,
+		Generation: "1",
+		MD5Hash:    base64.StdEncoding.EncodeToString(sum[:]),
+	})
+}
+
+func TestGCSSinkUpload(t *testing.T) {
+	fake, server := newFakeGCS(t)
+	sink := NewGCSSink("bucket", "dir/out.csv.gz", nil)
+	sink.Endpoint = server.URL
+
+	parts := [][]byte{
+		bytes.Repeat([]byte("a"), gcsChunkMultiple+100),
+		bytes.Repeat([]byte("b"), gcsChunkMultiple),
+		[]byte("tail"),
+	}
+	err := sink.Create("application/x-gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, part := range parts {
+		err = sink.UploadPart(int64(i+1), part, NewPartChecksum(part))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	output, err := sink.Complete()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := bytes.Join(parts, nil)
+	if !bytes.Equal(fake.objects["dir/out.csv.gz"], expected) {
+		t.Fatalf("Uploaded %v bytes, expected %v", len(fake.objects["dir/out.csv.gz"]), len(expected))
+	}
+	if output.Key != "dir/out.csv.gz" || output.VersionID != "1" {
+		t.Errorf("Unexpected output: %+v", output)
+	}
+}
+
+// An upload after the small output path (Abort then PutObject) must start from scratch.
+func TestGCSSinkReuse(t *testing.T) {
+	fake, server := newFakeGCS(t)
+	sink := NewGCSSink("bucket", "out.csv.gz", nil)
+	sink.Endpoint = server.URL
+
+	err := sink.Create("application/x-gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sink.PutObject([]byte("small"), "application/x-gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	part := bytes.Repeat([]byte("c"), gcsChunkMultiple+10)
+	fake.ranges = nil
+	err = sink.Create("application/x-gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.UploadPart(1, part, NewPartChecksum(part))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sink.Complete()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(fake.objects["out.csv.gz"], part) {
+		t.Fatalf("Uploaded %v bytes, expected %v", len(fake.objects["out.csv.gz"]), len(part))
+	}
+	expectedRange := fmt.Sprintf("bytes 0-%v/*", gcsChunkMultiple-1)
+	if len(fake.ranges) == 0 || fake.ranges[0] != expectedRange {
+		t.Errorf("First Content-Range is %q, expected %q", fake.ranges, expectedRange)
+	}
+}
+
+func TestGCSSinkConverter(t *testing.T) {
+	fake, server := newFakeGCS(t)
+	sink := NewGCSSink("bucket", "people.csv.gz", nil)
+	sink.Endpoint = server.URL
+
+	for i := 0; i < 2; i++ {
+		c := UploadConfig(testRows(t, "people", "alice", "bob"))
+		c.LogLevel = Error
+		c.SetSink(sink)
+		_, err := c.Upload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := gunzipString(t, fake.objects["people.csv.gz"]); got != "name\nalice\nbob\n" {
+			t.Fatalf("Unexpected object: %q", got)
+		}
+	}
+}
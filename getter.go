@@ -1,6 +1,7 @@
 package sqltocsvgzip
 
 import (
+	"bytes"
 	"io"
 
 	"github.com/klauspost/pgzip"
@@ -15,3 +16,57 @@ func (c *Converter) getGzipWriter(writer io.Writer) (*pgzip.Writer, error) {
 	err = zw.SetConcurrency(c.GzipBatchPerGoroutine, c.GzipGoroutines)
 	return zw, err
 }
+
+// getOutputWriters returns the gzip writer compressing to output,
+// through the encryption writer if encryption is set (nil otherwise).
+// Formats compressed already are not compressed again.
+func (c *Converter) getOutputWriters(output io.Writer) (compressWriter, io.WriteCloser, error) {
+	var ew io.WriteCloser
+	if c.encrypt != nil {
+		var err error
+		ew, err = c.encrypt(output)
+		if err != nil {
+			return nil, nil, err
+		}
+		output = ew
+	}
+
+	if !c.OutputFormat.compressed() {
+		return nopCompressWriter{output}, ew, nil
+	}
+	zw, err := c.getGzipWriter(output)
+	if err != nil {
+		return nil, nil, err
+	}
+	return zw, ew, nil
+}
+
+// finishOutput completes the rows, compresses what is left in csvBuffer and
+// closes the output writers.
+func (c *Converter) finishOutput(rowWriter rowWriter, zw compressWriter, ew io.WriteCloser, csvBuffer *bytes.Buffer) error {
+	err := rowWriter.close()
+	if err != nil {
+		return err
+	}
+
+	c.result.UncompressedBytes += int64(csvBuffer.Len())
+	_, err = zw.Write(csvBuffer.Bytes())
+	if err != nil {
+		return err
+	}
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+
+	if ew != nil {
+		err = ew.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	//Wipe the buffer
+	csvBuffer.Reset()
+	return nil
+}
@@ -3,9 +3,12 @@ module github.com/thatInfrastructureGuy/sqltocsvgzip
 go 1.14
 
 require (
-	github.com/aws/aws-sdk-go v1.36.28
-	github.com/go-sql-driver/mysql v1.5.0 // indirect
+	filippo.io/age v1.0.0
+	github.com/aws/aws-sdk-go v1.44.0
+	github.com/go-sql-driver/mysql v1.5.0
 	github.com/klauspost/compress v1.11.7 // indirect
 	github.com/klauspost/pgzip v1.2.5
-	github.com/stretchr/testify v1.5.1 // indirect
+	github.com/pkg/sftp v1.13.0
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	golang.org/x/text v0.3.7
 )
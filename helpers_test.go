@@ -0,0 +1,49 @@
+package sqltocsvgzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"io/ioutil"
+	"testing"
+)
+
+// testRows returns the rows of a single column "name" table of the fake driver.
+func testRows(t *testing.T, table string, names ...string) *sql.Rows {
+	t.Helper()
+	db, err := sql.Open("test", table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, db, "WIPE")
+	exec(t, db, "CREATE|"+table+"|name=string")
+	for _, name := range names {
+		exec(t, db, "INSERT|"+table+"|name=?", name)
+	}
+	rows, err := db.Query("SELECT|" + table + "|name|")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func exec(t *testing.T, db *sql.DB, query string, args ...interface{}) {
+	t.Helper()
+	_, err := db.Exec(query, args...)
+	if err != nil {
+		t.Fatalf("Exec of %q failed: %v", query, err)
+	}
+}
+
+func gunzipString(t *testing.T, b []byte) string {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(plain)
+}
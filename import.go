@@ -0,0 +1,523 @@
+package sqltocsvgzip
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ImportMethod is the way rows are loaded into the database.
+type ImportMethod int
+
+const (
+	// ImportAuto picks the fastest method supported by the driver.
+	ImportAuto ImportMethod = iota
+	// ImportCopy uses Postgres COPY FROM STDIN (github.com/lib/pq only).
+	ImportCopy
+	// ImportLoadData uses MySQL LOAD DATA LOCAL INFILE (github.com/go-sql-driver/mysql only).
+	// The server must allow local_infile, and the mysqlimport package must be imported.
+	ImportLoadData
+	// ImportInsert uses multi-row INSERT statements.
+	ImportInsert
+)
+
+func (m ImportMethod) String() string {
+	switch m {
+	case ImportCopy:
+		return "COPY"
+	case ImportLoadData:
+		return "LOAD DATA"
+	case ImportInsert:
+		return "INSERT"
+	}
+	return "auto"
+}
+
+// ImportConfig describes how a csv.gzip is loaded into a table.
+type ImportConfig struct {
+	Table       string   // Table to load, used as is in the statements (quote it if needed)
+	Columns     []string // Columns to load (default is the CSV header)
+	NoHeader    bool     // The CSV has no header row, Columns must be set
+	Delimiter   rune     // Delimiter of the CSV (default is comma)
+	NullString  string   // Unquoted values loaded as NULL (default is the one of Schema, or empty string)
+	BatchSize   int      // Rows per INSERT statement (default is 500)
+	CommitEvery int64    // Commit every that many rows (default is a single transaction)
+	Method      ImportMethod
+	LogLevel    LogLevel // Default is the LOG_LEVEL environment variable, like WriteConfig
+	Schema      *Schema  // Validate every row against the schema, e.g. from ReadSchemaFile
+
+	// Decrypt unwraps encrypted input, e.g. with NewAESGCMReader.
+	Decrypt func(r io.Reader) (io.Reader, error)
+
+	// S3 object read by ImportFromS3
+	S3Bucket   string
+	S3Region   string
+	S3Path     string
+	S3Endpoint string
+}
+
+// ImportResult describes a completed import.
+type ImportResult struct {
+	Table    string
+	Columns  []string
+	RowCount int64
+	Method   ImportMethod
+	Duration time.Duration
+}
+
+// ImportFile loads a csv.gzip file written by WriteFile into a table.
+func ImportFile(db *sql.DB, csvGzipFileName string, config *ImportConfig) (*ImportResult, error) {
+	f, err := os.Open(csvGzipFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Import(db, f, config)
+}
+
+// ImportFromS3 loads a csv.gzip object uploaded by Upload into a table.
+// The object is streamed, nothing is written to disk.
+func ImportFromS3(db *sql.DB, config *ImportConfig) (*ImportResult, error) {
+	body, err := getS3Object(config.S3Bucket, config.S3Region, config.S3Path, config.S3Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return Import(db, body, config)
+}
+
+// Import loads the csv.gzip read from r into a table.
+// Rows are loaded in a transaction (or one every CommitEvery rows),
+// which is rolled back on error.
+func Import(db *sql.DB, r io.Reader, config *ImportConfig) (*ImportResult, error) {
+	startTime := time.Now()
+	if config.Table == "" {
+		return nil, fmt.Errorf("Table is needed to import")
+	}
+
+	reader, err := NewReader(r, &ReaderConfig{
+		Columns:    config.Columns,
+		NoHeader:   config.NoHeader,
+		Delimiter:  config.Delimiter,
+		NullString: config.NullString,
+		Schema:     config.Schema,
+		Decrypt:    config.Decrypt,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	columns := reader.Columns()
+
+	method := config.Method
+	if method == ImportAuto {
+		method = detectImportMethod(db)
+	}
+	if method == ImportLoadData && getLoadDataHandlers() == nil {
+		reader.Close()
+		return nil, fmt.Errorf("ImportLoadData needs the reader handlers of the MySQL driver, import github.com/thatInfrastructureGuy/sqltocsvgzip/mysqlimport")
+	}
+	loader := newRowLoader(method, detectDialect(db), config, columns)
+
+	result := &ImportResult{
+		Table:   config.Table,
+		Columns: columns,
+		Method:  method,
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = loader.begin(tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = loader.load(record, reader.nulls)
+			if err != nil {
+				err = fmt.Errorf("Row %v: %v", result.RowCount+1, err)
+			}
+		}
+		if err != nil {
+			loader.abort()
+			tx.Rollback()
+			return nil, err
+		}
+		result.RowCount++
+
+		if config.CommitEvery > 0 && result.RowCount%config.CommitEvery == 0 {
+			err = loader.end()
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			config.writeLog(Debug, fmt.Sprintf("Committed %v rows into %v", result.RowCount, config.Table))
+
+			tx, err = db.Begin()
+			if err != nil {
+				return nil, err
+			}
+			err = loader.begin(tx)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+	}
+
+	err = loader.end()
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	result.Duration = time.Since(startTime)
+	config.writeLog(Info, fmt.Sprintf("Imported %v rows into %v using %v", result.RowCount, config.Table, method))
+	return result, nil
+}
+
+// detectImportMethod returns the fastest method supported by the driver of db.
+func detectImportMethod(db *sql.DB) ImportMethod {
+	switch fmt.Sprintf("%T", db.Driver()) {
+	case "*pq.Driver":
+		return ImportCopy
+	case "*mysql.MySQLDriver":
+		if getLoadDataHandlers() != nil {
+			return ImportLoadData
+		}
+	}
+	return ImportInsert
+}
+
+// sqlDialect holds the placeholder and identifier quoting of a database.
+type sqlDialect struct {
+	placeholder func(n int) string
+	quoteLeft   string
+	quoteRight  string
+}
+
+func detectDialect(db *sql.DB) sqlDialect {
+	driver := fmt.Sprintf("%T", db.Driver())
+	switch {
+	case strings.HasPrefix(driver, "*pq."), strings.HasPrefix(driver, "*stdlib."):
+		return PostgresInsert.sqlDialect()
+	case strings.HasPrefix(driver, "*mssql."):
+		return SQLServerInsert.sqlDialect()
+	case strings.HasPrefix(driver, "*mysql."):
+		return MySQLInsert.sqlDialect()
+	}
+	return sqlDialect{func(n int) string { return "?" }, `"`, `"`}
+}
+
+func (d sqlDialect) quote(identifier string) string {
+	return d.quoteLeft + strings.Replace(identifier, d.quoteRight, d.quoteRight+d.quoteRight, -1) + d.quoteRight
+}
+
+// quoteIdentifier quotes every part of a dotted identifier, e.g. schema.table.
+func (d sqlDialect) quoteIdentifier(identifier string) string {
+	parts := strings.Split(identifier, ".")
+	for i, part := range parts {
+		parts[i] = d.quote(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+func (d sqlDialect) columnList(columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = d.quote(column)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// rowLoader loads the rows of one transaction.
+type rowLoader interface {
+	begin(tx *sql.Tx) error
+	load(record []string, nulls []bool) error
+	end() error
+	abort()
+}
+
+func newRowLoader(method ImportMethod, dialect sqlDialect, config *ImportConfig, columns []string) rowLoader {
+	switch method {
+	case ImportCopy:
+		return &copyLoader{config: config, columns: columns, dialect: dialect}
+	case ImportLoadData:
+		return &loadDataLoader{config: config, columns: columns, dialect: dialect}
+	}
+	return &insertLoader{config: config, columns: columns, dialect: dialect}
+}
+
+// importValues converts a record to statement arguments, the fields flagged in nulls being NULL.
+func importValues(record []string, nulls []bool) []interface{} {
+	values := make([]interface{}, len(record))
+	for i, value := range record {
+		if !isNull(nulls, i) {
+			values[i] = value
+		}
+	}
+	return values
+}
+
+// copyLoader uses the COPY FROM STDIN support of github.com/lib/pq:
+// a prepared COPY statement is executed once per row, then once without
+// arguments to flush.
+type copyLoader struct {
+	config  *ImportConfig
+	columns []string
+	dialect sqlDialect
+	stmt    *sql.Stmt
+}
+
+func (l *copyLoader) begin(tx *sql.Tx) (err error) {
+	l.stmt, err = tx.Prepare(fmt.Sprintf("COPY %v (%v) FROM STDIN", l.config.Table, l.dialect.columnList(l.columns)))
+	return err
+}
+
+func (l *copyLoader) load(record []string, nulls []bool) error {
+	_, err := l.stmt.Exec(importValues(record, nulls)...)
+	return err
+}
+
+func (l *copyLoader) end() error {
+	_, err := l.stmt.Exec()
+	if closeErr := l.stmt.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (l *copyLoader) abort() {
+	l.stmt.Close()
+}
+
+// insertLoader batches rows into multi-row INSERT statements.
+type insertLoader struct {
+	config  *ImportConfig
+	columns []string
+	dialect sqlDialect
+	tx      *sql.Tx
+	values  []interface{}
+	rows    int
+}
+
+// Most databases limit the number of parameters of a statement, SQL Server to 2100.
+const maxInsertParameters = 2000
+
+func (l *insertLoader) batchSize() int {
+	batchSize := l.config.BatchSize
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	if batchSize*len(l.columns) > maxInsertParameters {
+		batchSize = maxInsertParameters / len(l.columns)
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return batchSize
+}
+
+func (l *insertLoader) begin(tx *sql.Tx) error {
+	l.tx = tx
+	l.values = l.values[:0]
+	l.rows = 0
+	return nil
+}
+
+func (l *insertLoader) load(record []string, nulls []bool) error {
+	if len(record) != len(l.columns) {
+		return fmt.Errorf("Expected %v values, got %v", len(l.columns), len(record))
+	}
+	l.values = append(l.values, importValues(record, nulls)...)
+	l.rows++
+	if l.rows >= l.batchSize() {
+		return l.flush()
+	}
+	return nil
+}
+
+func (l *insertLoader) flush() error {
+	if l.rows == 0 {
+		return nil
+	}
+
+	var query strings.Builder
+	query.WriteString(fmt.Sprintf("INSERT INTO %v (%v) VALUES ", l.config.Table, l.dialect.columnList(l.columns)))
+	n := 1
+	for row := 0; row < l.rows; row++ {
+		if row > 0 {
+			query.WriteString(", ")
+		}
+		query.WriteString("(")
+		for column := range l.columns {
+			if column > 0 {
+				query.WriteString(", ")
+			}
+			query.WriteString(l.dialect.placeholder(n))
+			n++
+		}
+		query.WriteString(")")
+	}
+
+	_, err := l.tx.Exec(query.String(), l.values...)
+	l.values = l.values[:0]
+	l.rows = 0
+	return err
+}
+
+func (l *insertLoader) end() error {
+	return l.flush()
+}
+
+func (l *insertLoader) abort() {
+	l.values = l.values[:0]
+	l.rows = 0
+}
+
+// LoadDataHandlers registers the io.Reader read by LOAD DATA LOCAL INFILE
+// 'Reader::<name>', and deregisters it once the statement is done.
+type LoadDataHandlers struct {
+	Register   func(name string, handler func() io.Reader)
+	Deregister func(name string)
+}
+
+var (
+	loadDataMu       sync.RWMutex
+	loadDataHandlers *LoadDataHandlers
+)
+
+// RegisterLoadDataHandlers enables ImportLoadData. The mysqlimport package
+// registers the handlers of github.com/go-sql-driver/mysql when imported,
+// so that the driver is only linked by the programs using it.
+func RegisterLoadDataHandlers(handlers *LoadDataHandlers) {
+	loadDataMu.Lock()
+	defer loadDataMu.Unlock()
+	loadDataHandlers = handlers
+}
+
+func getLoadDataHandlers() *LoadDataHandlers {
+	loadDataMu.RLock()
+	defer loadDataMu.RUnlock()
+	return loadDataHandlers
+}
+
+// loadDataLoader streams the rows to LOAD DATA LOCAL INFILE through
+// a reader handler of github.com/go-sql-driver/mysql.
+type loadDataLoader struct {
+	config   *ImportConfig
+	columns  []string
+	dialect  sqlDialect
+	handlers *LoadDataHandlers
+	handler  string
+	pw       *io.PipeWriter
+	buf      bytes.Buffer
+	done     chan error
+}
+
+func (l *loadDataLoader) begin(tx *sql.Tx) error {
+	suffix := make([]byte, 8)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return err
+	}
+	l.handler = "sqltocsvgzip-" + hex.EncodeToString(suffix)
+	l.handlers = getLoadDataHandlers()
+
+	pr, pw := io.Pipe()
+	l.pw = pw
+	l.handlers.Register(l.handler, func() io.Reader {
+		return pr
+	})
+
+	// Values are always enclosed, NULLs are written as the unquoted word NULL
+	query := fmt.Sprintf("LOAD DATA LOCAL INFILE 'Reader::%v' INTO TABLE %v CHARACTER SET utf8mb4"+
+		" FIELDS TERMINATED BY ',' ENCLOSED BY '\"' ESCAPED BY ''"+
+		" LINES TERMINATED BY '\\n' (%v)",
+		l.handler, l.config.Table, l.dialect.columnList(l.columns))
+
+	l.done = make(chan error, 1)
+	go func() {
+		_, err := tx.Exec(query)
+		// Unblock the writer if the statement failed before reading everything
+		if err != nil {
+			pr.CloseWithError(err)
+		} else {
+			pr.Close()
+		}
+		l.done <- err
+	}()
+	return nil
+}
+
+func (l *loadDataLoader) load(record []string, nulls []bool) error {
+	l.buf.Reset()
+	for i, value := range record {
+		if i > 0 {
+			l.buf.WriteByte(',')
+		}
+		if isNull(nulls, i) {
+			l.buf.WriteString("NULL")
+			continue
+		}
+		l.buf.WriteByte('"')
+		l.buf.WriteString(strings.Replace(value, `"`, `""`, -1))
+		l.buf.WriteByte('"')
+	}
+	l.buf.WriteByte('\n')
+	_, err := l.pw.Write(l.buf.Bytes())
+	return err
+}
+
+func (l *loadDataLoader) end() error {
+	l.pw.Close()
+	err := <-l.done
+	l.handlers.Deregister(l.handler)
+	return err
+}
+
+func (l *loadDataLoader) abort() {
+	l.pw.CloseWithError(fmt.Errorf("Import aborted"))
+	<-l.done
+	l.handlers.Deregister(l.handler)
+}
+
+// mysqlEscape escapes a string literal for MySQL.
+func mysqlEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\x00", `\0`, "\n", `\n`, "\r", `\r`, "\x1a", `\Z`).Replace(s)
+}
+
+// writeLog decides whether to write a log to stdout depending on LogLevel.
+func (config *ImportConfig) writeLog(logLevel LogLevel, logLine string) {
+	level := config.LogLevel
+	if level == 0 {
+		level = getLogLevel()
+	}
+	if logLevel <= level {
+		log.Println(logLine)
+	}
+}
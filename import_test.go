@@ -0,0 +1,318 @@
+package sqltocsvgzip
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingDriver is a database/sql driver recording the statements
+// of the committed transactions, to test the SQL sent by Import.
+type recordingDriver struct {
+	mu  sync.Mutex
+	dbs map[string]*recordingDB
+}
+
+type recordingDB struct {
+	mu        sync.Mutex
+	committed []recordedExec
+	commits   int
+	failAt    int // Fail the nth Exec, 0 never fails
+	execs     int
+}
+
+type recordedExec struct {
+	query string
+	args  []driver.Value
+}
+
+var recorder = &recordingDriver{dbs: make(map[string]*recordingDB)}
+
+func init() {
+	sql.Register("recording", recorder)
+}
+
+// newRecordingDB returns a database recording the statements in rdb.
+func newRecordingDB(t *testing.T) (*sql.DB, *recordingDB) {
+	t.Helper()
+	rdb := &recordingDB{}
+	recorder.mu.Lock()
+	recorder.dbs[t.Name()] = rdb
+	recorder.mu.Unlock()
+
+	db, err := sql.Open("recording", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, rdb
+}
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	rdb, ok := d.dbs[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown database %v", name)
+	}
+	return &recordingConn{db: rdb}, nil
+}
+
+type recordingConn struct {
+	db      *recordingDB
+	pending []recordedExec
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{c: c, query: query}, nil
+}
+
+func (c *recordingConn) Close() error { return nil }
+
+func (c *recordingConn) Begin() (driver.Tx, error) {
+	c.pending = nil
+	return c, nil
+}
+
+func (c *recordingConn) Commit() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.committed = append(c.db.committed, c.pending...)
+	c.db.commits++
+	c.pending = nil
+	return nil
+}
+
+func (c *recordingConn) Rollback() error {
+	c.pending = nil
+	return nil
+}
+
+type recordingStmt struct {
+	c     *recordingConn
+	query string
+}
+
+func (s *recordingStmt) Close() error  { return nil }
+func (s *recordingStmt) NumInput() int { return -1 }
+
+func (s *recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.c.db.mu.Lock()
+	s.c.db.execs++
+	fail := s.c.db.execs == s.c.db.failAt
+	s.c.db.mu.Unlock()
+	if fail {
+		return nil, fmt.Errorf("Exec failed")
+	}
+
+	exec := recordedExec{query: s.query, args: args}
+	// LOAD DATA reads the registered handler
+	if strings.HasPrefix(s.query, "LOAD DATA LOCAL INFILE 'Reader::") {
+		name := strings.TrimPrefix(s.query, "LOAD DATA LOCAL INFILE 'Reader::")
+		name = name[:strings.Index(name, "'")]
+		handler, ok := testLoadDataHandlers.get(name)
+		if !ok {
+			return nil, fmt.Errorf("No reader handler %v", name)
+		}
+		content, err := ioutil.ReadAll(handler())
+		if err != nil {
+			return nil, err
+		}
+		exec.args = []driver.Value{string(content)}
+	}
+	s.c.pending = append(s.c.pending, exec)
+	return driver.RowsAffected(1), nil
+}
+
+func (s *recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, fmt.Errorf("Query is not supported")
+}
+
+// handlerRegistry stands for the reader handlers of the MySQL driver.
+type handlerRegistry struct {
+	mu       sync.Mutex
+	handlers map[string]func() io.Reader
+}
+
+var testLoadDataHandlers = &handlerRegistry{handlers: make(map[string]func() io.Reader)}
+
+func (h *handlerRegistry) register(name string, handler func() io.Reader) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.handlers[name] = handler
+}
+
+func (h *handlerRegistry) deregister(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.handlers, name)
+}
+
+func (h *handlerRegistry) get(name string) (func() io.Reader, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	handler, ok := h.handlers[name]
+	return handler, ok
+}
+
+// importValuesTable are the values of a nullstring column exported by exportImportValues.
+var importValuesTable = []interface{}{"", nil, "NULL", "a,b", `"q"`, "line\nbreak"}
+
+// exportImportValues exports importValuesTable with the given NullString.
+func exportImportValues(t *testing.T, nullString string) *bytes.Buffer {
+	t.Helper()
+	db, err := sql.Open("test", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, db, "WIPE")
+	exec(t, db, "CREATE|values|v=nullstring")
+	for _, value := range importValuesTable {
+		exec(t, db, "INSERT|values|v=?", value)
+	}
+	rows, err := db.Query("SELECT|values|v|")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := WriteConfig(rows)
+	c.LogLevel = Error
+	c.NullString = nullString
+	var buf bytes.Buffer
+	err = c.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// importedValues returns the arguments of the recorded statements.
+func importedValues(rdb *recordingDB) []interface{} {
+	var values []interface{}
+	for _, exec := range rdb.committed {
+		for _, arg := range exec.args {
+			values = append(values, arg)
+		}
+	}
+	return values
+}
+
+func TestImportInsert(t *testing.T) {
+	for _, nullString := range []string{"", "NULL"} {
+		db, rdb := newRecordingDB(t)
+		result, err := Import(db, exportImportValues(t, nullString), &ImportConfig{
+			Table:      "staging.values",
+			NullString: nullString,
+			BatchSize:  4,
+			Method:     ImportInsert,
+			LogLevel:   Error,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.RowCount != int64(len(importValuesTable)) || result.Method != ImportInsert {
+			t.Errorf("NullString %q: unexpected result %+v", nullString, result)
+		}
+		if len(rdb.committed) != 2 || rdb.commits != 1 {
+			t.Fatalf("NullString %q: expected 2 INSERTs in 1 transaction, got %v in %v", nullString, len(rdb.committed), rdb.commits)
+		}
+		expected := `INSERT INTO staging.values ("v") VALUES (?), (?), (?), (?)`
+		if rdb.committed[0].query != expected {
+			t.Errorf("NullString %q: got %q, expected %q", nullString, rdb.committed[0].query, expected)
+		}
+		if values := importedValues(rdb); !reflect.DeepEqual(values, importValuesTable) {
+			t.Errorf("NullString %q: imported %q, expected %q", nullString, values, importValuesTable)
+		}
+	}
+}
+
+func TestImportCopy(t *testing.T) {
+	db, rdb := newRecordingDB(t)
+	_, err := Import(db, exportImportValues(t, ""), &ImportConfig{
+		Table:       "values",
+		CommitEvery: 4,
+		Method:      ImportCopy,
+		LogLevel:    Error,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One COPY per row, flushed without arguments before each commit
+	if rdb.commits != 2 || len(rdb.committed) != len(importValuesTable)+2 {
+		t.Fatalf("Expected %v statements in 2 transactions, got %v in %v", len(importValuesTable)+2, len(rdb.committed), rdb.commits)
+	}
+	for _, i := range []int{4, len(rdb.committed) - 1} {
+		if len(rdb.committed[i].args) != 0 {
+			t.Errorf("Statement %v is not a flush: %v", i, rdb.committed[i].args)
+		}
+	}
+	if rdb.committed[0].query != `COPY values ("v") FROM STDIN` {
+		t.Errorf("Unexpected statement %q", rdb.committed[0].query)
+	}
+	if values := importedValues(rdb); !reflect.DeepEqual(values, importValuesTable) {
+		t.Errorf("Imported %q, expected %q", values, importValuesTable)
+	}
+}
+
+func TestImportRollback(t *testing.T) {
+	db, rdb := newRecordingDB(t)
+	rdb.failAt = 2
+	_, err := Import(db, exportImportValues(t, ""), &ImportConfig{
+		Table:     "values",
+		BatchSize: 4,
+		Method:    ImportInsert,
+		LogLevel:  Error,
+	})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if rdb.commits != 0 || len(rdb.committed) != 0 {
+		t.Errorf("Expected nothing committed, got %v", rdb.committed)
+	}
+}
+
+func TestImportLoadData(t *testing.T) {
+	db, rdb := newRecordingDB(t)
+	_, err := Import(db, exportImportValues(t, ""), &ImportConfig{Table: "values", Method: ImportLoadData})
+	if err == nil {
+		t.Error("Expected an error without the reader handlers")
+	}
+
+	RegisterLoadDataHandlers(&LoadDataHandlers{
+		Register:   testLoadDataHandlers.register,
+		Deregister: testLoadDataHandlers.deregister,
+	})
+	defer RegisterLoadDataHandlers(nil)
+	_, err = Import(db, exportImportValues(t, ""), &ImportConfig{
+		Table:    "values",
+		Method:   ImportLoadData,
+		LogLevel: Error,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rdb.committed) != 1 {
+		t.Fatalf("Expected one LOAD DATA, got %v", rdb.committed)
+	}
+	// NULL is the unquoted word NULL, every value is enclosed
+	expected := "\"\"\nNULL\n\"NULL\"\n\"a,b\"\n\"\"\"q\"\"\"\n\"line\nbreak\"\n"
+	if content := rdb.committed[0].args[0]; content != expected {
+		t.Errorf("Got %q, expected %q", content, expected)
+	}
+	if !strings.HasSuffix(rdb.committed[0].query, `ENCLOSED BY '"' ESCAPED BY '' LINES TERMINATED BY '\n' ("v")`) {
+		t.Errorf("Unexpected statement %q", rdb.committed[0].query)
+	}
+	if len(testLoadDataHandlers.handlers) != 0 {
+		t.Error("Reader handler was not deregistered")
+	}
+}
@@ -0,0 +1,260 @@
+package sqltocsvgzip
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// InsertDialect is the SQL dialect of the SQLInsert output.
+type InsertDialect int
+
+const (
+	// PostgresInsert writes standard SQL literals, bytea as '\x...'.
+	PostgresInsert InsertDialect = iota
+	// MySQLInsert quotes identifiers with backticks and escapes strings with backslashes.
+	MySQLInsert
+	// SQLServerInsert quotes identifiers with brackets and writes N'' strings.
+	SQLServerInsert
+)
+
+// SQL Server allows at most 1000 rows in a VALUES list.
+const maxInsertBatchSize = 1000
+
+// sqlDialect returns the identifier quoting of the dialect.
+func (d InsertDialect) sqlDialect() sqlDialect {
+	switch d {
+	case MySQLInsert:
+		return sqlDialect{func(n int) string { return "?" }, "`", "`"}
+	case SQLServerInsert:
+		return sqlDialect{func(n int) string { return fmt.Sprintf("@p%v", n) }, "[", "]"}
+	}
+	return sqlDialect{func(n int) string { return fmt.Sprintf("$%v", n) }, `"`, `"`}
+}
+
+// timeFormat is the default TimeFormat of the dialect. zoned is set for
+// the columns keeping the offset, see zoneAware.
+func (d InsertDialect) timeFormat(zoned bool) string {
+	if d == SQLServerInsert {
+		if zoned {
+			// datetimeoffset, with its 100ns precision
+			return "2006-01-02T15:04:05.9999999-07:00"
+		}
+		// ISO 8601 with milliseconds, read the same whatever DATEFORMAT by datetime and datetime2
+		return "2006-01-02T15:04:05.999"
+	}
+	if zoned {
+		return "2006-01-02 15:04:05.999999-07:00"
+	}
+	return "2006-01-02 15:04:05.999999"
+}
+
+// zoneAware reports whether values of the database type keep their offset,
+// e.g. TIMESTAMPTZ, TIMESTAMP WITH TIME ZONE or DATETIMEOFFSET. Other types
+// get no offset: SQL Server datetime rejects it and MySQL DATETIME
+// would convert the value to the session time zone.
+func zoneAware(databaseType string) bool {
+	databaseType = strings.ToUpper(databaseType)
+	return strings.HasSuffix(databaseType, "TZ") || strings.Contains(databaseType, "WITH TIME ZONE") ||
+		strings.Contains(databaseType, "DATETIMEOFFSET")
+}
+
+// insertTimeFormats returns the time format of every query column if the
+// default TimeFormat of the SQLInsert output applies, nil otherwise.
+func (c *Converter) insertTimeFormats() ([]string, error) {
+	if c.OutputFormat != SQLInsert || c.TimeFormat != "" {
+		return nil, nil
+	}
+	columnTypes, err := c.rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	timeFormats := make([]string, len(columnTypes))
+	for i, columnType := range columnTypes {
+		timeFormats[i] = c.InsertDialect.timeFormat(zoneAware(columnType.DatabaseTypeName()))
+	}
+	return timeFormats, nil
+}
+
+// insertWriter writes the rows as multi-row INSERT statements.
+type insertWriter struct {
+	buf        *bytes.Buffer
+	stmt       bytes.Buffer
+	dialect    InsertDialect
+	insertInto string
+	types      []string
+	binary     []bool // Columns written as hex literals
+	columns    []string
+	batchSize  int
+	rows       int
+	transcoder *transcoder
+}
+
+func (c *Converter) newInsertWriter(buf *bytes.Buffer) (*insertWriter, error) {
+	if c.SchemaTable == "" {
+		return nil, fmt.Errorf("SchemaTable is needed for the SQLInsert output")
+	}
+	if c.WriteBOM {
+		return nil, fmt.Errorf("WriteBOM is not supported by the SQLInsert output")
+	}
+	dialect := c.InsertDialect.sqlDialect()
+
+	w := &insertWriter{
+		buf:        buf,
+		dialect:    c.InsertDialect,
+		insertInto: fmt.Sprintf("INSERT INTO %v (%v) VALUES\n", dialect.quoteIdentifier(c.SchemaTable), dialect.columnList(c.result.Columns)),
+		types:      make([]string, len(c.result.Columns)),
+		binary:     make([]bool, len(c.result.Columns)),
+		columns:    c.result.Columns,
+		batchSize:  c.InsertBatchSize,
+		transcoder: c.newTranscoder(),
+	}
+	if w.batchSize <= 0 {
+		w.batchSize = 100
+	}
+	if w.batchSize > maxInsertBatchSize {
+		w.batchSize = maxInsertBatchSize
+	}
+	for i := range w.types {
+		w.types[i] = TypeString
+		if c.result.Schema != nil && i < len(c.result.Schema.Columns) {
+			w.types[i] = c.result.Schema.Columns[i].Type
+		}
+		w.binary[i] = w.types[i] == TypeBinary
+	}
+	return w, nil
+}
+
+// writeHeader does nothing, every statement lists the columns.
+func (w *insertWriter) writeHeader(columns []string) error {
+	return nil
+}
+
+func (w *insertWriter) writeRow(row []string, nulls []bool) error {
+	if len(row) != len(w.types) {
+		return fmt.Errorf("Expected %v fields, got %v", len(w.types), len(row))
+	}
+
+	row, err := w.transcoder.checkUTF8(row, w.columns, w.binary)
+	if err != nil {
+		return err
+	}
+
+	w.stmt.Reset()
+	if w.rows == 0 {
+		w.stmt.WriteString(w.insertInto)
+	} else {
+		w.stmt.WriteString(",\n")
+	}
+	w.stmt.WriteString("(")
+	for i, value := range row {
+		if i > 0 {
+			w.stmt.WriteString(", ")
+		}
+		if isNull(nulls, i) {
+			w.stmt.WriteString("NULL")
+			continue
+		}
+		w.stmt.WriteString(w.literal(value, w.types[i]))
+	}
+	w.stmt.WriteString(")")
+
+	w.rows++
+	if w.rows == w.batchSize {
+		w.stmt.WriteString(";\n")
+		w.rows = 0
+	}
+	return w.write(w.stmt.Bytes())
+}
+
+// close ends the last statement.
+func (w *insertWriter) close() error {
+	if w.rows == 0 {
+		return nil
+	}
+	w.rows = 0
+	return w.write([]byte(";\n"))
+}
+
+func (w *insertWriter) write(b []byte) error {
+	b, err := w.transcoder.encode(b)
+	if err != nil {
+		return err
+	}
+	_, err = w.buf.Write(b)
+	return err
+}
+
+// literal returns the non-NULL value as a SQL literal of the column type.
+// Values that are not valid for the type are written as strings.
+func (w *insertWriter) literal(value, columnType string) string {
+	switch columnType {
+	case TypeInteger, TypeDecimal, TypeFloat:
+		if isNumber(value) {
+			return value
+		}
+	case TypeBoolean:
+		if b, err := strconv.ParseBool(value); err == nil {
+			if w.dialect == SQLServerInsert {
+				if b {
+					return "1"
+				}
+				return "0"
+			}
+			return strings.ToUpper(strconv.FormatBool(b))
+		}
+	case TypeBinary:
+		switch w.dialect {
+		case MySQLInsert:
+			return "X'" + hex.EncodeToString([]byte(value)) + "'"
+		case SQLServerInsert:
+			return "0x" + hex.EncodeToString([]byte(value))
+		}
+		return `'\x` + hex.EncodeToString([]byte(value)) + "'"
+	}
+
+	switch w.dialect {
+	case MySQLInsert:
+		return "'" + mysqlEscape(value) + "'"
+	case SQLServerInsert:
+		return "N'" + strings.Replace(value, "'", "''", -1) + "'"
+	}
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+// isNumber reports whether s is a decimal number literal, e.g. -1.5e3.
+// NaN, Inf and hexadecimal numbers are not.
+func isNumber(s string) bool {
+	i := 0
+	if i < len(s) && (s[i] == '-' || s[i] == '+') {
+		i++
+	}
+	digits := 0
+	for ; i < len(s) && s[i] >= '0' && s[i] <= '9'; i++ {
+		digits++
+	}
+	if i < len(s) && s[i] == '.' {
+		for i++; i < len(s) && s[i] >= '0' && s[i] <= '9'; i++ {
+			digits++
+		}
+	}
+	if digits == 0 {
+		return false
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		i++
+		if i < len(s) && (s[i] == '-' || s[i] == '+') {
+			i++
+		}
+		exponent := i
+		for ; i < len(s) && s[i] >= '0' && s[i] <= '9'; i++ {
+		}
+		if i == exponent {
+			return false
+		}
+	}
+	return i == len(s)
+}
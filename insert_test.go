@@ -0,0 +1,74 @@
+package sqltocsvgzip
+
+import (
+	"bytes"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestSQLInsert(t *testing.T) {
+	db, err := sql.Open("test", "insert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, db, "WIPE")
+	exec(t, db, "CREATE|people|name=string,nick=nullstring,born=datetime,seen=timestamptz")
+	born := time.Date(1990, 1, 2, 3, 4, 5, 0, time.UTC)
+	seen := time.Date(2021, 6, 7, 8, 9, 10, 500000000, time.FixedZone("", 2*3600))
+	exec(t, db, "INSERT|people|name=?,nick=?,born=?,seen=?", "alice", "", born, seen)
+	exec(t, db, "INSERT|people|name=?,nick=?,born=?,seen=?", "o'brien", nil, born, seen)
+
+	tests := []struct {
+		dialect  InsertDialect
+		expected string
+	}{
+		// Only the zone-aware seen keeps its offset
+		{PostgresInsert, `INSERT INTO "public"."people" ("name", "nick", "born", "seen") VALUES` + "\n" +
+			`('alice', '', '1990-01-02 03:04:05', '2021-06-07 08:09:10.5+02:00'),` + "\n" +
+			`('o''brien', NULL, '1990-01-02 03:04:05', '2021-06-07 08:09:10.5+02:00');` + "\n"},
+		{SQLServerInsert, `INSERT INTO [public].[people] ([name], [nick], [born], [seen]) VALUES` + "\n" +
+			`(N'alice', N'', N'1990-01-02T03:04:05', N'2021-06-07T08:09:10.5+02:00'),` + "\n" +
+			`(N'o''brien', NULL, N'1990-01-02T03:04:05', N'2021-06-07T08:09:10.5+02:00');` + "\n"},
+	}
+	for _, test := range tests {
+		rows, err := db.Query("SELECT|people|name,nick,born,seen|")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := WriteConfig(rows)
+		c.LogLevel = Error
+		c.OutputFormat = SQLInsert
+		c.InsertDialect = test.dialect
+		c.SchemaTable = "public.people"
+		var buf bytes.Buffer
+		err = c.Write(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := gunzipString(t, buf.Bytes()); got != test.expected {
+			t.Errorf("Dialect %v:\ngot      %q\nexpected %q", test.dialect, got, test.expected)
+		}
+		if c.TimeFormat != "" {
+			t.Errorf("TimeFormat was changed to %q", c.TimeFormat)
+		}
+	}
+}
+
+func TestZoneAware(t *testing.T) {
+	for databaseType, expected := range map[string]bool{
+		"TIMESTAMPTZ":                 true,
+		"timestamp with time zone":    true,
+		"DATETIMEOFFSET":              true,
+		"TIMETZ":                      true,
+		"TIMESTAMP":                   false,
+		"timestamp without time zone": false,
+		"DATETIME":                    false,
+		"DATETIME2":                   false,
+	} {
+		if got := zoneAware(databaseType); got != expected {
+			t.Errorf("%v: got %v, expected %v", databaseType, got, expected)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package sqltocsvgzip
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// EmailPattern matches email addresses in free text.
+	EmailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	// PhonePattern matches international and north american style phone numbers in free text.
+	PhonePattern = regexp.MustCompile(`\+?\d{1,3}?[\s.\-]?\(?\d{2,4}\)?[\s.\-]?\d{3,4}[\s.\-]?\d{3,4}`)
+)
+
+// Mask describes how the values of a column are masked.
+// Name is reported in the audit summary.
+type Mask struct {
+	Name  string
+	Apply func(value string) string
+}
+
+// MaskSummary reports how many values of a column were masked.
+type MaskSummary struct {
+	Column       string
+	Mask         string
+	MaskedValues int64
+}
+
+// Masker masks PII per column. It runs on the stringified values,
+// before any preprocessor sees them, and keeps an audit of the masked columns.
+type Masker struct {
+	rules   map[string]Mask
+	columns []string
+	indexes []int
+	masks   []Mask
+	counts  map[string]int64
+}
+
+// NewMasker returns an empty Masker. Add rules with Column.
+func NewMasker() *Masker {
+	return &Masker{
+		rules:  make(map[string]Mask),
+		counts: make(map[string]int64),
+	}
+}
+
+// Column sets the mask for the column with the given name.
+func (m *Masker) Column(column string, mask Mask) *Masker {
+	if _, ok := m.rules[column]; !ok {
+		m.columns = append(m.columns, column)
+	}
+	m.rules[column] = mask
+	return m
+}
+
+// SetMasker lets you specify a Masker for this conversion.
+func (c *Converter) SetMasker(masker *Masker) {
+	c.masker = masker
+}
+
+// Summary returns the audit summary of the masked columns,
+// sorted by column name.
+func (m *Masker) Summary() []MaskSummary {
+	summary := make([]MaskSummary, 0, len(m.columns))
+	for _, column := range m.columns {
+		summary = append(summary, MaskSummary{
+			Column:       column,
+			Mask:         m.rules[column].Name,
+			MaskedValues: m.counts[column],
+		})
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		return summary[i].Column < summary[j].Column
+	})
+	return summary
+}
+
+// bind resolves the masked columns to their position in columnNames
+// and resets the audit counts for the new export.
+func (m *Masker) bind(columnNames []string) error {
+	indexes, err := columnIndexes(columnNames, m.columns)
+	if err != nil {
+		return err
+	}
+
+	m.indexes = indexes
+	m.counts = make(map[string]int64)
+	m.masks = make([]Mask, len(m.columns))
+	for i, column := range m.columns {
+		m.masks[i] = m.rules[column]
+	}
+	return nil
+}
+
+// mask masks the bound columns of row in place.
+// Empty and NULL values, flagged in nulls, are left untouched.
+func (m *Masker) mask(row []string, nulls []bool) []string {
+	for i, index := range m.indexes {
+		if index >= len(row) || row[index] == "" || isNull(nulls, index) {
+			continue
+		}
+		masked := m.masks[i].Apply(row[index])
+		if masked != row[index] {
+			m.counts[m.columns[i]]++
+			row[index] = masked
+		}
+	}
+	return row
+}
+
+// logSummary writes the audit summary to the log.
+func (m *Masker) logSummary(c *Converter) {
+	for _, s := range m.Summary() {
+		c.writeLog(Info, fmt.Sprintf("Masked %v values in column %v using %v", s.MaskedValues, s.Column, s.Mask))
+	}
+}
+
+// Redact replaces the whole value with replacement.
+func Redact(replacement string) Mask {
+	return Mask{
+		Name: "redact",
+		Apply: func(string) string {
+			return replacement
+		},
+	}
+}
+
+// MaskPartial replaces every character but the last keep characters with maskChar.
+// e.g. MaskPartial(4, '*') turns "4111111111111111" into "************1111".
+func MaskPartial(keep int, maskChar rune) Mask {
+	return Mask{
+		Name: fmt.Sprintf("partial(keep=%v)", keep),
+		Apply: func(value string) string {
+			runes := []rune(value)
+			for i := 0; i < len(runes)-keep; i++ {
+				runes[i] = maskChar
+			}
+			return string(runes)
+		},
+	}
+}
+
+// HashSHA256 replaces the value with the hex encoded SHA-256 of salt + value.
+func HashSHA256(salt []byte) Mask {
+	return Mask{
+		Name: "sha256",
+		Apply: func(value string) string {
+			h := sha256.New()
+			h.Write(salt)
+			h.Write([]byte(value))
+			return hex.EncodeToString(h.Sum(nil))
+		},
+	}
+}
+
+// Tokenize replaces the value with the hex encoded HMAC-SHA256 of the value.
+// The same value always produces the same token for a given key,
+// so tokenized columns can still be joined.
+func Tokenize(key []byte) Mask {
+	return Mask{
+		Name: "hmac-sha256",
+		Apply: func(value string) string {
+			h := hmac.New(sha256.New, key)
+			h.Write([]byte(value))
+			return hex.EncodeToString(h.Sum(nil))
+		},
+	}
+}
+
+// Fake replaces the value with a fake value of the same format:
+// digits are replaced with digits, letters with letters of the same case
+// and every other character is kept. The replacement is derived from
+// the HMAC-SHA256 of the value, so it is stable for a given key.
+func Fake(key []byte) Mask {
+	return Mask{
+		Name: "fake",
+		Apply: func(value string) string {
+			stream := newKeyStream(key, value)
+			var b strings.Builder
+			b.Grow(len(value))
+			for _, r := range value {
+				switch {
+				case r >= '0' && r <= '9':
+					b.WriteRune('0' + rune(stream.next()%10))
+				case r >= 'a' && r <= 'z':
+					b.WriteRune('a' + rune(stream.next()%26))
+				case r >= 'A' && r <= 'Z':
+					b.WriteRune('A' + rune(stream.next()%26))
+				default:
+					b.WriteRune(r)
+				}
+			}
+			return b.String()
+		},
+	}
+}
+
+// Detect applies mask to every match of patterns in the value and leaves
+// the rest of the text unchanged. Use it for free-text columns,
+// e.g. Detect(Redact("[email]"), EmailPattern).
+// Patterns are matched on the original value; where matches overlap, the
+// first one (the longest one if they start together) is masked.
+func Detect(mask Mask, patterns ...*regexp.Regexp) Mask {
+	return Mask{
+		Name: "detect(" + mask.Name + ")",
+		Apply: func(value string) string {
+			var spans [][]int
+			for _, pattern := range patterns {
+				spans = append(spans, pattern.FindAllStringIndex(value, -1)...)
+			}
+			if len(spans) == 0 {
+				return value
+			}
+			sort.Slice(spans, func(i, j int) bool {
+				if spans[i][0] == spans[j][0] {
+					return spans[i][1] > spans[j][1]
+				}
+				return spans[i][0] < spans[j][0]
+			})
+
+			var b strings.Builder
+			end := 0
+			for _, span := range spans {
+				if span[0] < end || span[0] == span[1] {
+					continue
+				}
+				b.WriteString(value[end:span[0]])
+				b.WriteString(mask.Apply(value[span[0]:span[1]]))
+				end = span[1]
+			}
+			b.WriteString(value[end:])
+			return b.String()
+		},
+	}
+}
+
+// keyStream is a deterministic byte stream built from HMAC-SHA256 blocks.
+type keyStream struct {
+	key     []byte
+	value   string
+	counter uint64
+	block   []byte
+}
+
+func newKeyStream(key []byte, value string) *keyStream {
+	return &keyStream{key: key, value: value}
+}
+
+func (k *keyStream) next() byte {
+	if len(k.block) == 0 {
+		h := hmac.New(sha256.New, k.key)
+		h.Write([]byte(k.value))
+		var counter [8]byte
+		binary.BigEndian.PutUint64(counter[:], k.counter)
+		h.Write(counter[:])
+		k.block = h.Sum(nil)
+		k.counter++
+	}
+	b := k.block[0]
+	k.block = k.block[1:]
+	return b
+}
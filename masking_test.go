@@ -0,0 +1,135 @@
+package sqltocsvgzip
+
+import (
+	"bytes"
+	"database/sql"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var testMaskKey = []byte("mask key")
+
+func TestMasks(t *testing.T) {
+	tests := []struct {
+		mask     Mask
+		value    string
+		expected string
+	}{
+		{Redact("[redacted]"), "secret", "[redacted]"},
+		{MaskPartial(4, '*'), "4111111111111111", "************1111"},
+		{MaskPartial(4, '*'), "éèà", "éèà"},
+		{MaskPartial(2, '#'), "ünïcode", "#####de"},
+	}
+	for _, test := range tests {
+		if got := test.mask.Apply(test.value); got != test.expected {
+			t.Errorf("%v(%q) = %q, expected %q", test.mask.Name, test.value, got, test.expected)
+		}
+	}
+
+	hash := HashSHA256([]byte("salt")).Apply("alice")
+	if len(hash) != 64 || hash == HashSHA256([]byte("other salt")).Apply("alice") {
+		t.Errorf("Unexpected salted hash %q", hash)
+	}
+	token := Tokenize(testMaskKey).Apply("alice@example.com")
+	if token != Tokenize(testMaskKey).Apply("alice@example.com") || token == Tokenize([]byte("other key")).Apply("alice@example.com") {
+		t.Errorf("Tokens are not stable per key")
+	}
+
+	fake := Fake(testMaskKey).Apply("Alice-42@b.io")
+	if fake != Fake(testMaskKey).Apply("Alice-42@b.io") || fake == "Alice-42@b.io" {
+		t.Errorf("Unexpected fake value %q", fake)
+	}
+	if !regexp.MustCompile(`^[A-Z][a-z]{4}-\d\d@[a-z]\.[a-z]{2}$`).MatchString(fake) {
+		t.Errorf("Fake value %q does not keep the format", fake)
+	}
+}
+
+func TestDetect(t *testing.T) {
+	redact := Detect(Redact("[pii]"), EmailPattern, PhonePattern)
+	got := redact.Apply("Mail alice@example.com or call +1 555-123-4567, ref 42.")
+	if expected := "Mail [pii] or call [pii], ref 42."; got != expected {
+		t.Errorf("Got %q, expected %q", got, expected)
+	}
+	if got := redact.Apply("nothing here"); got != "nothing here" {
+		t.Errorf("Got %q, expected the value unchanged", got)
+	}
+
+	// The phone number inside the email is part of the email match:
+	// it is masked once, with the email, and not masked again.
+	fake := Fake(testMaskKey)
+	value := "Mail john.5551234567@example.com"
+	got = Detect(fake, EmailPattern, PhonePattern).Apply(value)
+	if expected := "Mail " + fake.Apply("john.5551234567@example.com"); got != expected {
+		t.Errorf("Got %q, expected %q", got, expected)
+	}
+	if got != Detect(fake, PhonePattern, EmailPattern).Apply(value) {
+		t.Errorf("Masked value depends on the pattern order")
+	}
+
+	// Overlapping matches: the first one wins, the longest one if they start together
+	overlap := Detect(Redact("X"), regexp.MustCompile(`bcd`), regexp.MustCompile(`ab`), regexp.MustCompile(`abc`))
+	if got := overlap.Apply("abcde abcd"); got != "Xde Xd" {
+		t.Errorf("Got %q, expected %q", got, "Xde Xd")
+	}
+}
+
+func newContactRows(t *testing.T) *sql.Rows {
+	t.Helper()
+	db, err := sql.Open("test", "contacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, db, "WIPE")
+	exec(t, db, "CREATE|contacts|name=string,card=nullstring,notes=string")
+	exec(t, db, "INSERT|contacts|name=?,card=?,notes=?", "alice", "4111111111111111", "mail alice@example.com")
+	exec(t, db, "INSERT|contacts|name=?,card=?,notes=?", "bob", nil, "no contact")
+	exec(t, db, "INSERT|contacts|name=?,card=?,notes=?", "carol", "", "")
+	rows, err := db.Query("SELECT|contacts|name,card,notes|")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestMasker(t *testing.T) {
+	masker := NewMasker().
+		Column("card", MaskPartial(4, '*')).
+		Column("notes", Detect(Redact("[email]"), EmailPattern))
+
+	// Counts restart at each export
+	for i := 0; i < 2; i++ {
+		c := WriteConfig(newContactRows(t))
+		c.LogLevel = Error
+		c.NullString = "NULL"
+		c.SetMasker(masker)
+		var buf bytes.Buffer
+		err := c.Write(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// NULL and empty values are left untouched
+		expected := "name,card,notes\nalice,************1111,mail [email]\nbob,NULL,no contact\ncarol,,\n"
+		if got := gunzipString(t, buf.Bytes()); got != expected {
+			t.Fatalf("Export %v:\ngot      %q\nexpected %q", i+1, got, expected)
+		}
+
+		summary := masker.Summary()
+		if len(summary) != 2 ||
+			summary[0] != (MaskSummary{Column: "card", Mask: "partial(keep=4)", MaskedValues: 1}) ||
+			summary[1] != (MaskSummary{Column: "notes", Mask: "detect(redact)", MaskedValues: 1}) {
+			t.Errorf("Export %v: unexpected summary %+v", i+1, summary)
+		}
+	}
+}
+
+func TestMaskerUnknownColumn(t *testing.T) {
+	c := WriteConfig(newContactRows(t))
+	c.LogLevel = Error
+	c.SetMasker(NewMasker().Column("ssn", Redact("")))
+	err := c.Write(&bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "ssn") {
+		t.Errorf("Expected an unknown column error, got %v", err)
+	}
+}
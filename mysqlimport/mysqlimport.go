@@ -0,0 +1,18 @@
+// Package mysqlimport enables the LOAD DATA LOCAL INFILE import of
+// github.com/thatInfrastructureGuy/sqltocsvgzip for github.com/go-sql-driver/mysql.
+// Import it for its side effect:
+//
+//	import _ "github.com/thatInfrastructureGuy/sqltocsvgzip/mysqlimport"
+package mysqlimport
+
+import (
+	"github.com/go-sql-driver/mysql"
+	"github.com/thatInfrastructureGuy/sqltocsvgzip"
+)
+
+func init() {
+	sqltocsvgzip.RegisterLoadDataHandlers(&sqltocsvgzip.LoadDataHandlers{
+		Register:   mysql.RegisterReaderHandler,
+		Deregister: mysql.DeregisterReaderHandler,
+	})
+}
@@ -0,0 +1,83 @@
+package sqltocsvgzip
+
+import (
+	"bytes"
+	"database/sql"
+	"testing"
+)
+
+func newOrderRows(t *testing.T) *sql.Rows {
+	db, err := sql.Open("test", "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, db, "WIPE")
+	exec(t, db, "CREATE|orders|name=string,amount=float64")
+	exec(t, db, "INSERT|orders|name=?,amount=?", "small", 5.0)
+	exec(t, db, "INSERT|orders|name=?,amount=?", "large", 50.5)
+	exec(t, db, "INSERT|orders|name=?,amount=?", "huge", 1000.0)
+	rows, err := db.Query("SELECT|orders|name,amount|")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+// Rows are filtered on raw values, values rewritten and a computed column appended.
+func orderPreProcessor(t *testing.T) ValuePreProcessorFunc {
+	return func(values []interface{}, columnTypes []*sql.ColumnType) (bool, []interface{}) {
+		if len(columnTypes) != 2 || columnTypes[1].Name() != "amount" || columnTypes[1].DatabaseTypeName() != "FLOAT64" {
+			t.Errorf("Unexpected column types: %v", columnTypes)
+		}
+		amount := values[1].(float64)
+		if amount < 10 {
+			return false, nil
+		}
+		if amount > 100 {
+			values[1] = 100.0
+		}
+		return true, append(values, amount > 100)
+	}
+}
+
+func TestValuePreProcessor(t *testing.T) {
+	c := WriteConfig(newOrderRows(t))
+	c.LogLevel = Error
+	c.Headers = []string{"name", "amount", "capped"}
+	c.SetValuePreProcessor(orderPreProcessor(t))
+	c.SetColumnFormatter("amount", FormatDecimal(2))
+	var buf bytes.Buffer
+	err := c.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "name,amount,capped\nlarge,50.50,false\nhuge,100.00,true\n"
+	if got := gunzipString(t, buf.Bytes()); got != expected {
+		t.Errorf("got %q, expected %q", got, expected)
+	}
+	result := c.Result()
+	if result.RowCount != 2 || result.SkippedRows != 1 {
+		t.Errorf("RowCount %v and SkippedRows %v, expected 2 and 1", result.RowCount, result.SkippedRows)
+	}
+}
+
+func TestValuePreProcessorOtherFormats(t *testing.T) {
+	c := WriteConfig(newOrderRows(t))
+	c.LogLevel = Error
+	c.Headers = []string{"name", "amount", "capped"}
+	c.SetValuePreProcessor(orderPreProcessor(t))
+	c.OutputFormat = SQLInsert
+	c.SchemaTable = "orders"
+	var buf bytes.Buffer
+	err := c.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `INSERT INTO "orders" ("name", "amount", "capped") VALUES` + "\n" +
+		"('large', 50.5, 'false'),\n('huge', 100, 'true');\n"
+	if got := gunzipString(t, buf.Bytes()); got != expected {
+		t.Errorf("got %q, expected %q", got, expected)
+	}
+}
@@ -0,0 +1,316 @@
+package sqltocsvgzip
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/klauspost/pgzip"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/transform"
+)
+
+const (
+	gzipMagic = "\x1f\x8b"
+	ageMagic  = "age-encryption.org/"
+)
+
+// ReaderConfig describes how an exported file is read.
+type ReaderConfig struct {
+	Columns    []string // Names of the fields (default is the CSV header)
+	NoHeader   bool     // The CSV has no header row, Columns must be set
+	Delimiter  rune     // Delimiter of the CSV (default is the one of Schema, or comma)
+	NullString string   // Unquoted values read as NULL (default is the one of Schema, or empty string)
+	Schema     *Schema  // Validate every row against the schema, e.g. from ReadSchemaFile
+
+	// CSV dialect and encoding, like the ones of Converter
+	// (default is the one of Schema, or RFC 4180 in UTF-8)
+	Quoting          QuoteMode
+	QuoteChar        rune
+	EscapeChar       rune
+	RecordTerminator string
+	Encoding         encoding.Encoding
+
+	// Decrypt unwraps encrypted input, e.g. with NewAESGCMReader.
+	Decrypt func(r io.Reader) (io.Reader, error)
+
+	// S3 object read by OpenFromS3
+	S3Bucket   string
+	S3Region   string
+	S3Path     string
+	S3Endpoint string
+}
+
+// Reader reads the rows of a file written by a Converter.
+// The input may be gzip compressed or not, and encrypted.
+type Reader struct {
+	csvReader *csvReader
+	zr        *pgzip.Reader
+	closer    io.Closer
+	columns   []string
+	nulls     []bool          // NULL fields of the last row
+	validate  []*ColumnSchema // Schema of every field, nil without Schema
+	rowCount  int64
+}
+
+// OpenFile opens a file written by WriteFile.
+func OpenFile(fileName string, config *ReaderConfig) (*Reader, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewReader(f, config)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.closer = f
+	return r, nil
+}
+
+// OpenFromS3 opens an object uploaded by Upload. The object is streamed.
+func OpenFromS3(config *ReaderConfig) (*Reader, error) {
+	body, err := getS3Object(config.S3Bucket, config.S3Region, config.S3Path, config.S3Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewReader(body, config)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	r.closer = body
+	return r, nil
+}
+
+// NewReader returns a Reader reading from r.
+// Encrypted input needs Decrypt, gzip compression is detected.
+func NewReader(r io.Reader, config *ReaderConfig) (*Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(ageMagic))
+	if config.Decrypt != nil {
+		decrypted, err := config.Decrypt(br)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReader(decrypted)
+	} else if bytes.HasPrefix(magic, []byte(aesGCMMagic)) || bytes.HasPrefix(magic, []byte(ageMagic)) {
+		return nil, fmt.Errorf("Input is encrypted, Decrypt is needed")
+	}
+
+	reader := &Reader{}
+	input := io.Reader(br)
+	magic, _ = br.Peek(len(gzipMagic))
+	if string(magic) == gzipMagic {
+		zr, err := pgzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		reader.zr = zr
+		input = zr
+	}
+
+	decoding := config.Encoding
+	if decoding == nil && config.Schema != nil && config.Schema.Encoding != "" {
+		var err error
+		decoding, err = ianaindex.IANA.Encoding(config.Schema.Encoding)
+		if err != nil || decoding == nil {
+			reader.Close()
+			return nil, fmt.Errorf("Unsupported encoding %v, set Encoding", config.Schema.Encoding)
+		}
+	}
+	if decoding != nil {
+		input = transform.NewReader(input, decoding.NewDecoder())
+	}
+
+	// Skip the byte order mark of SetExcelCSV, or the one of Encoding left by the decoder
+	bomReader := bufio.NewReader(input)
+	if bom, _ := bomReader.Peek(len(utf8BOM)); string(bom) == utf8BOM {
+		bomReader.Discard(len(utf8BOM))
+	}
+
+	var err error
+	reader.csvReader, err = newCSVReader(bomReader, config)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+
+	reader.columns = config.Columns
+	if !config.NoHeader {
+		header, _, err := reader.csvReader.Read()
+		if err != nil {
+			reader.Close()
+			return nil, fmt.Errorf("Could not read CSV header: %v", err)
+		}
+		if len(reader.columns) == 0 {
+			reader.columns = append([]string(nil), header...)
+		}
+	}
+	if len(reader.columns) == 0 {
+		reader.Close()
+		return nil, fmt.Errorf("Columns are needed to read a CSV without header")
+	}
+
+	if config.Schema != nil {
+		err := reader.setSchema(config.Schema)
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+	}
+	return reader, nil
+}
+
+// Columns returns the names of the fields.
+func (r *Reader) Columns() []string {
+	return r.columns
+}
+
+// RowCount returns the number of rows read so far.
+func (r *Reader) RowCount() int64 {
+	return r.rowCount
+}
+
+// IsNull reports whether field i of the last row read is NULL:
+// unquoted and equal to NullString.
+func (r *Reader) IsNull(i int) bool {
+	return isNull(r.nulls, i)
+}
+
+// Read returns the next row, or io.EOF once all rows are read.
+func (r *Reader) Read() ([]string, error) {
+	record, nulls, err := r.csvReader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Row %v: %v", r.rowCount+1, err)
+	}
+	r.rowCount++
+	if len(record) != len(r.columns) {
+		return nil, fmt.Errorf("Row %v: Expected %v fields, got %v", r.rowCount, len(r.columns), len(record))
+	}
+	r.nulls = nulls
+
+	if r.validate != nil {
+		err = r.validateRow(record)
+		if err != nil {
+			return nil, fmt.Errorf("Row %v: %v", r.rowCount, err)
+		}
+	}
+	return record, nil
+}
+
+// ReadMap returns the next row keyed by column name, or io.EOF once all rows are read.
+func (r *Reader) ReadMap() (map[string]string, error) {
+	record, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	row := make(map[string]string, len(r.columns))
+	for i, column := range r.columns {
+		if i < len(record) {
+			row[column] = record[i]
+		}
+	}
+	return row, nil
+}
+
+// Close releases the decompression goroutines and closes the file or S3 object.
+func (r *Reader) Close() error {
+	if r.zr != nil {
+		r.zr.Close()
+	}
+	if r.closer != nil {
+		return r.closer.Close()
+	}
+	return nil
+}
+
+// setSchema matches the columns with the schema by name.
+func (r *Reader) setSchema(schema *Schema) error {
+	byName := make(map[string]*ColumnSchema, len(schema.Columns))
+	for i := range schema.Columns {
+		byName[schema.Columns[i].Name] = &schema.Columns[i]
+	}
+
+	r.validate = make([]*ColumnSchema, len(r.columns))
+	for i, column := range r.columns {
+		columnSchema, ok := byName[column]
+		if !ok {
+			return fmt.Errorf("Column %v is not in the schema", column)
+		}
+		r.validate[i] = columnSchema
+		delete(byName, column)
+	}
+	for _, column := range schema.Columns {
+		if _, missing := byName[column.Name]; missing {
+			return fmt.Errorf("Column %v of the schema is missing", column.Name)
+		}
+	}
+	return nil
+}
+
+// validateRow checks the values against the schema. Temporal and binary
+// values are not checked, their format depends on the export settings.
+func (r *Reader) validateRow(record []string) error {
+	for i, value := range record {
+		column := r.validate[i]
+		if r.IsNull(i) {
+			if column.Nullable != nil && !*column.Nullable {
+				return fmt.Errorf("NULL in column %v", column.Name)
+			}
+			continue
+		}
+
+		var err error
+		switch column.Type {
+		case TypeInteger:
+			_, err = strconv.ParseInt(value, 10, 64)
+		case TypeDecimal, TypeFloat:
+			_, err = strconv.ParseFloat(value, 64)
+		case TypeBoolean:
+			_, err = strconv.ParseBool(value)
+		case TypeString:
+			if column.Length > 0 && int64(utf8.RuneCountInString(value)) > column.Length {
+				err = fmt.Errorf("longer than %v characters", column.Length)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid %v value in column %v: %v", column.Type, column.Name, err)
+		}
+	}
+	return nil
+}
+
+// getS3Object returns the body of an S3 object.
+func getS3Object(bucket, region, key, endpoint string) (io.ReadCloser, error) {
+	if len(bucket) == 0 || len(region) == 0 || len(key) == 0 {
+		return nil, fmt.Errorf("S3Bucket, S3Region and S3Path are needed to read from AWS S3")
+	}
+
+	sess, err := session.NewSession(newS3Config(region, endpoint))
+	if err != nil {
+		return nil, err
+	}
+	object, err := s3.New(sess).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return object.Body, nil
+}
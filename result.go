@@ -0,0 +1,57 @@
+package sqltocsvgzip
+
+import (
+	"time"
+)
+
+// ExportResult describes the output of a WriteFile, Write or Upload call.
+type ExportResult struct {
+	FileName            string        // Local file name (WriteFile only)
+	Files               []string      // Local file names, in order (WriteDir only)
+	FileChecksumsSHA256 []string      // Hex encoded SHA-256 of every file of Files (WriteDir only)
+	Bucket              string        // S3 bucket (Upload only)
+	Key                 string        // S3 key (Upload only)
+	VersionID           string        // S3 object version, if versioning is enabled on the bucket
+	ETag                string        // S3 ETag of the uploaded object
+	Location            string        // URL of the uploaded object
+	PartCount           int64         // Number of uploaded parts (1 for objects uploaded in one go)
+	CompressedBytes     int64         // Size of the output
+	UncompressedBytes   int64         // Size of the CSV before compression
+	RowCount            int64         // Number of rows written
+	SkippedRows         int64         // Number of rows skipped by the preprocessors or InvalidChars
+	Columns             []string      // Column headers of the output
+	Schema              *Schema       // Columns types of the output, if SchemaFormat is set or the output is not CSV
+	Duration            time.Duration // Time taken by the export
+	ChecksumSHA256      string        // Hex encoded SHA-256 of the output, of all Files concatenated for WriteDir
+	Verified            bool          // The uploaded object was read back and matched the output (S3Verify only)
+}
+
+// Result returns the ExportResult of the last export.
+func (c *Converter) Result() *ExportResult {
+	result := c.result
+	result.RowCount = c.RowCount
+	result.ChecksumSHA256 = c.ChecksumSHA256
+	return &result
+}
+
+// startTimer records the start of the export, unless it has already started.
+func (c *Converter) startTimer() {
+	if c.startTime.IsZero() {
+		c.startTime = time.Now()
+	}
+}
+
+// stopTimer records the duration of the export.
+func (c *Converter) stopTimer() {
+	c.result.Duration = time.Since(c.startTime)
+}
+
+// byteCounter counts the bytes written to it.
+type byteCounter struct {
+	n *int64
+}
+
+func (b byteCounter) Write(p []byte) (int, error) {
+	*b.n += int64(len(p))
+	return len(p), nil
+}
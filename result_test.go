@@ -0,0 +1,81 @@
+package sqltocsvgzip
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// skipBob skips the rows of bob.
+func skipBob(row []string, columnNames []string) (bool, []string) {
+	return row[0] != "bob", row
+}
+
+func TestWriteFileResult(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "people.csv.gz")
+	c := WriteConfig(testRows(t, "people", "alice", "bob", "carol"))
+	c.LogLevel = Error
+	c.SetRowPreProcessor(skipBob)
+
+	result, err := c.WriteFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csv := gunzipString(t, b)
+	sum := sha256.Sum256(b)
+	expected := ExportResult{
+		FileName:          fileName,
+		CompressedBytes:   int64(len(b)),
+		UncompressedBytes: int64(len(csv)),
+		RowCount:          2,
+		SkippedRows:       1,
+		Columns:           []string{"name"},
+		Duration:          result.Duration,
+		ChecksumSHA256:    hex.EncodeToString(sum[:]),
+	}
+	if !reflect.DeepEqual(*result, expected) {
+		t.Errorf("Got      %+v\nexpected %+v", *result, expected)
+	}
+	if result.Duration <= 0 {
+		t.Errorf("Duration is %v", result.Duration)
+	}
+	if csv != "name\nalice\ncarol\n" {
+		t.Errorf("Unexpected file %q", csv)
+	}
+}
+
+func TestUploadResult(t *testing.T) {
+	fake, server := newFakeS3(t)
+	c := newS3Converter(testRows(t, "people", "alice", "bob", "carol"), server)
+	c.SetRowPreProcessor(skipBob)
+
+	result, err := c.Upload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	object := fake.objects["/exports/people.csv.gz"]
+	sum := sha256.Sum256(object)
+	if result.Bucket != "exports" || result.Key != "people.csv.gz" ||
+		result.VersionID != fake.versions["/exports/people.csv.gz"] || result.VersionID == "" ||
+		!strings.HasSuffix(result.Location, "/exports/people.csv.gz") ||
+		result.PartCount != 1 || result.FileName != "" {
+		t.Errorf("Unexpected object in result: %+v", result)
+	}
+	if result.RowCount != 2 || result.SkippedRows != 1 || !reflect.DeepEqual(result.Columns, []string{"name"}) {
+		t.Errorf("Unexpected rows in result: %+v", result)
+	}
+	if result.CompressedBytes != int64(len(object)) || result.UncompressedBytes != int64(len("name\nalice\ncarol\n")) ||
+		result.ChecksumSHA256 != hex.EncodeToString(sum[:]) || result.Duration <= 0 {
+		t.Errorf("Unexpected sizes in result: %+v", result)
+	}
+}
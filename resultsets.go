@@ -0,0 +1,145 @@
+package sqltocsvgzip
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EachResultSet calls export once per result set of the query, e.g. for
+// stored procedures returning several result sets. export writes the
+// current result set with WriteFile, Upload, Write... and set is the
+// number of the output, starting at 1. Every output gets its own headers.
+//
+// With ConcatResultSets, consecutive result sets with the same columns
+// are written to the same output.
+func (c *Converter) EachResultSet(export func(set int) (*ExportResult, error)) ([]*ExportResult, error) {
+	var results []*ExportResult
+	for set := 1; ; set++ {
+		c.resetExport()
+		result, err := export(set)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+
+		if !c.nextResultSet() {
+			return results, c.rows.Err()
+		}
+	}
+}
+
+// WriteResultSets writes every result set to its own file.
+// {set} in nameTemplate, which is required, is replaced by the number of the output, e.g. "report_{set}.csv.gz".
+func (c *Converter) WriteResultSets(nameTemplate string) ([]*ExportResult, error) {
+	if !strings.Contains(nameTemplate, "{set}") {
+		return nil, fmt.Errorf("nameTemplate %v has no {set}, every result set would overwrite the same file", nameTemplate)
+	}
+	return c.EachResultSet(func(set int) (*ExportResult, error) {
+		return c.WriteFile(resultSetName(nameTemplate, set))
+	})
+}
+
+// UploadResultSets uploads every result set to its own S3 object.
+// {set} in S3Path, which is required, is replaced by the number of the output, e.g. "/reports/report_{set}.csv.gz".
+// Use UploadResultSetsTo with other sinks.
+func (c *Converter) UploadResultSets() ([]*ExportResult, error) {
+	if _, ok := c.getSink().(*s3Sink); !ok {
+		return nil, fmt.Errorf("UploadResultSets only uploads to S3Path, use UploadResultSetsTo with SetSink")
+	}
+	if !strings.Contains(c.S3Path, "{set}") {
+		return nil, fmt.Errorf("S3Path %v has no {set}, every result set would overwrite the same object", c.S3Path)
+	}
+
+	pathTemplate := c.S3Path
+	defer func() {
+		c.S3Path = pathTemplate
+	}()
+
+	return c.EachResultSet(func(set int) (*ExportResult, error) {
+		c.S3Path = resultSetName(pathTemplate, set)
+		return c.Upload()
+	})
+}
+
+// UploadResultSetsTo uploads every result set to the sink returned by newSink
+// for the number of the output, e.g. a GCSSink per object.
+func (c *Converter) UploadResultSetsTo(newSink func(set int) Sink) ([]*ExportResult, error) {
+	sink := c.sink
+	defer func() {
+		c.sink = sink
+	}()
+
+	return c.EachResultSet(func(set int) (*ExportResult, error) {
+		c.SetSink(newSink(set))
+		return c.Upload()
+	})
+}
+
+func resultSetName(nameTemplate string, set int) string {
+	return strings.Replace(nameTemplate, "{set}", strconv.Itoa(set), -1)
+}
+
+// nextRow advances to the next row. With ConcatResultSets, it carries on
+// with the next result set if it has the same columns as the current one.
+func (c *Converter) nextRow() bool {
+	for {
+		if c.rows.Next() {
+			return true
+		}
+		if !c.ConcatResultSets || c.rows.Err() != nil {
+			return false
+		}
+
+		if !c.rows.NextResultSet() {
+			c.resultSetsDone = true
+			return false
+		}
+		columnNames, err := c.rows.Columns()
+		if err != nil || !equalColumns(columnNames, c.resultSetColumns) {
+			// Left for the next output
+			c.resultSetReady = true
+			return false
+		}
+		c.writeLog(Debug, "Concatenating result set with the same columns")
+	}
+}
+
+// nextResultSet moves on to the next result set, unless nextRow already did.
+func (c *Converter) nextResultSet() bool {
+	if c.resultSetReady {
+		c.resultSetReady = false
+		return true
+	}
+	if c.resultSetsDone {
+		return false
+	}
+	return c.rows.NextResultSet()
+}
+
+// resetExport clears the state of the previous export so that the
+// Converter can be used for the next output.
+func (c *Converter) resetExport() {
+	c.result = ExportResult{}
+	c.RowCount = 0
+	c.ChecksumSHA256 = ""
+	c.startTime = time.Time{}
+	c.partNumber = 0
+	c.gzipBuf = nil
+	c.partChecksums = nil
+	c.s3Resp = nil
+	c.s3CompletedParts = nil
+}
+
+func equalColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+package sqltocsvgzip
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUploadResultSetsTo(t *testing.T) {
+	fake, server := newFakeGCS(t)
+	c := UploadConfig(testRows(t, "people", "alice"))
+	c.LogLevel = Error
+
+	results, err := c.UploadResultSetsTo(func(set int) Sink {
+		sink := NewGCSSink("bucket", fmt.Sprintf("report_%v.csv.gz", set), nil)
+		sink.Endpoint = server.URL
+		return sink
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Key != "report_1.csv.gz" {
+		t.Fatalf("Unexpected results: %+v", results)
+	}
+	if got := gunzipString(t, fake.objects["report_1.csv.gz"]); got != "name\nalice\n" {
+		t.Fatalf("Unexpected object: %q", got)
+	}
+}
+
+func TestUploadResultSetsWithSink(t *testing.T) {
+	c := UploadConfig(testRows(t, "people", "alice"))
+	c.LogLevel = Error
+	c.SetSink(NewGCSSink("bucket", "report.csv.gz", nil))
+
+	_, err := c.UploadResultSets()
+	if err == nil {
+		t.Fatal("Expected an error, every result set would overwrite the same object")
+	}
+}
+
+// resultSetRows returns the rows of a query returning 4 result sets:
+// people (alice, bob), more people (carol), cities and no people.
+func resultSetRows(t *testing.T) *sql.Rows {
+	t.Helper()
+	db, err := sql.Open("test", "resultsets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, db, "WIPE")
+	exec(t, db, "CREATE|people|name=string,batch=int32")
+	exec(t, db, "CREATE|cities|city=string")
+	for i, name := range []string{"alice", "bob", "carol"} {
+		exec(t, db, "INSERT|people|name=?,batch=?", name, i/2+1)
+	}
+	exec(t, db, "INSERT|cities|city=?", "paris")
+	rows, err := db.Query("SELECT|people|name|batch=?;SELECT|people|name|batch=?;SELECT|cities|city|;SELECT|people|name|batch=?", 1, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestWriteResultSets(t *testing.T) {
+	tests := []struct {
+		concat   bool
+		expected []string
+	}{
+		{false, []string{"name\nalice\nbob\n", "name\ncarol\n", "city\nparis\n", "name\n"}},
+		// Consecutive result sets with the same columns share an output
+		{true, []string{"name\nalice\nbob\ncarol\n", "city\nparis\n", "name\n"}},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		c := WriteConfig(resultSetRows(t))
+		c.LogLevel = Error
+		c.ConcatResultSets = test.concat
+
+		results, err := c.WriteResultSets(filepath.Join(dir, "report_{set}.csv.gz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != len(test.expected) {
+			t.Fatalf("ConcatResultSets %v: got %v outputs, expected %v", test.concat, len(results), len(test.expected))
+		}
+		for i, expected := range test.expected {
+			fileName := filepath.Join(dir, fmt.Sprintf("report_%v.csv.gz", i+1))
+			b, err := ioutil.ReadFile(fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := gunzipString(t, b); got != expected {
+				t.Errorf("ConcatResultSets %v, output %v: got %q, expected %q", test.concat, i+1, got, expected)
+			}
+			if rows := int64(strings.Count(expected, "\n") - 1); results[i].RowCount != rows || results[i].FileName != fileName {
+				t.Errorf("ConcatResultSets %v, output %v: unexpected result %+v", test.concat, i+1, results[i])
+			}
+		}
+	}
+}
+
+func TestUploadResultSets(t *testing.T) {
+	fake, server := newFakeS3(t)
+	c := newS3Converter(resultSetRows(t), server)
+	c.S3Path = "reports/report_{set}.csv.gz"
+
+	results, err := c.UploadResultSets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 || results[2].Key != "reports/report_3.csv.gz" {
+		t.Fatalf("Unexpected results: %+v", results)
+	}
+	if got := gunzipString(t, fake.objects["/exports/reports/report_3.csv.gz"]); got != "city\nparis\n" {
+		t.Errorf("Unexpected object: %q", got)
+	}
+	if c.S3Path != "reports/report_{set}.csv.gz" {
+		t.Errorf("S3Path was not restored: %v", c.S3Path)
+	}
+}
+
+func TestResultSetsTemplateWithoutSet(t *testing.T) {
+	c := WriteConfig(resultSetRows(t))
+	c.LogLevel = Error
+	_, err := c.WriteResultSets(filepath.Join(t.TempDir(), "report.csv.gz"))
+	if err == nil || !strings.Contains(err.Error(), "{set}") {
+		t.Errorf("Expected an error, got %v", err)
+	}
+
+	c = UploadConfig(resultSetRows(t))
+	c.LogLevel = Error
+	c.S3Path = "reports/report.csv.gz"
+	_, err = c.UploadResultSets()
+	if err == nil || !strings.Contains(err.Error(), "{set}") {
+		t.Errorf("Expected an error, got %v", err)
+	}
+}
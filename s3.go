@@ -2,29 +2,28 @@ package sqltocsvgzip
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net/url"
-	"sync"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 const maxRetries = 3
 
 func (c *Converter) createMultipartRequest() (err error) {
-	// Filetype ref: https://mimesniff.spec.whatwg.org/#matching-an-archive-type-pattern
-	fileType := "application/x-gzip"
-
 	input := &s3.CreateMultipartUploadInput{
-		Bucket:      aws.String(c.S3Bucket),
-		Key:         aws.String(c.S3Path),
-		ACL:         aws.String(c.S3Acl),
-		ContentType: aws.String(fileType),
+		Bucket:            aws.String(c.S3Bucket),
+		Key:               aws.String(c.S3Path),
+		ACL:               aws.String(c.S3Acl),
+		ContentType:       aws.String(c.contentType()),
+		ChecksumAlgorithm: aws.String(s3.ChecksumAlgorithmSha256),
 	}
 
 	c.s3Resp, err = c.s3Svc.CreateMultipartUpload(input)
@@ -39,6 +38,14 @@ func (c *Converter) createMultipartRequest() (err error) {
 	return nil
 }
 
+// contentType returns the content type of the uploaded object.
+func (c *Converter) contentType() string {
+	if c.encrypt != nil {
+		return "application/octet-stream"
+	}
+	return c.OutputFormat.contentType()
+}
+
 // createS3Session authenticates with AWS and returns a S3 client
 func (c *Converter) createS3Session() error {
 	if len(c.S3Bucket) == 0 || len(c.S3Region) == 0 {
@@ -49,15 +56,31 @@ func (c *Converter) createS3Session() error {
 	}
 
 	// The session the S3 Uploader will use
-	sess := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(c.S3Region),
-	}))
+	sess := session.Must(session.NewSession(c.s3Config()))
 
 	c.s3Svc = s3.New(sess)
 
 	return nil
 }
 
+// s3Config returns the AWS config for the S3 settings of the Converter.
+func (c *Converter) s3Config() *aws.Config {
+	return newS3Config(c.S3Region, c.S3Endpoint)
+}
+
+// newS3Config returns the AWS config for region.
+// endpoint can point to any S3 compatible storage, e.g. MinIO.
+func newS3Config(region, endpoint string) *aws.Config {
+	config := &aws.Config{
+		Region: aws.String(region),
+	}
+	if len(endpoint) > 0 {
+		config.Endpoint = aws.String(endpoint)
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	return config
+}
+
 func (c *Converter) abortMultipartUpload() error {
 	c.writeLog(Info, "Aborting multipart upload for UploadId: "+aws.StringValue(c.s3Resp.UploadId))
 	abortInput := &s3.AbortMultipartUploadInput{
@@ -66,7 +89,11 @@ func (c *Converter) abortMultipartUpload() error {
 		UploadId: c.s3Resp.UploadId,
 	}
 	_, err := c.s3Svc.AbortMultipartUpload(abortInput)
-	return err
+	if err != nil {
+		return err
+	}
+	c.s3Resp = nil
+	return nil
 }
 
 func (c *Converter) completeMultipartUpload() (*s3.CompleteMultipartUploadOutput, error) {
@@ -82,14 +109,72 @@ func (c *Converter) completeMultipartUpload() (*s3.CompleteMultipartUploadOutput
 	return c.s3Svc.CompleteMultipartUpload(completeInput)
 }
 
-func (c *Converter) uploadPart(partNumber int64, buf []byte, mu *sync.RWMutex) (err error) {
+// completeS3Upload completes the multipart upload and verifies the checksums of the object.
+func (c *Converter) completeS3Upload() (*UploadOutput, error) {
+	// Sort completed parts
+	c.sortCompletedParts()
+	// Complete S3 upload
+	completeResponse, err := c.completeMultipartUpload()
+	if err != nil {
+		return nil, err
+	}
+	// The upload is complete, there is nothing left to abort
+	c.s3Resp = nil
+
+	// Verify the checksums of the completed object
+	err = c.verifyMultipartUpload(completeResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	uploadPath, err := url.PathUnescape(aws.StringValue(completeResponse.Location))
+	if err != nil {
+		return nil, err
+	}
+
+	return &UploadOutput{
+		Bucket:    c.S3Bucket,
+		Key:       c.S3Path,
+		Location:  uploadPath,
+		ETag:      strings.Trim(aws.StringValue(completeResponse.ETag), `"`),
+		VersionID: aws.StringValue(completeResponse.VersionId),
+	}, nil
+}
+
+// verifyMultipartUpload compares the ETag and the composite SHA-256 checksum
+// returned by S3 with the ones computed from the uploaded parts.
+func (c *Converter) verifyMultipartUpload(resp *s3.CompleteMultipartUploadOutput) error {
+	etag, checksumSHA256 := compositeChecksums(c.partChecksums)
+
+	if !c.S3SkipETagCheck {
+		err := verifyChecksum("ETag", etag, aws.StringValue(resp.ETag))
+		if err != nil {
+			return err
+		}
+	}
+
+	if resp.ChecksumSHA256 != nil {
+		err := verifyChecksum("ChecksumSHA256", checksumSHA256, aws.StringValue(resp.ChecksumSHA256))
+		if err != nil {
+			return err
+		}
+	}
+
+	c.writeLog(Debug, "Verified checksums of the completed upload: "+etag)
+	return nil
+}
+
+func (c *Converter) uploadPart(partNumber int64, buf []byte, checksum PartChecksum) (err error) {
 	tryNum := 1
+	checksumSHA256 := base64.StdEncoding.EncodeToString(checksum.SHA256)
 	partInput := &s3.UploadPartInput{
-		Body:       bytes.NewReader(buf),
-		Bucket:     c.s3Resp.Bucket,
-		Key:        c.s3Resp.Key,
-		PartNumber: aws.Int64(partNumber),
-		UploadId:   c.s3Resp.UploadId,
+		Body:           bytes.NewReader(buf),
+		Bucket:         c.s3Resp.Bucket,
+		Key:            c.s3Resp.Key,
+		PartNumber:     aws.Int64(partNumber),
+		UploadId:       c.s3Resp.UploadId,
+		ContentMD5:     aws.String(base64.StdEncoding.EncodeToString(checksum.MD5)),
+		ChecksumSHA256: aws.String(checksumSHA256),
 	}
 
 	for tryNum <= maxRetries {
@@ -106,12 +191,13 @@ func (c *Converter) uploadPart(partNumber int64, buf []byte, mu *sync.RWMutex) (
 			tryNum++
 		} else {
 			c.writeLog(Info, fmt.Sprintf("Uploaded part: #%v", partNumber))
-			mu.Lock()
+			c.s3Mu.Lock()
 			c.s3CompletedParts = append(c.s3CompletedParts, &s3.CompletedPart{
-				ETag:       uploadResult.ETag,
-				PartNumber: aws.Int64(partNumber),
+				ETag:           uploadResult.ETag,
+				PartNumber:     aws.Int64(partNumber),
+				ChecksumSHA256: aws.String(checksumSHA256),
 			})
-			mu.Unlock()
+			c.s3Mu.Unlock()
 			return nil
 		}
 	}
@@ -125,32 +211,62 @@ func (c *Converter) UploadObjectToS3(w io.Writer) error {
 		return fmt.Errorf("Expected buffer. Got %T", w)
 	}
 
-	fileType := "application/x-gzip"
+	output, err := c.putS3Object(c.S3Path, buf.Bytes(), c.contentType())
+	if err != nil {
+		return err
+	}
 
-	// The session the S3 Uploader will use
-	sess := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(c.S3Region),
-	}))
-
-	// Create an uploader with the session and default options
-	uploader := s3manager.NewUploader(sess)
-
-	// Upload the file to S3.
-	res, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket:      aws.String(c.S3Bucket),
-		Key:         aws.String(c.S3Path),
-		ACL:         aws.String(c.S3Acl),
-		ContentType: aws.String(fileType),
-		Body:        bytes.NewReader(buf.Bytes()),
+	c.result.Bucket = output.Bucket
+	c.result.Key = output.Key
+	c.result.Location = output.Location
+	c.result.ETag = output.ETag
+	c.result.VersionID = output.VersionID
+	c.result.PartCount = 1
+	return nil
+}
+
+// putS3Object uploads buf to AWS S3 at key in a single PutObject request,
+// so that the ETag is the MD5 of buf whatever its size.
+func (c *Converter) putS3Object(key string, buf []byte, contentType string) (*UploadOutput, error) {
+	if c.s3Svc == nil {
+		err := c.createS3Session()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	checksum := NewPartChecksum(buf)
+	req, res := c.s3Svc.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:         aws.String(c.S3Bucket),
+		Key:            aws.String(key),
+		ACL:            aws.String(c.S3Acl),
+		ContentType:    aws.String(contentType),
+		ContentMD5:     aws.String(base64.StdEncoding.EncodeToString(checksum.MD5)),
+		ChecksumSHA256: aws.String(base64.StdEncoding.EncodeToString(checksum.SHA256)),
+		Body:           bytes.NewReader(buf),
 	})
+	err := req.Send()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	uploadPath, err := url.PathUnescape(res.Location)
+	if !c.S3SkipETagCheck {
+		err = verifyChecksum("ETag", hex.EncodeToString(checksum.MD5), aws.StringValue(res.ETag))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	uploadPath, err := url.PathUnescape(req.HTTPRequest.URL.String())
 	if err != nil {
-		return err
+		return nil, err
 	}
-	c.writeLog(Info, "Successfully uploaded file: "+uploadPath)
-	return nil
+
+	return &UploadOutput{
+		Bucket:    c.S3Bucket,
+		Key:       key,
+		Location:  uploadPath,
+		ETag:      strings.Trim(aws.StringValue(res.ETag), `"`),
+		VersionID: aws.StringValue(res.VersionId),
+	}, nil
 }
@@ -0,0 +1,348 @@
+package sqltocsvgzip
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 implements the path-style object and multipart upload operations
+// used by the S3 upload, like MinIO. Checksums are required and verified.
+type fakeS3 struct {
+	mu          sync.Mutex
+	objects     map[string][]byte // by path, "/bucket/key"
+	versions    map[string]string
+	uploads     map[string]map[int64][]byte
+	aborted     int
+	deleted     []string
+	requests    []string
+	getVersions []string // versionId of the GetObject requests
+
+	// Faults
+	failPart       int64  // Part number whose uploads fail with BadDigest
+	etag           string // ETag returned by CompleteMultipartUpload and PutObject instead of the real one
+	checksumSHA256 string // ChecksumSHA256 returned by CompleteMultipartUpload instead of the real one
+	corruptGet     bool   // Flip a byte of the objects read back
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	f := &fakeS3{
+		objects:  map[string][]byte{},
+		versions: map[string]string{},
+		uploads:  map[string]map[int64][]byte{},
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+// newS3Converter returns an UploadConfig Converter uploading to
+// exports/people.csv.gz on the fake S3 server.
+func newS3Converter(rows *sql.Rows, server *httptest.Server) *Converter {
+	c := UploadConfig(rows)
+	c.LogLevel = Error
+	c.S3Bucket = "exports"
+	c.S3Region = "us-east-1"
+	c.S3Path = "people.csv.gz"
+	c.S3Endpoint = server.URL
+	c.S3Acl = "private"
+	return c
+}
+
+// largeRows returns rows of 1Mb each, enough for two parts of the minimum
+// size when written without compression.
+func largeRows(t *testing.T, table string, count int) *sql.Rows {
+	t.Helper()
+	names := make([]string, count)
+	for i := range names {
+		names[i] = strings.Repeat(string(rune('a'+i%26)), 1024*1024)
+	}
+	return testRows(t, table, names...)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket, key := path[0], path[len(path)-1]
+	query := r.URL.Query()
+	_, initiate := query["uploads"]
+	uploadID := query.Get("uploadId")
+
+	switch {
+	case r.Method == http.MethodPost && initiate:
+		f.requests = append(f.requests, "CreateMultipartUpload")
+		uploadID = strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[uploadID] = map[int64][]byte{}
+		f.writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: uploadID})
+
+	case r.Method == http.MethodPut && uploadID != "":
+		f.requests = append(f.requests, "UploadPart")
+		parts, ok := f.uploads[uploadID]
+		if !ok {
+			f.writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		partNumber, _ := strconv.ParseInt(query.Get("partNumber"), 10, 64)
+		if partNumber == f.failPart || !f.checkDigests(r, body) {
+			f.writeError(w, http.StatusBadRequest, "BadDigest")
+			return
+		}
+		parts[partNumber] = body
+		sum := md5.Sum(body)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+
+	case r.Method == http.MethodPost && uploadID != "":
+		f.requests = append(f.requests, "CompleteMultipartUpload")
+		parts, ok := f.uploads[uploadID]
+		if !ok {
+			f.writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var complete struct {
+			Parts []struct {
+				PartNumber int64
+				ETag       string
+			} `xml:"Part"`
+		}
+		err := xml.Unmarshal(body, &complete)
+		if err != nil {
+			f.writeError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+
+		var object []byte
+		md5Hash := md5.New()
+		sha256Hash := sha256.New()
+		for i, part := range complete.Parts {
+			data, ok := parts[part.PartNumber]
+			if !ok || part.PartNumber != int64(i+1) {
+				f.writeError(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			object = append(object, data...)
+			partMD5 := md5.Sum(data)
+			partSHA256 := sha256.Sum256(data)
+			md5Hash.Write(partMD5[:])
+			sha256Hash.Write(partSHA256[:])
+		}
+		delete(f.uploads, uploadID)
+		f.store(w, r.URL.Path, object)
+
+		etag := fmt.Sprintf(`"%v-%v"`, hex.EncodeToString(md5Hash.Sum(nil)), len(complete.Parts))
+		if f.etag != "" {
+			etag = f.etag
+		}
+		checksum := fmt.Sprintf("%v-%v", base64.StdEncoding.EncodeToString(sha256Hash.Sum(nil)), len(complete.Parts))
+		if f.checksumSHA256 != "" {
+			checksum = f.checksumSHA256
+		}
+		f.writeXML(w, struct {
+			XMLName        xml.Name `xml:"CompleteMultipartUploadResult"`
+			Location       string
+			Bucket         string
+			Key            string
+			ETag           string
+			ChecksumSHA256 string
+		}{Location: "http://" + r.Host + r.URL.Path, Bucket: bucket, Key: key, ETag: etag, ChecksumSHA256: checksum})
+
+	case r.Method == http.MethodDelete && uploadID != "":
+		f.requests = append(f.requests, "AbortMultipartUpload")
+		if _, ok := f.uploads[uploadID]; !ok {
+			f.writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		delete(f.uploads, uploadID)
+		f.aborted++
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut:
+		f.requests = append(f.requests, "PutObject")
+		if !f.checkDigests(r, body) {
+			f.writeError(w, http.StatusBadRequest, "BadDigest")
+			return
+		}
+		f.store(w, r.URL.Path, body)
+		sum := md5.Sum(body)
+		etag := `"` + hex.EncodeToString(sum[:]) + `"`
+		if f.etag != "" {
+			etag = f.etag
+		}
+		w.Header().Set("ETag", etag)
+
+	case r.Method == http.MethodGet:
+		f.requests = append(f.requests, "GetObject")
+		f.getVersions = append(f.getVersions, query.Get("versionId"))
+		object, ok := f.objects[r.URL.Path]
+		if !ok || (query.Get("versionId") != "" && query.Get("versionId") != f.versions[r.URL.Path]) {
+			f.writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if f.corruptGet && len(object) > 0 {
+			object = append([]byte(nil), object...)
+			object[len(object)/2] ^= 1
+		}
+		w.Write(object)
+
+	case r.Method == http.MethodDelete:
+		f.requests = append(f.requests, "DeleteObject")
+		delete(f.objects, r.URL.Path)
+		f.deleted = append(f.deleted, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		f.writeError(w, http.StatusBadRequest, "NotImplemented")
+	}
+}
+
+// checkDigests checks the required Content-MD5 and x-amz-checksum-sha256 headers.
+func (f *fakeS3) checkDigests(r *http.Request, body []byte) bool {
+	md5Sum := md5.Sum(body)
+	sha256Sum := sha256.Sum256(body)
+	return r.Header.Get("Content-MD5") == base64.StdEncoding.EncodeToString(md5Sum[:]) &&
+		r.Header.Get("X-Amz-Checksum-Sha256") == base64.StdEncoding.EncodeToString(sha256Sum[:])
+}
+
+// store saves a new version of the object at path.
+func (f *fakeS3) store(w http.ResponseWriter, path string, object []byte) {
+	f.objects[path] = object
+	f.versions[path] = "v" + strconv.Itoa(len(f.requests))
+	w.Header().Set("x-amz-version-id", f.versions[path])
+}
+
+func (f *fakeS3) writeXML(w http.ResponseWriter, v interface{}) {
+	b, _ := xml.Marshal(v)
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(b)
+}
+
+func (f *fakeS3) writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%v</Code><Message>%v</Message></Error>", code, code)
+}
+
+func TestUploadS3Multipart(t *testing.T) {
+	fake, server := newFakeS3(t)
+	c := newS3Converter(largeRows(t, "people", 11), server)
+	c.CompressionLevel = flate.NoCompression
+	c.UploadPartSize = minFileSize
+
+	result, err := c.Upload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	object := fake.objects["/exports/people.csv.gz"]
+	if result.PartCount != 2 {
+		t.Errorf("Uploaded %v parts, expected 2", result.PartCount)
+	}
+	sum := sha256.Sum256(object)
+	if result.ChecksumSHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("ChecksumSHA256 is %v, expected the SHA-256 of the object", result.ChecksumSHA256)
+	}
+	if !strings.HasSuffix(result.ETag, "-2") {
+		t.Errorf("Unexpected ETag %v", result.ETag)
+	}
+	if got := gunzipString(t, object); len(got) != 11*(1024*1024+1)+len("name\n") {
+		t.Errorf("Object is %v bytes uncompressed", len(got))
+	}
+}
+
+func TestUploadS3PutObject(t *testing.T) {
+	fake, server := newFakeS3(t)
+	c := newS3Converter(testRows(t, "people", "alice", "bob"), server)
+
+	result, err := c.Upload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	object := fake.objects["/exports/people.csv.gz"]
+	if got := gunzipString(t, object); got != "name\nalice\nbob\n" {
+		t.Fatalf("Unexpected object %q", got)
+	}
+	// Small outputs are uploaded in one request, so their ETag is their MD5
+	sum := md5.Sum(object)
+	if result.PartCount != 1 || result.ETag != hex.EncodeToString(sum[:]) {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	if fake.aborted != 1 {
+		t.Errorf("Expected the multipart upload to be aborted, requests: %v", fake.requests)
+	}
+}
+
+func TestUploadS3ChecksumMismatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		fault    func(f *fakeS3)
+		large    bool
+		expected string
+	}{
+		{"Multipart ETag", func(f *fakeS3) { f.etag = `"0123456789abcdef0123456789abcdef-2"` }, true, "ETag mismatch"},
+		{"Multipart ChecksumSHA256", func(f *fakeS3) { f.checksumSHA256 = "AAAA-2" }, true, "ChecksumSHA256 mismatch"},
+		{"PutObject ETag", func(f *fakeS3) { f.etag = `"0123456789abcdef0123456789abcdef"` }, false, "ETag mismatch"},
+	}
+	for _, test := range tests {
+		fake, server := newFakeS3(t)
+		test.fault(fake)
+		rows := testRows(t, "people", "alice")
+		if test.large {
+			rows = largeRows(t, "people", 11)
+		}
+		c := newS3Converter(rows, server)
+		c.CompressionLevel = flate.NoCompression
+		c.UploadPartSize = minFileSize
+
+		_, err := c.Upload()
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%v: expected %q, got %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestUploadS3SkipETagCheck(t *testing.T) {
+	fake, server := newFakeS3(t)
+	// SSE-KMS ETags are not MD5 digests
+	fake.etag = `"kms-etag-2"`
+	c := newS3Converter(largeRows(t, "people", 11), server)
+	c.CompressionLevel = flate.NoCompression
+	c.UploadPartSize = minFileSize
+	c.S3SkipETagCheck = true
+
+	result, err := c.Upload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ETag != "kms-etag-2" {
+		t.Errorf("Unexpected ETag %v", result.ETag)
+	}
+	if !bytes.HasPrefix(fake.objects["/exports/people.csv.gz"], []byte{0x1f, 0x8b}) {
+		t.Errorf("Object is not gzipped")
+	}
+}
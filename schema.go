@@ -0,0 +1,727 @@
+package sqltocsvgzip
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+// SchemaFormat is the format of the schema sidecar.
+type SchemaFormat int
+
+const (
+	// NoSchema does not write a schema sidecar.
+	NoSchema SchemaFormat = iota
+	// JSONSchema describes a row as a JSON Schema (draft-07) object.
+	JSONSchema
+	// CSVW is a CSV on the Web metadata document.
+	CSVW
+	// BigQueryDDL is a BigQuery CREATE TABLE statement.
+	BigQueryDDL
+	// RedshiftDDL is an Amazon Redshift CREATE TABLE statement.
+	RedshiftDDL
+	// SnowflakeDDL is a Snowflake CREATE TABLE statement.
+	SnowflakeDDL
+)
+
+// Extension returns the suffix appended to the output name for the sidecar.
+func (f SchemaFormat) Extension() string {
+	switch f {
+	case JSONSchema:
+		return ".schema.json"
+	case CSVW:
+		return "-metadata.json"
+	case BigQueryDDL, RedshiftDDL, SnowflakeDDL:
+		return ".sql"
+	}
+	return ""
+}
+
+// ContentType returns the content type of the sidecar.
+func (f SchemaFormat) ContentType() string {
+	switch f {
+	case JSONSchema:
+		return "application/schema+json"
+	case CSVW:
+		return "application/csvm+json"
+	}
+	return "application/sql"
+}
+
+// Logical types of the columns, derived from the database and scan types.
+const (
+	TypeString    = "string"
+	TypeInteger   = "integer"
+	TypeDecimal   = "decimal"
+	TypeFloat     = "float"
+	TypeBoolean   = "boolean"
+	TypeDate      = "date"
+	TypeTime      = "time"
+	TypeTimestamp = "timestamp"
+	TypeBinary    = "binary"
+)
+
+// ColumnSchema describes a column of the output.
+type ColumnSchema struct {
+	Name         string `json:"name"`
+	Type         string `json:"type"`                   // Logical type, e.g. TypeInteger
+	DatabaseType string `json:"databaseType,omitempty"` // As reported by the driver, e.g. VARCHAR
+	ScanType     string `json:"scanType,omitempty"`     // Go type used to scan the column, e.g. sql.NullInt64
+	Nullable     *bool  `json:"nullable,omitempty"`     // Unset if the driver does not know
+	Length       int64  `json:"length,omitempty"`
+	Precision    int64  `json:"precision,omitempty"`
+	Scale        int64  `json:"scale,omitempty"`
+}
+
+// Schema describes the columns of the output, and the CSV dialect and
+// encoding a Reader needs to read it back. Only CSVW sidecars keep the dialect.
+type Schema struct {
+	Columns          []ColumnSchema `json:"columns"`
+	Delimiter        rune           `json:"-"`
+	Header           bool           `json:"-"`
+	NullString       string         `json:"-"`
+	Quoting          QuoteMode      `json:"-"`
+	QuoteChar        rune           `json:"-"`
+	EscapeChar       rune           `json:"-"`
+	RecordTerminator string         `json:"-"`
+	Encoding         string         `json:"-"` // IANA name of the OutputEncoding, empty for UTF-8
+}
+
+// setSchema builds the schema of the output from the column types of the query.
+// Output columns are matched with the query columns by position, or by name
+// if the transform pipeline changed them. Unknown and formatted columns, and the
+// ones appended by the ValuePreProcessorFunc, are strings.
+func (c *Converter) setSchema(headers []string) error {
+	columnTypes, err := c.rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+
+	byName := make(map[string]int, len(headers))
+	for i, header := range headers {
+		byName[header] = i
+	}
+
+	schema := &Schema{
+		Delimiter:        c.Delimiter,
+		Header:           c.WriteHeaders,
+		NullString:       c.NullString,
+		Quoting:          c.Quoting,
+		QuoteChar:        c.QuoteChar,
+		EscapeChar:       c.EscapeChar,
+		RecordTerminator: c.RecordTerminator,
+	}
+	if c.OutputEncoding != nil {
+		schema.Encoding, err = ianaindex.IANA.Name(c.OutputEncoding)
+		if err != nil {
+			// Not readable back without ReaderConfig.Encoding
+			schema.Encoding = fmt.Sprint(c.OutputEncoding)
+		}
+	}
+	for i, name := range c.result.Columns {
+		index := i
+		if c.pipeline != nil {
+			var ok bool
+			index, ok = byName[name]
+			if !ok {
+				index = -1
+			}
+		}
+
+		column := ColumnSchema{Name: name, Type: TypeString}
+		if index >= 0 && index < len(columnTypes) {
+			column = newColumnSchema(name, columnTypes[index])
+			if index < len(c.formatters) && c.formatters[index] != nil {
+				column.Type = TypeString
+			}
+		}
+		schema.Columns = append(schema.Columns, column)
+	}
+
+	c.result.Schema = schema
+	return nil
+}
+
+func newColumnSchema(name string, columnType *sql.ColumnType) ColumnSchema {
+	column := ColumnSchema{
+		Name:         name,
+		DatabaseType: columnType.DatabaseTypeName(),
+	}
+	if scanType := columnType.ScanType(); scanType != nil {
+		column.ScanType = scanType.String()
+	}
+	if nullable, ok := columnType.Nullable(); ok {
+		column.Nullable = &nullable
+	}
+	// Unbounded types report the maximum int64 as length
+	if length, ok := columnType.Length(); ok && length < 1<<31 {
+		column.Length = length
+	}
+	if precision, scale, ok := columnType.DecimalSize(); ok {
+		column.Precision = precision
+		column.Scale = scale
+	}
+	column.Type = logicalType(column.DatabaseType, columnType.ScanType())
+	if column.Type == TypeDecimal && column.Precision > 0 && column.Scale == 0 && column.Precision < 19 {
+		column.Type = TypeInteger
+	}
+	return column
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	nullTime    = reflect.TypeOf(sql.NullTime{})
+	nullInt64   = reflect.TypeOf(sql.NullInt64{})
+	nullInt32   = reflect.TypeOf(sql.NullInt32{})
+	nullFloat64 = reflect.TypeOf(sql.NullFloat64{})
+	nullBool    = reflect.TypeOf(sql.NullBool{})
+)
+
+// logicalType derives the logical type from the scan type, falling back
+// to the database type name for drivers scanning everything as bytes.
+func logicalType(databaseType string, scanType reflect.Type) string {
+	databaseType = strings.ToUpper(databaseType)
+
+	if scanType != nil {
+		switch scanType {
+		case timeType, nullTime:
+			switch databaseType {
+			case "DATE":
+				return TypeDate
+			case "TIME":
+				return TypeTime
+			}
+			return TypeTimestamp
+		case nullInt64, nullInt32:
+			return TypeInteger
+		case nullFloat64:
+			return floatType(databaseType)
+		case nullBool:
+			return TypeBoolean
+		}
+		switch scanType.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return TypeInteger
+		case reflect.Float32, reflect.Float64:
+			return floatType(databaseType)
+		case reflect.Bool:
+			return TypeBoolean
+		}
+	}
+
+	switch {
+	case databaseType == "DATE":
+		return TypeDate
+	case databaseType == "TIME" || strings.HasPrefix(databaseType, "TIME "):
+		return TypeTime
+	case strings.Contains(databaseType, "TIMESTAMP") || strings.Contains(databaseType, "DATETIME"):
+		return TypeTimestamp
+	case strings.Contains(databaseType, "INT") && !strings.Contains(databaseType, "INTERVAL"):
+		return TypeInteger
+	case strings.Contains(databaseType, "DEC") || strings.Contains(databaseType, "NUMERIC") || strings.Contains(databaseType, "MONEY"):
+		return TypeDecimal
+	case strings.Contains(databaseType, "FLOAT") || strings.Contains(databaseType, "DOUBLE") || databaseType == "REAL":
+		return TypeFloat
+	case strings.HasPrefix(databaseType, "BOOL") || databaseType == "BIT":
+		return TypeBoolean
+	case strings.Contains(databaseType, "BLOB") || strings.Contains(databaseType, "BINARY") || databaseType == "BYTEA" || databaseType == "IMAGE":
+		return TypeBinary
+	}
+	return TypeString
+}
+
+// floatType tells decimals, which some drivers scan as floats, from floats.
+func floatType(databaseType string) string {
+	if strings.Contains(databaseType, "DEC") || strings.Contains(databaseType, "NUMERIC") {
+		return TypeDecimal
+	}
+	return TypeFloat
+}
+
+// Render returns the schema in the given format.
+// table is the table name of the DDL statements, or the file name of the data for CSVW.
+func (s *Schema) Render(format SchemaFormat, table string) ([]byte, error) {
+	switch format {
+	case JSONSchema:
+		return s.jsonSchema(table)
+	case CSVW:
+		return s.csvw(table)
+	case BigQueryDDL:
+		return s.ddl(table, "`", bigQueryType), nil
+	case RedshiftDDL:
+		return s.ddl(table, `"`, redshiftType), nil
+	case SnowflakeDDL:
+		return s.ddl(table, `"`, snowflakeType), nil
+	}
+	return nil, fmt.Errorf("Unknown schema format: %v", format)
+}
+
+func (s *Schema) jsonSchema(title string) ([]byte, error) {
+	type property struct {
+		Type         interface{} `json:"type"`
+		Format       string      `json:"format,omitempty"`
+		MaxLength    int64       `json:"maxLength,omitempty"`
+		DatabaseType string      `json:"x-databaseType,omitempty"`
+	}
+
+	properties := make(map[string]property, len(s.Columns))
+	required := []string{}
+	for _, column := range s.Columns {
+		p := property{DatabaseType: column.DatabaseType}
+		switch column.Type {
+		case TypeInteger:
+			p.Type = "integer"
+		case TypeDecimal, TypeFloat:
+			p.Type = "number"
+		case TypeBoolean:
+			p.Type = "boolean"
+		case TypeDate:
+			p.Type, p.Format = "string", "date"
+		case TypeTime:
+			p.Type, p.Format = "string", "time"
+		case TypeTimestamp:
+			p.Type, p.Format = "string", "date-time"
+		default:
+			p.Type = "string"
+			if column.Type == TypeString {
+				p.MaxLength = column.Length
+			}
+		}
+
+		if column.Nullable != nil && !*column.Nullable {
+			required = append(required, column.Name)
+		} else {
+			p.Type = []interface{}{p.Type, "null"}
+		}
+		properties[column.Name] = p
+	}
+
+	return json.MarshalIndent(map[string]interface{}{
+		"$schema":    "http://json-schema.org/draft-07/schema#",
+		"title":      title,
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}, "", "  ")
+}
+
+func (s *Schema) csvw(url string) ([]byte, error) {
+	type datatype struct {
+		Base      string `json:"base"`
+		MaxLength int64  `json:"maxLength,omitempty"`
+	}
+	type column struct {
+		Name     string   `json:"name"`
+		Titles   string   `json:"titles"`
+		Datatype datatype `json:"datatype"`
+		Required bool     `json:"required,omitempty"`
+	}
+
+	columns := make([]column, 0, len(s.Columns))
+	for _, c := range s.Columns {
+		d := datatype{Base: "string"}
+		switch c.Type {
+		case TypeInteger, TypeDecimal, TypeBoolean, TypeDate, TypeTime:
+			d.Base = c.Type
+		case TypeFloat:
+			d.Base = "double"
+		case TypeTimestamp:
+			d.Base = "datetime"
+		case TypeString:
+			d.MaxLength = c.Length
+		}
+		columns = append(columns, column{
+			Name:     c.Name,
+			Titles:   c.Name,
+			Datatype: d,
+			Required: c.Nullable != nil && !*c.Nullable,
+		})
+	}
+
+	delimiter := s.Delimiter
+	if delimiter == 0 {
+		delimiter = ','
+	}
+	dialect := map[string]interface{}{
+		"delimiter": string(delimiter),
+		"header":    s.Header,
+	}
+	if s.Quoting == QuoteNone {
+		dialect["quoteChar"] = nil
+	} else if s.QuoteChar != 0 {
+		dialect["quoteChar"] = string(s.QuoteChar)
+	}
+	// CSVW only knows backslash escapes
+	if s.EscapeChar != 0 || s.Quoting == QuoteNone {
+		dialect["doubleQuote"] = false
+	}
+	if s.EscapeChar != 0 && s.EscapeChar != '\\' {
+		dialect["x-escapeChar"] = string(s.EscapeChar)
+	}
+	if s.RecordTerminator != "" {
+		dialect["lineTerminators"] = []string{s.RecordTerminator}
+	}
+	if s.Encoding != "" {
+		dialect["encoding"] = s.Encoding
+	}
+	return json.MarshalIndent(map[string]interface{}{
+		"@context": "http://www.w3.org/ns/csvw",
+		"url":      url,
+		"dialect":  dialect,
+		"tableSchema": map[string]interface{}{
+			"columns": columns,
+			"null":    s.NullString,
+		},
+	}, "", "  ")
+}
+
+func (s *Schema) ddl(table, quote string, columnType func(ColumnSchema) string) []byte {
+	var ddl strings.Builder
+	ddl.WriteString("CREATE TABLE " + quoteIdentifier(table, quote) + " (\n")
+	for i, column := range s.Columns {
+		ddl.WriteString("    " + quoteIdentifier(column.Name, quote) + " " + columnType(column))
+		if column.Nullable != nil && !*column.Nullable {
+			ddl.WriteString(" NOT NULL")
+		}
+		if i < len(s.Columns)-1 {
+			ddl.WriteString(",")
+		}
+		ddl.WriteString("\n")
+	}
+	ddl.WriteString(");\n")
+	return []byte(ddl.String())
+}
+
+// quoteIdentifier quotes every part of a dotted identifier.
+func quoteIdentifier(identifier, quote string) string {
+	parts := strings.Split(identifier, ".")
+	for i, part := range parts {
+		parts[i] = quote + strings.Replace(part, quote, quote+quote, -1) + quote
+	}
+	return strings.Join(parts, ".")
+}
+
+func bigQueryType(column ColumnSchema) string {
+	switch column.Type {
+	case TypeInteger:
+		return "INT64"
+	case TypeDecimal:
+		if column.Precision > 0 && (column.Precision-column.Scale > 29 || column.Scale > 9) {
+			return "BIGNUMERIC"
+		}
+		return "NUMERIC"
+	case TypeFloat:
+		return "FLOAT64"
+	case TypeBoolean:
+		return "BOOL"
+	case TypeDate:
+		return "DATE"
+	case TypeTime:
+		return "TIME"
+	case TypeTimestamp:
+		return "TIMESTAMP"
+	case TypeBinary:
+		return "BYTES"
+	}
+	return "STRING"
+}
+
+func redshiftType(column ColumnSchema) string {
+	switch column.Type {
+	case TypeInteger:
+		return "BIGINT"
+	case TypeDecimal:
+		if column.Precision > 0 && column.Precision <= 38 {
+			return fmt.Sprintf("DECIMAL(%v,%v)", column.Precision, column.Scale)
+		}
+		return "DECIMAL(38,10)"
+	case TypeFloat:
+		return "DOUBLE PRECISION"
+	case TypeBoolean:
+		return "BOOLEAN"
+	case TypeDate:
+		return "DATE"
+	case TypeTime:
+		return "TIME"
+	case TypeTimestamp:
+		return "TIMESTAMP"
+	}
+	// Redshift lengths are in bytes, allow for multibyte characters
+	if column.Length > 0 && column.Length*4 <= 65535 {
+		return fmt.Sprintf("VARCHAR(%v)", column.Length*4)
+	}
+	return "VARCHAR(MAX)"
+}
+
+func snowflakeType(column ColumnSchema) string {
+	switch column.Type {
+	case TypeInteger:
+		return "NUMBER(38,0)"
+	case TypeDecimal:
+		if column.Precision > 0 && column.Precision <= 38 {
+			return fmt.Sprintf("NUMBER(%v,%v)", column.Precision, column.Scale)
+		}
+		return "NUMBER"
+	case TypeFloat:
+		return "FLOAT"
+	case TypeBoolean:
+		return "BOOLEAN"
+	case TypeDate:
+		return "DATE"
+	case TypeTime:
+		return "TIME"
+	case TypeTimestamp:
+		return "TIMESTAMP_NTZ"
+	case TypeBinary:
+		return "BINARY"
+	}
+	if column.Length > 0 {
+		return fmt.Sprintf("VARCHAR(%v)", column.Length)
+	}
+	return "VARCHAR"
+}
+
+// schemaTable returns the table name of the DDL sidecar:
+// SchemaTable if set, the file name without extensions otherwise.
+func (c *Converter) schemaTable(fileName string) string {
+	if c.SchemaTable != "" {
+		return c.SchemaTable
+	}
+	table := path.Base(strings.Replace(fileName, "\\", "/", -1))
+	if i := strings.Index(table, "."); i > 0 {
+		table = table[:i]
+	}
+	return table
+}
+
+// renderSchema renders the schema sidecar of the output fileName.
+func (c *Converter) renderSchema(fileName string) ([]byte, error) {
+	if c.result.Schema == nil {
+		return nil, fmt.Errorf("No schema, SchemaFormat is not set")
+	}
+	name := c.schemaTable(fileName)
+	if c.SchemaFormat == CSVW {
+		// Relative to the metadata document
+		name = path.Base(strings.Replace(fileName, "\\", "/", -1))
+	}
+	return c.result.Schema.Render(c.SchemaFormat, name)
+}
+
+// writeSchemaFile writes the schema sidecar next to fileName.
+func (c *Converter) writeSchemaFile(fileName string) error {
+	content, err := c.renderSchema(fileName)
+	if err != nil {
+		return err
+	}
+
+	schemaFileName := fileName + c.SchemaFormat.Extension()
+	f, err := createTempFile(schemaFileName, c.FileMode)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = commitTempFile(f.Name(), schemaFileName, c.NoOverwrite)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// uploadSchema uploads the schema sidecar next to the uploaded object.
+// Only AWS S3 is supported: other sinks are bound to a single object,
+// upload ExportResult.Schema yourself.
+func (c *Converter) uploadSchema(sink Sink) error {
+	if _, ok := sink.(*s3Sink); !ok {
+		c.writeLog(Warn, "Schema sidecars are only uploaded to AWS S3. See ExportResult.Schema.")
+		return nil
+	}
+
+	content, err := c.renderSchema(c.S3Path)
+	if err != nil {
+		return err
+	}
+	_, err = c.putS3Object(c.S3Path+c.SchemaFormat.Extension(), content, c.SchemaFormat.ContentType())
+	return err
+}
+
+// ReadSchemaFile reads a JSON Schema or CSVW schema sidecar, e.g. to
+// validate rows with a Reader.
+func ReadSchemaFile(fileName string) (*Schema, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSchema(content)
+}
+
+// ParseSchema parses a JSON Schema or CSVW schema sidecar.
+// DDL sidecars are not supported. JSON Schema does not keep the order of
+// the columns, they are sorted by name.
+func ParseSchema(content []byte) (*Schema, error) {
+	var document struct {
+		Context    string `json:"@context"`
+		Properties map[string]struct {
+			Type         interface{} `json:"type"`
+			Format       string      `json:"format"`
+			MaxLength    int64       `json:"maxLength"`
+			DatabaseType string      `json:"x-databaseType"`
+		} `json:"properties"`
+		Required []string `json:"required"`
+		Dialect  struct {
+			Delimiter       string          `json:"delimiter"`
+			Header          *bool           `json:"header"`
+			QuoteChar       json.RawMessage `json:"quoteChar"`
+			DoubleQuote     *bool           `json:"doubleQuote"`
+			EscapeChar      string          `json:"x-escapeChar"`
+			LineTerminators interface{}     `json:"lineTerminators"`
+			Encoding        string          `json:"encoding"`
+		} `json:"dialect"`
+		TableSchema struct {
+			Columns []struct {
+				Name     string `json:"name"`
+				Datatype struct {
+					Base      string `json:"base"`
+					MaxLength int64  `json:"maxLength"`
+				} `json:"datatype"`
+				Required bool `json:"required"`
+			} `json:"columns"`
+			Null string `json:"null"`
+		} `json:"tableSchema"`
+	}
+	err := json.Unmarshal(content, &document)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse schema: %v", err)
+	}
+
+	notNull := false
+	schema := &Schema{Header: true}
+	if document.Context != "" {
+		// CSVW
+		if document.Dialect.Delimiter != "" {
+			schema.Delimiter, _ = utf8.DecodeRuneInString(document.Dialect.Delimiter)
+		}
+		if document.Dialect.Header != nil {
+			schema.Header = *document.Dialect.Header
+		}
+		err = schema.parseCSVWDialect(document.Dialect.QuoteChar, document.Dialect.DoubleQuote,
+			document.Dialect.EscapeChar, document.Dialect.LineTerminators)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(document.Dialect.Encoding, "utf-8") {
+			schema.Encoding = document.Dialect.Encoding
+		}
+		schema.NullString = document.TableSchema.Null
+		for _, c := range document.TableSchema.Columns {
+			column := ColumnSchema{Name: c.Name, Type: c.Datatype.Base}
+			switch c.Datatype.Base {
+			case "double":
+				column.Type = TypeFloat
+			case "datetime":
+				column.Type = TypeTimestamp
+			case TypeString:
+				column.Length = c.Datatype.MaxLength
+			}
+			if c.Required {
+				column.Nullable = &notNull
+			}
+			schema.Columns = append(schema.Columns, column)
+		}
+		return schema, nil
+	}
+
+	if document.Properties == nil {
+		return nil, fmt.Errorf("Unknown schema format, expected JSON Schema or CSVW")
+	}
+	required := make(map[string]bool, len(document.Required))
+	for _, name := range document.Required {
+		required[name] = true
+	}
+	for name, p := range document.Properties {
+		// Nullable columns have a ["type", "null"] type
+		jsonType, _ := p.Type.(string)
+		if types, ok := p.Type.([]interface{}); ok && len(types) > 0 {
+			jsonType, _ = types[0].(string)
+		}
+
+		column := ColumnSchema{Name: name, DatabaseType: p.DatabaseType, Type: TypeString}
+		switch jsonType {
+		case "integer":
+			column.Type = TypeInteger
+		case "number":
+			column.Type = floatType(strings.ToUpper(p.DatabaseType))
+		case "boolean":
+			column.Type = TypeBoolean
+		case "string":
+			switch p.Format {
+			case "date":
+				column.Type = TypeDate
+			case "time":
+				column.Type = TypeTime
+			case "date-time":
+				column.Type = TypeTimestamp
+			}
+			column.Length = p.MaxLength
+		}
+		if required[name] {
+			column.Nullable = &notNull
+		}
+		schema.Columns = append(schema.Columns, column)
+	}
+	sort.Slice(schema.Columns, func(i, j int) bool {
+		return schema.Columns[i].Name < schema.Columns[j].Name
+	})
+	return schema, nil
+}
+
+// parseCSVWDialect sets the quoting, escaping and record terminator of a CSVW dialect.
+func (s *Schema) parseCSVWDialect(quoteChar json.RawMessage, doubleQuote *bool, escapeChar string, lineTerminators interface{}) error {
+	if string(quoteChar) == "null" {
+		s.Quoting = QuoteNone
+	} else if len(quoteChar) > 0 {
+		var quote string
+		err := json.Unmarshal(quoteChar, &quote)
+		if err != nil {
+			return fmt.Errorf("Could not parse schema: invalid quoteChar: %v", err)
+		}
+		if quote != `"` {
+			s.QuoteChar, _ = utf8.DecodeRuneInString(quote)
+		}
+	}
+
+	if escapeChar != "" {
+		s.EscapeChar, _ = utf8.DecodeRuneInString(escapeChar)
+	} else if doubleQuote != nil && !*doubleQuote {
+		s.EscapeChar = '\\'
+	}
+
+	switch terminators := lineTerminators.(type) {
+	case string:
+		s.RecordTerminator = terminators
+	case []interface{}:
+		if len(terminators) > 0 {
+			s.RecordTerminator, _ = terminators[0].(string)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,348 @@
+package sqltocsvgzip
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTypedRows returns the rows of an orders table with a column of every fakedb type.
+func newTypedRows(t *testing.T) *sql.Rows {
+	t.Helper()
+	db, err := sql.Open("test", "typed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, db, "WIPE")
+	exec(t, db, "CREATE|orders|name=string,qty=int32,amount=float64,created=datetime,paid=bool,data=blob")
+	exec(t, db, "INSERT|orders|name=?,qty=?,amount=?,created=?,paid=?,data=?",
+		"alice", 2, 9.5, time.Date(2021, 10, 4, 10, 30, 0, 0, time.UTC), true, []byte("x"))
+	rows, err := db.Query("SELECT|orders|name,qty,amount,created,paid,data|")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func schemaTypes(schema *Schema) []string {
+	types := make([]string, len(schema.Columns))
+	for i, column := range schema.Columns {
+		types[i] = column.Name + ":" + column.Type
+	}
+	return types
+}
+
+func TestSchemaColumnTypes(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(c *Converter)
+		expected []string
+	}{
+		{
+			name:     "Query columns",
+			setup:    func(c *Converter) {},
+			expected: []string{"name:string", "qty:integer", "amount:float", "created:timestamp", "paid:boolean", "data:binary"},
+		},
+		{
+			name:     "Formatted columns are strings",
+			setup:    func(c *Converter) { c.SetColumnFormatter("amount", FormatDecimal(2)) },
+			expected: []string{"name:string", "qty:integer", "amount:string", "created:timestamp", "paid:boolean", "data:binary"},
+		},
+		{
+			name:     "Pipeline columns are matched by name",
+			setup:    func(c *Converter) { c.SetPipeline(NewPipeline(Select("qty", "name"), Constant("source", "crm"))) },
+			expected: []string{"qty:integer", "name:string", "source:string"},
+		},
+	}
+	for _, test := range tests {
+		c := WriteConfig(newTypedRows(t))
+		c.LogLevel = Error
+		c.SchemaFormat = JSONSchema
+		test.setup(c)
+		result, err := c.WriteFile(filepath.Join(t.TempDir(), "orders.csv.gz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := schemaTypes(result.Schema); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%v: got %v, expected %v", test.name, got, test.expected)
+		}
+	}
+}
+
+func TestLogicalType(t *testing.T) {
+	tests := []struct {
+		databaseType string
+		scanType     reflect.Type
+		expected     string
+	}{
+		{"VARCHAR", nil, TypeString},
+		{"BIGINT", nil, TypeInteger},
+		{"INTERVAL", nil, TypeString},
+		{"NUMERIC", nil, TypeDecimal},
+		{"DECIMAL", nullFloat64, TypeDecimal},
+		{"DOUBLE", nullFloat64, TypeFloat},
+		{"REAL", nil, TypeFloat},
+		{"BOOL", nil, TypeBoolean},
+		{"DATE", timeType, TypeDate},
+		{"TIME", nil, TypeTime},
+		{"TIMESTAMPTZ", nullTime, TypeTimestamp},
+		{"DATETIME", nil, TypeTimestamp},
+		{"BYTEA", nil, TypeBinary},
+		{"VARBINARY", nil, TypeBinary},
+		{"", nullInt64, TypeInteger},
+		{"TINYINT", reflect.TypeOf(int8(0)), TypeInteger},
+		{"BIT", reflect.TypeOf(false), TypeBoolean},
+		// Drivers scanning everything as bytes
+		{"INT", reflect.TypeOf([]byte{}), TypeInteger},
+	}
+	for _, test := range tests {
+		if got := logicalType(test.databaseType, test.scanType); got != test.expected {
+			t.Errorf("%v %v: got %v, expected %v", test.databaseType, test.scanType, got, test.expected)
+		}
+	}
+}
+
+// testSchema has a column of every logical type, NOT NULL columns and sizes.
+func testSchema() *Schema {
+	notNull, nullable := false, true
+	return &Schema{
+		Columns: []ColumnSchema{
+			{Name: "id", Type: TypeInteger, Nullable: &notNull},
+			{Name: "name", Type: TypeString, Length: 100, Nullable: &nullable},
+			{Name: "price", DatabaseType: "NUMERIC", Type: TypeDecimal, Precision: 10, Scale: 2},
+			{Name: "ratio", Type: TypeFloat},
+			{Name: "active", Type: TypeBoolean},
+			{Name: "born", Type: TypeDate},
+			{Name: "opens", Type: TypeTime},
+			{Name: "updated", Type: TypeTimestamp},
+			{Name: "photo", Type: TypeBinary},
+		},
+		Delimiter:  ';',
+		Header:     true,
+		NullString: `\N`,
+	}
+}
+
+func TestSchemaDDL(t *testing.T) {
+	tests := []struct {
+		format   SchemaFormat
+		expected string
+	}{
+		{BigQueryDDL, "CREATE TABLE `shop`.`products` (\n" +
+			"    `id` INT64 NOT NULL,\n    `name` STRING,\n    `price` NUMERIC,\n    `ratio` FLOAT64,\n    `active` BOOL,\n" +
+			"    `born` DATE,\n    `opens` TIME,\n    `updated` TIMESTAMP,\n    `photo` BYTES\n);\n"},
+		{RedshiftDDL, "CREATE TABLE \"shop\".\"products\" (\n" +
+			"    \"id\" BIGINT NOT NULL,\n    \"name\" VARCHAR(400),\n    \"price\" DECIMAL(10,2),\n    \"ratio\" DOUBLE PRECISION,\n    \"active\" BOOLEAN,\n" +
+			"    \"born\" DATE,\n    \"opens\" TIME,\n    \"updated\" TIMESTAMP,\n    \"photo\" VARCHAR(MAX)\n);\n"},
+		{SnowflakeDDL, "CREATE TABLE \"shop\".\"products\" (\n" +
+			"    \"id\" NUMBER(38,0) NOT NULL,\n    \"name\" VARCHAR(100),\n    \"price\" NUMBER(10,2),\n    \"ratio\" FLOAT,\n    \"active\" BOOLEAN,\n" +
+			"    \"born\" DATE,\n    \"opens\" TIME,\n    \"updated\" TIMESTAMP_NTZ,\n    \"photo\" BINARY\n);\n"},
+	}
+	for _, test := range tests {
+		ddl, err := testSchema().Render(test.format, "shop.products")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(ddl) != test.expected {
+			t.Errorf("Format %v:\ngot      %q\nexpected %q", test.format, ddl, test.expected)
+		}
+	}
+
+	// Identifiers are quoted
+	ddl, _ := (&Schema{Columns: []ColumnSchema{{Name: "a`b", Type: TypeString}}}).Render(BigQueryDDL, "t")
+	if !strings.Contains(string(ddl), "`a``b` STRING") {
+		t.Errorf("Identifier not quoted: %q", ddl)
+	}
+}
+
+func TestSchemaJSONSchema(t *testing.T) {
+	content, err := testSchema().Render(JSONSchema, "products")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var document struct {
+		Schema     string                            `json:"$schema"`
+		Title      string                            `json:"title"`
+		Properties map[string]map[string]interface{} `json:"properties"`
+		Required   []string                          `json:"required"`
+	}
+	err = json.Unmarshal(content, &document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if document.Title != "products" || !strings.Contains(document.Schema, "draft-07") || !reflect.DeepEqual(document.Required, []string{"id"}) {
+		t.Errorf("Unexpected document: %s", content)
+	}
+	expected := map[string]string{
+		"id":      `{"type":"integer"}`,
+		"name":    `{"maxLength":100,"type":["string","null"]}`,
+		"price":   `{"type":["number","null"],"x-databaseType":"NUMERIC"}`,
+		"active":  `{"type":["boolean","null"]}`,
+		"born":    `{"format":"date","type":["string","null"]}`,
+		"updated": `{"format":"date-time","type":["string","null"]}`,
+		"photo":   `{"type":["string","null"]}`,
+	}
+	for name, property := range expected {
+		b, _ := json.Marshal(document.Properties[name])
+		if string(b) != property {
+			t.Errorf("Property %v is %s, expected %s", name, b, property)
+		}
+	}
+}
+
+func TestSchemaCSVW(t *testing.T) {
+	content, err := testSchema().Render(CSVW, "products.csv.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var document struct {
+		Context string `json:"@context"`
+		URL     string `json:"url"`
+		Dialect struct {
+			Delimiter string `json:"delimiter"`
+			Header    bool   `json:"header"`
+		} `json:"dialect"`
+		TableSchema struct {
+			Columns []struct {
+				Name     string `json:"name"`
+				Datatype struct {
+					Base      string `json:"base"`
+					MaxLength int64  `json:"maxLength"`
+				} `json:"datatype"`
+				Required bool `json:"required"`
+			} `json:"columns"`
+			Null string `json:"null"`
+		} `json:"tableSchema"`
+	}
+	err = json.Unmarshal(content, &document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if document.Context != "http://www.w3.org/ns/csvw" || document.URL != "products.csv.gz" ||
+		document.Dialect.Delimiter != ";" || !document.Dialect.Header || document.TableSchema.Null != `\N` {
+		t.Errorf("Unexpected document: %s", content)
+	}
+	var bases []string
+	for _, column := range document.TableSchema.Columns {
+		bases = append(bases, column.Datatype.Base)
+	}
+	expected := []string{"integer", "string", "decimal", "double", "boolean", "date", "time", "datetime", "string"}
+	if !reflect.DeepEqual(bases, expected) {
+		t.Errorf("Datatypes are %v, expected %v", bases, expected)
+	}
+	if !document.TableSchema.Columns[0].Required || document.TableSchema.Columns[1].Required || document.TableSchema.Columns[1].Datatype.MaxLength != 100 {
+		t.Errorf("Unexpected columns: %s", content)
+	}
+}
+
+func TestParseSchema(t *testing.T) {
+	for _, format := range []SchemaFormat{JSONSchema, CSVW} {
+		content, err := testSchema().Render(format, "products")
+		if err != nil {
+			t.Fatal(err)
+		}
+		schema, err := ParseSchema(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]string{}
+		for _, column := range testSchema().Columns {
+			// Binary columns are strings in both formats
+			typ := column.Type
+			if typ == TypeBinary {
+				typ = TypeString
+			}
+			expected[column.Name] = typ
+		}
+		if len(schema.Columns) != len(expected) {
+			t.Fatalf("Format %v: got %v columns", format, len(schema.Columns))
+		}
+		for _, column := range schema.Columns {
+			if column.Type != expected[column.Name] {
+				t.Errorf("Format %v: column %v is %v, expected %v", format, column.Name, column.Type, expected[column.Name])
+			}
+			if notNull := column.Nullable != nil && !*column.Nullable; notNull != (column.Name == "id") {
+				t.Errorf("Format %v: column %v NOT NULL is %v", format, column.Name, notNull)
+			}
+			if column.Name == "name" && column.Length != 100 {
+				t.Errorf("Format %v: length of name is %v", format, column.Length)
+			}
+		}
+		if format == CSVW && (schema.Delimiter != ';' || schema.NullString != `\N` || !schema.Header) {
+			t.Errorf("Unexpected CSVW dialect: %+v", schema)
+		}
+	}
+
+	_, err := ParseSchema([]byte(`{"type": "object"}`))
+	if err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+func TestWriteFileSchemaSidecar(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "orders.csv.gz")
+	c := WriteConfig(newTypedRows(t))
+	c.LogLevel = Error
+	c.SchemaFormat = CSVW
+	c.Delimiter = '|'
+	c.NullString = "NULL"
+	_, err := c.WriteFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schema, err := ReadSchemaFile(fileName + "-metadata.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema.Delimiter != '|' || schema.NullString != "NULL" || len(schema.Columns) != 6 || schema.Columns[1].Type != TypeInteger {
+		t.Errorf("Unexpected schema: %+v", schema)
+	}
+	content, _ := ioutil.ReadFile(fileName + "-metadata.json")
+	if !strings.Contains(string(content), `"url": "orders.csv.gz"`) {
+		t.Errorf("Expected the url relative to the metadata: %s", content)
+	}
+
+	// An existing sidecar is not replaced with NoOverwrite
+	err = os.Remove(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = WriteConfig(newTypedRows(t))
+	c.LogLevel = Error
+	c.SchemaFormat = CSVW
+	c.NoOverwrite = true
+	_, err = c.WriteFile(fileName)
+	if err == nil {
+		t.Error("Expected an error, the sidecar exists")
+	}
+	after, _ := ioutil.ReadFile(fileName + "-metadata.json")
+	if string(after) != string(content) {
+		t.Errorf("Sidecar was replaced: %s", after)
+	}
+}
+
+func TestUploadSchemaSidecar(t *testing.T) {
+	fake, server := newFakeS3(t)
+	c := newS3Converter(newTypedRows(t), server)
+	c.S3Path = "exports/orders.csv.gz"
+	c.SchemaFormat = BigQueryDDL
+	c.SchemaTable = "shop.orders"
+
+	_, err := c.Upload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ddl := string(fake.objects["/exports/exports/orders.csv.gz.sql"])
+	if !strings.HasPrefix(ddl, "CREATE TABLE `shop`.`orders` (\n    `name` STRING,\n    `qty` INT64,") {
+		t.Errorf("Unexpected sidecar: %q", ddl)
+	}
+}
@@ -0,0 +1,196 @@
+package sqltocsvgzip
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPConfig describes the remote file written by UploadSFTP.
+type SFTPConfig struct {
+	Addr           string              // host:port, e.g. sftp.example.com:22
+	User           string              // SSH user
+	PrivateKey     []byte              // PEM encoded private key
+	Passphrase     []byte              // Passphrase of PrivateKey, if any
+	KnownHostsFile string              // known_hosts file used to verify the server host key
+	HostKey        ssh.HostKeyCallback // Overrides KnownHostsFile if set
+	Path           string              // Remote file path
+	Timeout        time.Duration       // Dial timeout (default is 30 seconds)
+}
+
+// UploadSFTP streams the csv.gzip to a remote path over SFTP.
+// Like Upload, it needs no local storage.
+//
+// The output is written to a temporary file next to Path, which is renamed
+// to Path once complete, so that partners never pick up a partial file.
+// Connecting and renaming are retried; the stream itself can't be replayed.
+func (c *Converter) UploadSFTP(config *SFTPConfig) (*ExportResult, error) {
+	c.startTimer()
+
+	// Explicitely unset s3 upload
+	c.S3Upload = false
+
+	clientConfig, err := config.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var sshClient *ssh.Client
+	err = retry("Connect to "+config.Addr, func() error {
+		sshClient, err = ssh.Dial("tcp", config.Addr, clientConfig)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer sshClient.Close()
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	tmpPath, err := sftpTempPath(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := client.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.Write(f)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = retry("Rename "+tmpPath, func() error {
+			return sftpRename(client, tmpPath, config.Path)
+		})
+	}
+	if err != nil {
+		removeErr := client.Remove(tmpPath)
+		if removeErr != nil {
+			c.writeLog(Warn, fmt.Sprintf("Could not remove %v: %v", tmpPath, removeErr))
+		}
+		return nil, err
+	}
+
+	if c.SchemaFormat != NoSchema {
+		err = c.uploadSFTPSchema(client, config.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	location := fmt.Sprintf("sftp://%v@%v%v", config.User, config.Addr, config.Path)
+	c.writeLog(Info, "Successfully uploaded file: "+location)
+
+	c.result.FileName = config.Path
+	c.result.Location = location
+	c.stopTimer()
+	return c.Result(), nil
+}
+
+func (config *SFTPConfig) clientConfig() (*ssh.ClientConfig, error) {
+	hostKey := config.HostKey
+	if hostKey == nil {
+		if config.KnownHostsFile == "" {
+			return nil, fmt.Errorf("KnownHostsFile or HostKey is needed to verify the SFTP server")
+		}
+		var err error
+		hostKey, err = knownhosts.New(config.KnownHostsFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var signer ssh.Signer
+	var err error
+	if len(config.Passphrase) > 0 {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(config.PrivateKey, config.Passphrase)
+	} else {
+		signer, err = ssh.ParsePrivateKey(config.PrivateKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid PrivateKey: %v", err)
+	}
+
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	return &ssh.ClientConfig{
+		User:            config.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKey,
+		Timeout:         timeout,
+	}, nil
+}
+
+// sftpTempPath returns a hidden, unique file name in the directory of remotePath.
+func sftpTempPath(remotePath string) (string, error) {
+	suffix := make([]byte, 8)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return "", err
+	}
+	dir, file := path.Split(remotePath)
+	return fmt.Sprintf("%v.%v.%v.tmp", dir, file, hex.EncodeToString(suffix)), nil
+}
+
+// sftpRename replaces newPath with oldPath. The posix-rename extension
+// overwrites newPath atomically; plain SFTP rename fails if newPath exists.
+func sftpRename(client *sftp.Client, oldPath, newPath string) error {
+	err := client.PosixRename(oldPath, newPath)
+	if err == nil {
+		return nil
+	}
+	_, statErr := client.Stat(newPath)
+	if statErr == nil {
+		return err
+	}
+	return client.Rename(oldPath, newPath)
+}
+
+// uploadSFTPSchema writes the schema sidecar next to remotePath.
+func (c *Converter) uploadSFTPSchema(client *sftp.Client, remotePath string) error {
+	content, err := c.renderSchema(remotePath)
+	if err != nil {
+		return err
+	}
+
+	schemaPath := remotePath + c.SchemaFormat.Extension()
+	tmpPath, err := sftpTempPath(schemaPath)
+	if err != nil {
+		return err
+	}
+	f, err := client.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = retry("Rename "+tmpPath, func() error {
+			return sftpRename(client, tmpPath, schemaPath)
+		})
+	}
+	if err != nil {
+		client.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package sqltocsvgzip
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// newSFTPServer starts an in-process SSH server with the sftp subsystem
+// serving the local file system, and returns its address and host key.
+func newSFTPServer(t *testing.T, clientKey ssh.PublicKey) (string, ssh.PublicKey) {
+	hostKey := newTestSigner(t)
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "partner" && string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config)
+		}
+	}()
+	return listener.Addr().String(), hostKey.PublicKey()
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range channelRequests {
+				// Payload is the length prefixed subsystem name
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					server, err := sftp.NewServer(channel)
+					if err == nil {
+						server.Serve()
+					}
+					channel.Close()
+				}
+			}
+		}()
+	}
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func newTestPrivateKey(t *testing.T) ([]byte, ssh.PublicKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), publicKey
+}
+
+func TestUploadSFTP(t *testing.T) {
+	privateKey, publicKey := newTestPrivateKey(t)
+	addr, hostKey := newSFTPServer(t, publicKey)
+	dir := t.TempDir()
+
+	config := &SFTPConfig{
+		Addr:       addr,
+		User:       "partner",
+		PrivateKey: privateKey,
+		HostKey:    ssh.FixedHostKey(hostKey),
+		Path:       filepath.ToSlash(filepath.Join(dir, "people.csv.gz")),
+	}
+
+	// The second upload replaces the existing file
+	for _, names := range [][]string{{"alice"}, {"alice", "bob"}} {
+		c := WriteConfig(testRows(t, "people", names...))
+		c.LogLevel = Error
+		result, err := c.UploadSFTP(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(result.Location, "sftp://partner@"+addr) {
+			t.Errorf("Unexpected location %v", result.Location)
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(dir, "people.csv.gz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "name\n" + strings.Join(names, "\n") + "\n"
+		if got := gunzipString(t, b); got != expected {
+			t.Fatalf("Remote file is %q, expected %q", got, expected)
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("Expected only people.csv.gz, found %v files", len(files))
+	}
+}
+
+func TestUploadSFTPHostKeyMismatch(t *testing.T) {
+	privateKey, publicKey := newTestPrivateKey(t)
+	addr, _ := newSFTPServer(t, publicKey)
+	dir := t.TempDir()
+
+	c := WriteConfig(testRows(t, "people", "alice"))
+	c.LogLevel = Error
+	_, err := c.UploadSFTP(&SFTPConfig{
+		Addr:       addr,
+		User:       "partner",
+		PrivateKey: privateKey,
+		HostKey:    ssh.FixedHostKey(newTestSigner(t).PublicKey()),
+		Path:       filepath.ToSlash(filepath.Join(dir, "people.csv.gz")),
+	})
+	if err == nil || !strings.Contains(err.Error(), "host key mismatch") {
+		t.Fatalf("Expected a host key mismatch, got %v", err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("Expected no remote file, found %v", len(files))
+	}
+}
@@ -0,0 +1,106 @@
+package sqltocsvgzip
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Sink is an object storage backend for Upload.
+// The compressed output is split into parts which are queued in order
+// and uploaded concurrently by UploadThreads goroutines.
+type Sink interface {
+	// Create starts a new multipart upload.
+	Create(contentType string) error
+	// UploadPart uploads a single part. Part numbers start at 1.
+	UploadPart(partNumber int64, buf []byte, checksum PartChecksum) error
+	// Complete assembles the uploaded parts into the final object.
+	Complete() (*UploadOutput, error)
+	// Abort cancels the multipart upload and discards the uploaded parts.
+	Abort() error
+	// PutObject uploads outputs smaller than a single part in one request.
+	// It is called after Abort.
+	PutObject(buf []byte, contentType string) (*UploadOutput, error)
+}
+
+// UploadOutput describes the object written by a Sink.
+type UploadOutput struct {
+	Bucket    string
+	Key       string
+	Location  string
+	ETag      string
+	VersionID string
+}
+
+// SetSink lets you upload to another object storage than AWS S3.
+// By default Upload uses AWS S3, configured by the S3 fields of the Converter.
+func (c *Converter) SetSink(sink Sink) {
+	c.sink = sink
+}
+
+// getSink returns the Sink to upload to.
+func (c *Converter) getSink() Sink {
+	if c.sink == nil {
+		c.sink = &s3Sink{c: c}
+	}
+	return c.sink
+}
+
+// s3Sink uploads to AWS S3 using the S3 settings of the Converter.
+type s3Sink struct {
+	c *Converter
+}
+
+func (s *s3Sink) Create(contentType string) error {
+	err := s.c.createS3Session()
+	if err != nil {
+		return err
+	}
+	return s.c.createMultipartRequest()
+}
+
+func (s *s3Sink) UploadPart(partNumber int64, buf []byte, checksum PartChecksum) error {
+	return s.c.uploadPart(partNumber, buf, checksum)
+}
+
+func (s *s3Sink) Complete() (*UploadOutput, error) {
+	return s.c.completeS3Upload()
+}
+
+func (s *s3Sink) Abort() error {
+	if s.c.s3Resp == nil {
+		return nil
+	}
+	return s.c.abortMultipartUpload()
+}
+
+func (s *s3Sink) PutObject(buf []byte, contentType string) (*UploadOutput, error) {
+	return s.c.putS3Object(s.c.S3Path, buf, contentType)
+}
+
+// retry calls fn until it succeeds, at most maxRetries times.
+func retry(name string, fn func() error) (err error) {
+	for tryNum := 1; tryNum <= maxRetries; tryNum++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		time.Sleep(time.Duration(tryNum) * 100 * time.Millisecond)
+	}
+	return fmt.Errorf("%v failed after %v tries: %v", name, maxRetries, err)
+}
+
+// httpError returns an error if resp does not have one of the expected status codes.
+// The response body is closed if an error is returned.
+func httpError(resp *http.Response, expected ...int) error {
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+	return fmt.Errorf("Unexpected response %v: %s", resp.Status, body)
+}
@@ -0,0 +1,142 @@
+package sqltocsvgzip
+
+import (
+	"compress/flate"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memorySink keeps the uploaded parts in memory. Uploads of failPart fail.
+type memorySink struct {
+	mu        sync.Mutex
+	parts     map[int64][]byte
+	object    []byte
+	failPart  int64
+	completed int
+	aborted   int
+}
+
+func (m *memorySink) Create(contentType string) error {
+	m.parts = map[int64][]byte{}
+	return nil
+}
+
+func (m *memorySink) UploadPart(partNumber int64, buf []byte, checksum PartChecksum) error {
+	if partNumber == m.failPart {
+		return fmt.Errorf("part #%v failed", partNumber)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.parts[partNumber] = append([]byte(nil), buf...)
+	return nil
+}
+
+func (m *memorySink) Complete() (*UploadOutput, error) {
+	m.completed++
+	partNumbers := make([]int64, 0, len(m.parts))
+	for partNumber := range m.parts {
+		partNumbers = append(partNumbers, partNumber)
+	}
+	sort.Slice(partNumbers, func(i, j int) bool { return partNumbers[i] < partNumbers[j] })
+	for _, partNumber := range partNumbers {
+		m.object = append(m.object, m.parts[partNumber]...)
+	}
+	return &UploadOutput{Key: "memory"}, nil
+}
+
+func (m *memorySink) Abort() error {
+	m.aborted++
+	return nil
+}
+
+func (m *memorySink) PutObject(buf []byte, contentType string) (*UploadOutput, error) {
+	m.object = buf
+	return &UploadOutput{Key: "memory"}, nil
+}
+
+func TestUploadPartFailure(t *testing.T) {
+	for _, test := range []struct {
+		threads  int
+		failPart int64
+	}{
+		{4, 1},
+		{4, 2},
+		// A single worker keeps draining the queue after its error
+		{1, 1},
+	} {
+		sink := &memorySink{failPart: test.failPart}
+		c := UploadConfig(largeRows(t, "people", 21))
+		c.LogLevel = Error
+		c.CompressionLevel = flate.NoCompression
+		c.UploadPartSize = minFileSize
+		c.UploadThreads = test.threads
+		c.SetSink(sink)
+
+		_, err := c.Upload()
+		expected := fmt.Sprintf("part #%v failed", test.failPart)
+		if err == nil || err.Error() != expected {
+			t.Errorf("%+v: expected %q, got %v", test, expected, err)
+		}
+		if sink.completed != 0 || sink.aborted != 1 || sink.object != nil {
+			t.Errorf("%+v: expected the upload to be aborted, not completed: %v completed, %v aborted", test, sink.completed, sink.aborted)
+		}
+	}
+}
+
+func TestUploadS3PartFailure(t *testing.T) {
+	fake, server := newFakeS3(t)
+	fake.failPart = 2
+	c := newS3Converter(largeRows(t, "people", 11), server)
+	c.CompressionLevel = flate.NoCompression
+	c.UploadPartSize = minFileSize
+
+	_, err := c.Upload()
+	if err == nil || !strings.Contains(err.Error(), "BadDigest") {
+		t.Fatalf("Expected BadDigest, got %v", err)
+	}
+	if len(fake.objects) != 0 || fake.aborted != 1 || len(fake.uploads) != 0 {
+		t.Errorf("Expected the upload to be aborted, requests: %v", fake.requests)
+	}
+	for _, request := range fake.requests {
+		if request == "CompleteMultipartUpload" {
+			t.Errorf("The upload was completed")
+		}
+	}
+}
+
+func TestAzureBlobSinkMissingBlock(t *testing.T) {
+	fake, server := newFakeAzure(t)
+	sink := NewAzureBlobSink(testAzureAccount, testAzureKey, "exports", "out.csv.gz")
+	sink.Endpoint = server.URL + "/" + testAzureAccount
+
+	err := sink.Create("application/x-gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, partNumber := range []int64{1, 3} {
+		err = sink.UploadPart(partNumber, []byte("part"), NewPartChecksum([]byte("part")))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = sink.Complete()
+	if err == nil || !strings.Contains(err.Error(), "part #2 is missing") {
+		t.Errorf("Expected a missing block, got %v", err)
+	}
+	if len(fake.blobs) != 0 {
+		t.Errorf("Block list was committed")
+	}
+
+	// No block at all
+	err = sink.Create("application/x-gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sink.Complete()
+	if err == nil || len(fake.blobs) != 0 {
+		t.Errorf("Expected an error without blocks, got %v", err)
+	}
+}
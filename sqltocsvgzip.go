@@ -6,11 +6,12 @@ package sqltocsvgzip
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
-	"net/url"
 	"os"
 	"os/signal"
 	"sync"
@@ -19,7 +20,7 @@ import (
 
 // WriteFile will write a CSV.GZIP file to the file name specified (with headers)
 // based on whatever is in the sql.Rows you pass in.
-func WriteFile(csvGzipFileName string, rows *sql.Rows) (rowCount int64, err error) {
+func WriteFile(csvGzipFileName string, rows *sql.Rows) (*ExportResult, error) {
 	return WriteConfig(rows).WriteFile(csvGzipFileName)
 }
 
@@ -28,28 +29,30 @@ func WriteFile(csvGzipFileName string, rows *sql.Rows) (rowCount int64, err erro
 // UploadToS3 looks for the following environment variables.
 // Required: S3_BUCKET, S3_PATH, S3_REGION
 // Optional: S3_ACL (default => bucket-owner-full-control)
-func UploadToS3(rows *sql.Rows) (rowCount int64, err error) {
+func UploadToS3(rows *sql.Rows) (*ExportResult, error) {
 	return UploadConfig(rows).Upload()
 }
 
 // Upload uploads the csv.gzip, return an error if problem.
-// Creates a Multipart AWS requests.
+// Creates a Multipart AWS requests (or uses the Sink set with SetSink).
 // Completes the multipart request if all uploads are successful.
 // Aborts the operation when an error is received.
-func (c *Converter) Upload() (rowCount int64, err error) {
-	if c.UploadPartSize < minFileSize {
-		return 0, fmt.Errorf("UploadPartSize should be greater than %v\n", minFileSize)
-	}
+func (c *Converter) Upload() (*ExportResult, error) {
+	return c.upload(nil)
+}
 
-	// Create MultiPart S3 Upload
-	err = c.createS3Session()
-	if err != nil {
-		return 0, err
+// upload uploads the csv.gzip to the sink while also writing it to destinations.
+func (c *Converter) upload(destinations []*Destination) (*ExportResult, error) {
+	if c.UploadPartSize < minFileSize {
+		return nil, fmt.Errorf("UploadPartSize should be greater than %v\n", minFileSize)
 	}
+	c.startTimer()
 
-	err = c.createMultipartRequest()
+	// Create MultiPart Upload
+	sink := c.getSink()
+	err := sink.Create(c.contentType())
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	wg := sync.WaitGroup{}
@@ -57,124 +60,244 @@ func (c *Converter) Upload() (rowCount int64, err error) {
 	c.uploadQ = make(chan *obj, c.UploadThreads)
 	c.quit = make(chan bool, 1)
 
-	// Upload Parts to S3
+	// Upload Parts
+	uploadErrs := make([]error, c.UploadThreads)
 	for i := 0; i < c.UploadThreads; i++ {
 		wg.Add(1)
-		go func() {
+		go func(i int) {
 			defer wg.Done()
-			err = c.UploadPart()
-			if err != nil {
-				c.writeLog(Error, err.Error())
-			}
-		}()
+			uploadErrs[i] = c.UploadPart()
+		}(i)
 	}
 
-	err = c.Write(&buf)
-	if err != nil {
-		// Abort S3 Upload
-		awserr := c.abortMultipartUpload()
-		if awserr != nil {
-			return 0, awserr
-		}
-		return 0, err
+	sinkDestination := &Destination{
+		Name:   "upload",
+		Writer: &partWriter{c: c, buf: &buf},
+		Policy: FailAll,
+	}
+	err = c.Write(newTeeWriter(c, append([]*Destination{sinkDestination}, destinations...)))
+
+	// Upload last part of the file
+	if err == nil && c.partNumber > 0 {
+		// Add to Queue for multipart upload
+		c.AddToQueue(&buf, true)
+
+		//Reset writer
+		buf.Reset()
 	}
 
 	close(c.uploadQ)
 	wg.Wait()
 
+	// A failed part makes Write quit, report why
+	for _, uploadErr := range uploadErrs {
+		if uploadErr != nil {
+			err = uploadErr
+			break
+		}
+	}
+	if err != nil {
+		return nil, c.abort(sink, err)
+	}
+
+	var output *UploadOutput
 	if c.partNumber == 0 {
 		// Upload one time
 		c.writeLog(Info, "Gzip file < 5 MB. Enable direct upload. Abort multipart upload.")
-		err = c.abortMultipartUpload()
+		err = sink.Abort()
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
 
-		err = c.UploadObjectToS3(&buf)
+		output, err = sink.PutObject(buf.Bytes(), c.contentType())
+		if err != nil {
+			return nil, err
+		}
+		c.result.PartCount = 1
+	} else {
+		// Complete upload
+		output, err = sink.Complete()
 		if err != nil {
-			return 0, err
+			return nil, c.abort(sink, err)
 		}
-		return c.RowCount, nil
+		c.result.PartCount = c.partNumber
 	}
+	c.writeLog(Info, "Successfully uploaded file: "+output.Location)
 
-	// Sort completed parts
-	c.sortCompletedParts()
-	// Complete S3 upload
-	completeResponse, err := c.completeMultipartUpload()
-	if err != nil {
-		// Abort S3 Upload
-		awserr := c.abortMultipartUpload()
-		if awserr != nil {
-			return 0, awserr
+	if c.S3Verify {
+		err = c.verifyUpload(sink, output)
+		if err != nil {
+			return nil, err
 		}
-		return 0, err
 	}
 
-	uploadPath, err := url.PathUnescape(completeResponse.String())
-	if err != nil {
-		return 0, err
+	if c.SchemaFormat != NoSchema {
+		err = c.uploadSchema(sink)
+		if err != nil {
+			return nil, err
+		}
 	}
-	c.writeLog(Info, "Successfully uploaded file: "+uploadPath)
 
-	return c.RowCount, nil
+	c.result.Bucket = output.Bucket
+	c.result.Key = output.Key
+	c.result.Location = output.Location
+	c.result.ETag = output.ETag
+	c.result.VersionID = output.VersionID
+	c.stopTimer()
+
+	return c.Result(), nil
+}
+
+// abort aborts the upload to sink after err.
+func (c *Converter) abort(sink Sink, err error) error {
+	abortErr := sink.Abort()
+	if abortErr != nil {
+		return fmt.Errorf("%v. Could not abort the upload: %v", err, abortErr)
+	}
+	return err
 }
 
-// WriteFile writes the csv.gzip to the filename specified, return an error if problem
-func (c *Converter) WriteFile(csvGzipFileName string) (rowCount int64, err error) {
-	f, err := os.Create(csvGzipFileName)
+// WriteFile writes the csv.gzip to the filename specified, return an error if problem.
+// The output goes to a temporary file in the same directory which is renamed
+// to csvGzipFileName on success and removed on failure.
+func (c *Converter) WriteFile(csvGzipFileName string) (*ExportResult, error) {
+	c.startTimer()
+	if c.NoOverwrite {
+		_, err := os.Lstat(csvGzipFileName)
+		if err == nil {
+			return nil, fmt.Errorf("File %v already exists", csvGzipFileName)
+		}
+	}
+
+	f, err := createTempFile(csvGzipFileName, c.FileMode)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	defer f.Close()
 
 	// Explicitely unset s3 upload
 	c.S3Upload = false
 
 	err = c.Write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = commitTempFile(f.Name(), csvGzipFileName, c.NoOverwrite)
+	}
 	if err != nil {
-		return 0, err
+		os.Remove(f.Name())
+		return nil, err
 	}
 
-	return c.RowCount, nil
+	if c.SchemaFormat != NoSchema {
+		err = c.writeSchemaFile(csvGzipFileName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.result.FileName = csvGzipFileName
+	c.stopTimer()
+	return c.Result(), nil
 }
 
-// Write writes the csv.gzip to the Writer provided
+// Write writes the csv.gzip (or the OutputFormat) to the Writer provided
 func (c *Converter) Write(w io.Writer) error {
+	c.startTimer()
 	writeRow := true
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 	defer signal.Stop(interrupt)
 
-	csvWriter, csvBuffer := c.getCSVWriter()
+	// Same size as sqlRowBatch
+	csvBuffer := bytes.NewBuffer(make([]byte, 0, c.CsvBufferSize))
 
 	// Set headers
-	columnNames, totalColumns, err := c.setCSVHeaders(csvWriter)
+	columnNames, totalColumns, err := c.setCSVHeaders()
 	if err != nil {
 		return err
 	}
 
+	c.timeFormat = c.outputTimeFormat()
+	c.timeFormats, err = c.insertTimeFormats()
+	if err != nil {
+		return err
+	}
+
+	// Resolve per-column formatters
+	err = c.setColumnFormatters()
+	if err != nil {
+		return err
+	}
+
+	// Describe the output columns for the schema sidecar and the XLSX, FixedWidth and SQLInsert outputs
+	if c.SchemaFormat != NoSchema || c.OutputFormat != CSV {
+		err = c.setSchema(columnNames)
+		if err != nil {
+			return err
+		}
+	}
+
+	rowWriter, err := c.newRowWriter(csvBuffer)
+	if err != nil {
+		return err
+	}
+	err = c.writeHeaders(rowWriter)
+	if err != nil {
+		return err
+	}
+
+	// Resolve masked columns
+	if c.masker != nil {
+		err = c.masker.bind(columnNames)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Buffers for each iteration
 	values := make([]interface{}, totalColumns, totalColumns)
 	valuePtrs := make([]interface{}, totalColumns, totalColumns)
 
-	for i := range columnNames {
+	for i := range valuePtrs {
 		valuePtrs[i] = &values[i]
 	}
 
-	zw, err := c.getGzipWriter(w)
+	var columnTypes []*sql.ColumnType
+	if c.valuePreProcessor != nil {
+		columnTypes, err = c.rows.ColumnTypes()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Checksum of the whole output
+	fileHash := sha256.New()
+	output := io.MultiWriter(w, fileHash, byteCounter{&c.result.CompressedBytes})
+
+	zw, ew, err := c.getOutputWriters(output)
 	if err != nil {
 		return err
 	}
-	defer zw.Close()
+	defer func() {
+		if zw != nil {
+			zw.Close()
+		}
+	}()
+
+	// Writers splitting the output into several files
+	rotator, _ := w.(rotatingWriter)
+	var fileRows int64
 
 	// Iterate over sql rows
-	for c.rows.Next() {
+	for c.nextRow() {
 		select {
 		case <-c.quit:
-			c.abortMultipartUpload()
 			return fmt.Errorf("Received quit signal. Exiting.")
 		case <-interrupt:
-			c.abortMultipartUpload()
 			return fmt.Errorf("Received quit signal. Exiting.")
 		default:
 			// Do nothing
@@ -184,25 +307,78 @@ func (c *Converter) Write(w io.Writer) error {
 			return err
 		}
 
-		row := c.stringify(values)
+		writeRow = true
+		rowValues := values
+		if c.valuePreProcessor != nil {
+			writeRow, rowValues = c.valuePreProcessor(values, columnTypes)
+			if !writeRow {
+				c.result.SkippedRows++
+				continue
+			}
+		}
+
+		row, nulls := c.stringify(rowValues)
+
+		if c.masker != nil {
+			row = c.masker.mask(row, nulls)
+		}
 
 		if c.rowPreProcessor != nil {
 			writeRow, row = c.rowPreProcessor(row, columnNames)
+			nulls = trackNulls(row, nulls, nil, c.NullString)
+		}
+
+		if writeRow && c.pipeline != nil {
+			writeRow, row, nulls = c.pipeline.process(row, nulls, c.NullString)
+		}
+
+		if !writeRow {
+			c.result.SkippedRows++
 		}
 
 		if writeRow {
-			c.RowCount = c.RowCount + 1
+			if rotator != nil && fileRows > 0 && rotator.full(fileRows) {
+				err = c.finishOutput(rowWriter, zw, ew, csvBuffer)
+				if err != nil {
+					return err
+				}
+				err = rotator.rotate()
+				if err != nil {
+					return err
+				}
+				zw, ew, err = c.getOutputWriters(output)
+				if err != nil {
+					return err
+				}
+				rowWriter, err = c.newRowWriter(csvBuffer)
+				if err != nil {
+					return err
+				}
+				err = c.writeHeaders(rowWriter)
+				if err != nil {
+					return err
+				}
+				fileRows = 0
+			}
 
 			// Write to CSV Buffer
-			err = csvWriter.Write(row)
+			err = rowWriter.writeRow(row, nulls)
+			if err == errSkipRow {
+				c.writeLog(Debug, "Skipping row with invalid UTF-8 or characters OutputEncoding cannot represent")
+				c.result.SkippedRows++
+				continue
+			}
 			if err != nil {
 				return err
 			}
-			csvWriter.Flush()
+
+			c.RowCount = c.RowCount + 1
+			fileRows++
 
 			// Convert from csv to gzip
 			// Writes from buffer to underlying file
 			if csvBuffer.Len() >= (c.GzipBatchPerGoroutine * c.GzipGoroutines) {
+				c.result.UncompressedBytes += int64(csvBuffer.Len())
 				_, err = zw.Write(csvBuffer.Bytes())
 				if err != nil {
 					return err
@@ -215,27 +391,6 @@ func (c *Converter) Write(w io.Writer) error {
 				// Reset buffer
 				csvBuffer.Reset()
 
-				// Upload partially created file to S3
-				// If size of the gzip file exceeds maxFileStorage
-				if c.S3Upload {
-					// GZIP writer to underline file.csv.gzip
-					gzipBuffer, ok := w.(*bytes.Buffer)
-					if !ok {
-						return fmt.Errorf("Expected buffer. Got %T", w)
-					}
-
-					if gzipBuffer.Len() >= c.UploadPartSize {
-						if c.partNumber == 10000 {
-							return fmt.Errorf("Number of parts cannot exceed 10000. Please increase UploadPartSize and try again.")
-						}
-
-						// Add to Queue
-						c.AddToQueue(gzipBuffer, false)
-
-						//Reset writer
-						gzipBuffer.Reset()
-					}
-				}
 			}
 		}
 	}
@@ -245,40 +400,49 @@ func (c *Converter) Write(w io.Writer) error {
 		return err
 	}
 
-	_, err = zw.Write(csvBuffer.Bytes())
+	err = c.finishOutput(rowWriter, zw, ew, csvBuffer)
 	if err != nil {
 		return err
 	}
-	err = zw.Close()
-	if err != nil {
-		return err
+
+	c.ChecksumSHA256 = hex.EncodeToString(fileHash.Sum(nil))
+
+	// Log the total number of rows processed.
+	c.writeLog(Info, fmt.Sprintf("Total sql rows processed: %v", c.RowCount))
+	if c.masker != nil {
+		c.masker.logSummary(c)
 	}
+	c.stopTimer()
+	return nil
+}
 
-	//Wipe the buffer
-	csvBuffer.Reset()
+// partWriter buffers the compressed output and adds a part to the
+// upload queue whenever the buffer exceeds UploadPartSize.
+type partWriter struct {
+	c   *Converter
+	buf *bytes.Buffer
+}
 
-	// Upload last part of the file to S3
-	if c.S3Upload {
-		if c.partNumber == 0 {
-			return nil
-		}
+func (p *partWriter) Write(b []byte) (int, error) {
+	n, err := p.buf.Write(b)
+	if err != nil {
+		return n, err
+	}
 
-		// GZIP writer to underline file.csv.gzip
-		gzipBuffer, ok := w.(*bytes.Buffer)
-		if !ok {
-			return fmt.Errorf("Expected buffer. Got %T", w)
+	// Upload partially created file to S3
+	// If size of the gzip file exceeds UploadPartSize
+	if p.buf.Len() >= p.c.UploadPartSize {
+		if p.c.partNumber == 10000 {
+			return n, fmt.Errorf("Number of parts cannot exceed 10000. Please increase UploadPartSize and try again.")
 		}
 
-		// Add to Queue for multipart upload
-		c.AddToQueue(gzipBuffer, true)
+		// Add to Queue
+		p.c.AddToQueue(p.buf, false)
 
 		//Reset writer
-		gzipBuffer.Reset()
+		p.buf.Reset()
 	}
-
-	// Log the total number of rows processed.
-	c.writeLog(Info, fmt.Sprintf("Total sql rows processed: %v", c.RowCount))
-	return nil
+	return n, nil
 }
 
 // AddToQueue sends obj over the upload queue.
@@ -292,10 +456,7 @@ func (c *Converter) AddToQueue(buf *bytes.Buffer, lastPart bool) {
 		if c.partNumber > 1 {
 			// Add part to queue
 			c.writeLog(Debug, fmt.Sprintf("Add part to queue: #%v", c.partNumber-1))
-			c.uploadQ <- &obj{
-				partNumber: c.partNumber - 1,
-				buf:        c.gzipBuf,
-			}
+			c.uploadQ <- c.newObj(c.partNumber-1, c.gzipBuf)
 		}
 
 		c.gzipBuf = make([]byte, buf.Len())
@@ -303,10 +464,7 @@ func (c *Converter) AddToQueue(buf *bytes.Buffer, lastPart bool) {
 		if lastPart {
 			// Add last part to queue
 			c.writeLog(Debug, fmt.Sprintf("Add part to queue: #%v", c.partNumber))
-			c.uploadQ <- &obj{
-				partNumber: c.partNumber,
-				buf:        c.gzipBuf,
-			}
+			c.uploadQ <- c.newObj(c.partNumber, c.gzipBuf)
 			c.gzipBuf = c.gzipBuf[:0]
 		}
 	} else {
@@ -315,28 +473,46 @@ func (c *Converter) AddToQueue(buf *bytes.Buffer, lastPart bool) {
 
 		// Add part to queue
 		c.writeLog(Debug, fmt.Sprintf("Add part to queue: #%v", c.partNumber-1))
-		c.uploadQ <- &obj{
-			partNumber: c.partNumber - 1,
-			buf:        c.gzipBuf,
-		}
+		c.uploadQ <- c.newObj(c.partNumber-1, c.gzipBuf)
 		c.gzipBuf = c.gzipBuf[:0]
 
 		c.partNumber--
 	}
 }
 
+// newObj creates an obj for the upload queue and records the
+// checksums of the part.
+func (c *Converter) newObj(partNumber int64, buf []byte) *obj {
+	checksum := NewPartChecksum(buf)
+	if c.partChecksums == nil {
+		c.partChecksums = make(map[int64]PartChecksum)
+	}
+	c.partChecksums[partNumber] = checksum
+
+	return &obj{
+		partNumber: partNumber,
+		buf:        buf,
+		checksum:   checksum,
+	}
+}
+
 // UploadPart listens to upload queue. Whenever an obj is received,
-// it is then uploaded to AWS.
-// Abort operation is called if any error is received.
+// it is then uploaded to the Sink (AWS S3 by default).
+// After an error, the writer is sent a quit signal and the remaining
+// parts are discarded. The error is returned once the queue is closed.
 func (c *Converter) UploadPart() (err error) {
-	mu := &sync.RWMutex{}
-	for s3obj := range c.uploadQ {
-		err = c.uploadPart(s3obj.partNumber, s3obj.buf, mu)
+	for part := range c.uploadQ {
 		if err != nil {
-			c.writeLog(Error, "Error occurred. Sending quit signal to writer.")
-			c.quit <- true
-			c.abortMultipartUpload()
-			return err
+			// Keep draining the queue so that the writer never blocks
+			continue
+		}
+		err = c.getSink().UploadPart(part.partNumber, part.buf, part.checksum)
+		if err != nil {
+			c.writeLog(Error, fmt.Sprintf("Upload of part #%v failed: %v. Sending quit signal to writer.", part.partNumber, err))
+			select {
+			case c.quit <- true:
+			default:
+			}
 		}
 	}
 	c.writeLog(Debug, "Received closed signal")
@@ -0,0 +1,94 @@
+package sqltocsvgzip
+
+import (
+	"fmt"
+	"io"
+)
+
+// DestinationPolicy decides what happens to a Tee export when a destination fails.
+type DestinationPolicy int
+
+const (
+	// FailAll aborts the whole export when the destination fails.
+	FailAll DestinationPolicy = iota
+	// BestEffort stops writing to the failed destination and carries on with the others.
+	BestEffort
+)
+
+// Destination is one of the outputs of a Tee export.
+type Destination struct {
+	Name   string
+	Writer io.Writer
+	Policy DestinationPolicy
+	Err    error // Set if writing to the destination failed
+}
+
+// Tee writes the csv.gzip to every destination in a single pass over the rows,
+// e.g. a local file for audit plus an http.ResponseWriter.
+// If S3Upload is set (see UploadConfig), the output is also uploaded to S3 like Upload does.
+// A failed S3 upload always fails the export. Without S3Upload,
+// at least one destination is required.
+//
+// Destinations are not closed by Tee. Check Destination.Err for best effort
+// destinations which failed along the way.
+func (c *Converter) Tee(destinations ...*Destination) (*ExportResult, error) {
+	if len(destinations) == 0 && !c.S3Upload {
+		return nil, fmt.Errorf("Tee requires at least one destination or S3Upload")
+	}
+	for _, d := range destinations {
+		if d == nil || d.Writer == nil {
+			return nil, fmt.Errorf("Tee destinations require a Writer")
+		}
+	}
+
+	if c.S3Upload {
+		return c.upload(destinations)
+	}
+
+	c.startTimer()
+	err := c.Write(newTeeWriter(c, destinations))
+	if err != nil {
+		return nil, err
+	}
+
+	c.stopTimer()
+	return c.Result(), nil
+}
+
+// teeWriter writes to every destination which has not failed yet.
+type teeWriter struct {
+	c            *Converter
+	destinations []*Destination
+}
+
+func newTeeWriter(c *Converter, destinations []*Destination) *teeWriter {
+	return &teeWriter{c: c, destinations: destinations}
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	active := 0
+	for _, d := range t.destinations {
+		if d.Err != nil {
+			continue
+		}
+
+		n, err := d.Writer.Write(p)
+		if err == nil && n != len(p) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			d.Err = err
+			if d.Policy == FailAll {
+				return n, fmt.Errorf("Destination %v failed: %v", d.Name, err)
+			}
+			t.c.writeLog(Warn, fmt.Sprintf("Destination %v failed, skipping it: %v", d.Name, err))
+			continue
+		}
+		active++
+	}
+
+	if active == 0 {
+		return 0, fmt.Errorf("All destinations failed")
+	}
+	return len(p), nil
+}
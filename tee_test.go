@@ -0,0 +1,134 @@
+package sqltocsvgzip
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// failingWriter fails once more than limit bytes have been written to it.
+type failingWriter struct {
+	limit   int
+	written int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if f.written+len(p) > f.limit {
+		return 0, fmt.Errorf("disk full")
+	}
+	f.written += len(p)
+	return len(p), nil
+}
+
+func TestTee(t *testing.T) {
+	var audit, response bytes.Buffer
+	c := WriteConfig(testRows(t, "people", "alice", "bob"))
+	c.LogLevel = Error
+
+	result, err := c.Tee(
+		&Destination{Name: "audit", Writer: &audit},
+		&Destination{Name: "response", Writer: &response, Policy: BestEffort},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := gunzipString(t, audit.Bytes()); got != "name\nalice\nbob\n" {
+		t.Fatalf("Unexpected output %q", got)
+	}
+	if !bytes.Equal(audit.Bytes(), response.Bytes()) {
+		t.Errorf("Destinations got different outputs")
+	}
+	sum := sha256.Sum256(audit.Bytes())
+	if result.RowCount != 2 || result.ChecksumSHA256 != hex.EncodeToString(sum[:]) || result.CompressedBytes != int64(audit.Len()) {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+}
+
+func TestTeeBestEffort(t *testing.T) {
+	var audit bytes.Buffer
+	response := &Destination{Name: "response", Writer: &failingWriter{}, Policy: BestEffort}
+	c := WriteConfig(testRows(t, "people", "alice", "bob"))
+	c.LogLevel = Error
+
+	_, err := c.Tee(&Destination{Name: "audit", Writer: &audit}, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Err == nil || !strings.Contains(response.Err.Error(), "disk full") {
+		t.Errorf("Expected the error of the failed destination, got %v", response.Err)
+	}
+	if got := gunzipString(t, audit.Bytes()); got != "name\nalice\nbob\n" {
+		t.Errorf("Unexpected output %q", got)
+	}
+}
+
+func TestTeeFailAll(t *testing.T) {
+	c := WriteConfig(testRows(t, "people", "alice", "bob"))
+	c.LogLevel = Error
+	audit := &Destination{Name: "audit", Writer: &failingWriter{limit: 10}}
+
+	_, err := c.Tee(&Destination{Name: "response", Writer: &bytes.Buffer{}, Policy: BestEffort}, audit)
+	if err == nil || !strings.Contains(err.Error(), "Destination audit failed: disk full") {
+		t.Errorf("Expected the audit destination to fail the export, got %v", err)
+	}
+	if audit.Err == nil {
+		t.Errorf("Expected Err to be set")
+	}
+}
+
+func TestTeeAllFailed(t *testing.T) {
+	c := WriteConfig(testRows(t, "people", "alice", "bob"))
+	c.LogLevel = Error
+
+	_, err := c.Tee(
+		&Destination{Name: "first", Writer: &failingWriter{}, Policy: BestEffort},
+		&Destination{Name: "second", Writer: &failingWriter{}, Policy: BestEffort},
+	)
+	if err == nil || !strings.Contains(err.Error(), "All destinations failed") {
+		t.Errorf("Expected all destinations to fail, got %v", err)
+	}
+}
+
+func TestTeeInvalidDestinations(t *testing.T) {
+	for _, destinations := range [][]*Destination{
+		nil,
+		{nil},
+		{{Name: "no writer"}},
+	} {
+		c := WriteConfig(testRows(t, "people", "alice"))
+		c.LogLevel = Error
+		_, err := c.Tee(destinations...)
+		if err == nil || strings.Contains(err.Error(), "All destinations failed") {
+			t.Errorf("%v destinations: expected an argument error, got %v", len(destinations), err)
+		}
+	}
+}
+
+func TestTeeUpload(t *testing.T) {
+	fake, server := newFakeS3(t)
+	var audit bytes.Buffer
+	c := newS3Converter(testRows(t, "people", "alice", "bob"), server)
+
+	result, err := c.Tee(&Destination{Name: "audit", Writer: &audit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fake.objects["/exports/people.csv.gz"], audit.Bytes()) {
+		t.Errorf("Uploaded object and audit file differ")
+	}
+	if result.Key != "people.csv.gz" || result.RowCount != 2 {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+
+	// A failed upload fails the export
+	fake.etag = `"0123456789abcdef0123456789abcdef"`
+	c = newS3Converter(testRows(t, "people", "alice", "bob"), server)
+	_, err = c.Tee(&Destination{Name: "audit", Writer: &bytes.Buffer{}, Policy: BestEffort})
+	if err == nil {
+		t.Errorf("Expected the upload to fail the export")
+	}
+}
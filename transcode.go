@@ -0,0 +1,115 @@
+package sqltocsvgzip
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
+)
+
+// InvalidCharPolicy tells what to do with characters OutputEncoding
+// cannot represent and with invalid UTF-8 coming from the database.
+type InvalidCharPolicy int
+
+const (
+	// InvalidCharError fails the export.
+	InvalidCharError InvalidCharPolicy = iota
+	// InvalidCharReplace replaces invalid UTF-8 with U+FFFD and characters
+	// the encoding cannot represent with its substitute character.
+	InvalidCharReplace
+	// InvalidCharSkipRow skips the row, counted in ExportResult.SkippedRows.
+	InvalidCharSkipRow
+)
+
+// errSkipRow is returned by rowWriters for rows left out of the output.
+var errSkipRow = errors.New("Row skipped")
+
+// transcoder applies InvalidChars to the rows, and converts the encoded
+// rows from UTF-8 to OutputEncoding if set.
+type transcoder struct {
+	t      transform.Transformer // nil for UTF-8 output
+	policy InvalidCharPolicy
+	out    []byte
+}
+
+func (c *Converter) newTranscoder() *transcoder {
+	t := &transcoder{policy: c.InvalidChars}
+	if c.OutputEncoding == nil {
+		return t
+	}
+	encoder := c.OutputEncoding.NewEncoder()
+	if c.InvalidChars == InvalidCharReplace {
+		encoder = encoding.ReplaceUnsupported(encoder)
+	}
+	t.t = encoder
+	t.out = make([]byte, 4096)
+	return t
+}
+
+// encodes reports whether the rows are converted to OutputEncoding.
+func (t *transcoder) encodes() bool {
+	return t.t != nil
+}
+
+// checkUTF8 applies the policy to invalid UTF-8 in the values of a row.
+// columns names the values in errors. Values flagged in binary,
+// written hex encoded, are not checked.
+func (t *transcoder) checkUTF8(row []string, columns []string, binary []bool) ([]string, error) {
+	var valid []string
+	for i, value := range row {
+		if isNull(binary, i) || utf8.ValidString(value) {
+			continue
+		}
+		switch t.policy {
+		case InvalidCharReplace:
+			if valid == nil {
+				valid = append([]string(nil), row...)
+			}
+			valid[i] = strings.ToValidUTF8(value, string(utf8.RuneError))
+		case InvalidCharSkipRow:
+			return nil, errSkipRow
+		default:
+			column := fmt.Sprint(i + 1)
+			if i < len(columns) {
+				column = columns[i]
+			}
+			return nil, fmt.Errorf("Invalid UTF-8 in column %v", column)
+		}
+	}
+	if valid == nil {
+		return row, nil
+	}
+	return valid, nil
+}
+
+// encode returns src in OutputEncoding, or src as is for UTF-8 output.
+// The result is valid until the next call. The state of the encoder,
+// e.g. whether the UTF-16 byte order mark is written, is kept from row to row.
+func (t *transcoder) encode(src []byte) ([]byte, error) {
+	if t.t == nil {
+		return src, nil
+	}
+	n := 0
+	for {
+		nDst, nSrc, err := t.t.Transform(t.out[n:], src, true)
+		n += nDst
+		src = src[nSrc:]
+		switch err {
+		case nil:
+			return t.out[:n], nil
+		case transform.ErrShortDst:
+			out := make([]byte, 2*len(t.out)+len(src))
+			copy(out, t.out[:n])
+			t.out = out
+		default:
+			if t.policy == InvalidCharSkipRow {
+				return nil, errSkipRow
+			}
+			r, _ := utf8.DecodeRune(src)
+			return nil, fmt.Errorf("Character %q cannot be encoded: %v", r, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package sqltocsvgzip
+
+import (
+	"bytes"
+	"database/sql"
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+func TestInvalidCharsUTF8Output(t *testing.T) {
+	tests := []struct {
+		policy   InvalidCharPolicy
+		expected string
+		skipped  int64
+	}{
+		{InvalidCharError, "", 0},
+		{InvalidCharReplace, "name\nok\nbad�\n", 0},
+		{InvalidCharSkipRow, "name\nok\n", 1},
+	}
+	for _, test := range tests {
+		c := WriteConfig(testRows(t, "people", "ok", "bad\xff"))
+		c.LogLevel = Error
+		c.InvalidChars = test.policy
+		var buf bytes.Buffer
+		err := c.Write(&buf)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("Policy %v: expected an error for invalid UTF-8", test.policy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := gunzipString(t, buf.Bytes()); got != test.expected {
+			t.Errorf("Policy %v: got %q, expected %q", test.policy, got, test.expected)
+		}
+		if c.Result().SkippedRows != test.skipped {
+			t.Errorf("Policy %v: skipped %v rows, expected %v", test.policy, c.Result().SkippedRows, test.skipped)
+		}
+	}
+}
+
+func TestInvalidCharsBinaryInsert(t *testing.T) {
+	db, err := sql.Open("test", "binaryinsert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, db, "WIPE")
+	exec(t, db, "CREATE|files|data=blob")
+	exec(t, db, "INSERT|files|data=?", []byte{0xff, 0x00})
+	rows, err := db.Query("SELECT|files|data|")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Binary columns are hex literals, their bytes are not checked
+	c := WriteConfig(rows)
+	c.LogLevel = Error
+	c.OutputFormat = SQLInsert
+	c.SchemaTable = "files"
+	var buf bytes.Buffer
+	err = c.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `INSERT INTO "files" ("data") VALUES` + "\n" + `('\xff00');` + "\n"
+	if got := gunzipString(t, buf.Bytes()); got != expected {
+		t.Errorf("Got %q, expected %q", got, expected)
+	}
+}
+
+func TestOutputEncodingXLSX(t *testing.T) {
+	c := WriteConfig(testRows(t, "people", "alice"))
+	c.LogLevel = Error
+	c.OutputFormat = XLSX
+	c.OutputEncoding = charmap.Windows1252
+	err := c.Write(&bytes.Buffer{})
+	if err == nil {
+		t.Error("Expected an error for OutputEncoding with XLSX")
+	}
+}
@@ -0,0 +1,269 @@
+package sqltocsvgzip
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// TransformStep is a single step of a Pipeline.
+// It is called once with the column names produced by the previous step
+// and returns the column names it produces, together with the
+// CsvPreProcessorFunc to apply to every row.
+type TransformStep func(columnNames []string) (outputColumns []string, processor CsvPreProcessorFunc, err error)
+
+// Pipeline chains multiple TransformSteps. Each row is passed through
+// the steps in order until one of them skips it.
+type Pipeline struct {
+	steps      []TransformStep
+	processors []CsvPreProcessorFunc
+	columns    [][]string
+	sources    [][]int // Input position of every output column of each step, -1 for new columns
+}
+
+// NewPipeline returns a Pipeline running the given steps in order.
+func NewPipeline(steps ...TransformStep) *Pipeline {
+	return &Pipeline{steps: steps}
+}
+
+// Add appends steps to the end of the pipeline.
+func (p *Pipeline) Add(steps ...TransformStep) *Pipeline {
+	p.steps = append(p.steps, steps...)
+	return p
+}
+
+// SetPipeline lets you specify a Pipeline for this conversion.
+// It runs after the CsvPreProcessorFunc and its output columns
+// are used as CSV headers.
+func (c *Converter) SetPipeline(pipeline *Pipeline) {
+	c.pipeline = pipeline
+}
+
+// bind resolves every step against the column names produced by the
+// previous step and returns the column names of the last step.
+func (p *Pipeline) bind(columnNames []string) ([]string, error) {
+	p.processors = make([]CsvPreProcessorFunc, len(p.steps))
+	p.columns = make([][]string, len(p.steps))
+	p.sources = make([][]int, len(p.steps))
+
+	for i, step := range p.steps {
+		outputColumns, processor, err := step(columnNames)
+		if err != nil {
+			return nil, err
+		}
+		p.columns[i] = columnNames
+		p.processors[i] = processor
+		p.sources[i] = sourceIndexes(columnNames, outputColumns)
+		columnNames = outputColumns
+	}
+
+	return columnNames, nil
+}
+
+// process runs the row through every bound step. nulls flags the NULL
+// fields of the row and follows the columns from step to step.
+func (p *Pipeline) process(row []string, nulls []bool, nullString string) (bool, []string, []bool) {
+	writeRow := true
+	for i, processor := range p.processors {
+		writeRow, row = processor(row, p.columns[i])
+		if !writeRow {
+			return false, nil, nil
+		}
+		nulls = trackNulls(row, nulls, p.sources[i], nullString)
+	}
+	return writeRow, row, nulls
+}
+
+// sourceIndexes returns the position in columnNames of every output column:
+// the column with the same name, or the one at the same position if the
+// step renamed columns without adding any.
+func sourceIndexes(columnNames []string, outputColumns []string) []int {
+	positions := make(map[string]int, len(columnNames))
+	for i, name := range columnNames {
+		positions[name] = i
+	}
+
+	sources := make([]int, len(outputColumns))
+	for j, name := range outputColumns {
+		index, ok := positions[name]
+		switch {
+		case j < len(columnNames) && columnNames[j] == name:
+			index = j
+		case !ok && len(outputColumns) == len(columnNames):
+			index = j
+		case !ok:
+			index = -1
+		}
+		sources[j] = index
+	}
+	return sources
+}
+
+// trackNulls returns the NULL flags of row, the output of a processor.
+// A field stays NULL if it comes from a NULL field, at sources[j] or at the
+// same position if sources is nil, and its value is still nullString.
+func trackNulls(row []string, nulls []bool, sources []int, nullString string) []bool {
+	if nulls == nil {
+		return nil
+	}
+
+	var tracked []bool
+	for j, value := range row {
+		index := j
+		if sources != nil {
+			index = -1
+			if j < len(sources) {
+				index = sources[j]
+			}
+		}
+		if index >= 0 && isNull(nulls, index) && value == nullString {
+			if tracked == nil {
+				tracked = make([]bool, len(row))
+			}
+			tracked[j] = true
+		}
+	}
+	return tracked
+}
+
+// Process wraps a CsvPreProcessorFunc into a TransformStep
+// which does not change the columns.
+func Process(processor CsvPreProcessorFunc) TransformStep {
+	return func(columnNames []string) ([]string, CsvPreProcessorFunc, error) {
+		return columnNames, processor, nil
+	}
+}
+
+// Select projects and reorders the columns. Columns not listed are dropped.
+func Select(columns ...string) TransformStep {
+	return func(columnNames []string) ([]string, CsvPreProcessorFunc, error) {
+		indexes, err := columnIndexes(columnNames, columns)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return columns, func(row []string, _ []string) (bool, []string) {
+			selected := make([]string, len(indexes))
+			for i, index := range indexes {
+				if index < len(row) {
+					selected[i] = row[index]
+				}
+			}
+			return true, selected
+		}, nil
+	}
+}
+
+// Rename renames columns from the keys of names to their values.
+// Columns not listed keep their name.
+func Rename(names map[string]string) TransformStep {
+	return func(columnNames []string) ([]string, CsvPreProcessorFunc, error) {
+		renamed := make([]string, len(columnNames))
+		for i, name := range columnNames {
+			if newName, ok := names[name]; ok {
+				name = newName
+			}
+			renamed[i] = name
+		}
+
+		return renamed, func(row []string, _ []string) (bool, []string) {
+			return true, row
+		}, nil
+	}
+}
+
+// Constant appends a column with the same value on every row.
+func Constant(column, value string) TransformStep {
+	return func(columnNames []string) ([]string, CsvPreProcessorFunc, error) {
+		outputColumns := append(append([]string{}, columnNames...), column)
+
+		return outputColumns, func(row []string, _ []string) (bool, []string) {
+			return true, append(row, value)
+		}, nil
+	}
+}
+
+// RegexReplace replaces matches of re with replacement in the given columns.
+// replacement can reference submatches as in regexp.ReplaceAllString.
+// If no columns are given, all columns are processed.
+func RegexReplace(re *regexp.Regexp, replacement string, columns ...string) TransformStep {
+	return mapColumns(func(value string) string {
+		return re.ReplaceAllString(value, replacement)
+	}, columns)
+}
+
+// TrimSpace removes leading and trailing white space from the given columns.
+// If no columns are given, all columns are processed.
+func TrimSpace(columns ...string) TransformStep {
+	return mapColumns(strings.TrimSpace, columns)
+}
+
+// ToUpper upper cases the given columns.
+// If no columns are given, all columns are processed.
+func ToUpper(columns ...string) TransformStep {
+	return mapColumns(strings.ToUpper, columns)
+}
+
+// ToLower lower cases the given columns.
+// If no columns are given, all columns are processed.
+func ToLower(columns ...string) TransformStep {
+	return mapColumns(strings.ToLower, columns)
+}
+
+// MapValues replaces values found in mapping in the given columns.
+// Other values are left unchanged. If no columns are given, all columns are processed.
+func MapValues(mapping map[string]string, columns ...string) TransformStep {
+	return mapColumns(func(value string) string {
+		if mapped, ok := mapping[value]; ok {
+			return mapped
+		}
+		return value
+	}, columns)
+}
+
+// mapColumns returns a TransformStep applying fn to the given columns,
+// or to all columns if none are given.
+func mapColumns(fn func(string) string, columns []string) TransformStep {
+	return func(columnNames []string) ([]string, CsvPreProcessorFunc, error) {
+		var indexes []int
+		if len(columns) == 0 {
+			indexes = make([]int, len(columnNames))
+			for i := range columnNames {
+				indexes[i] = i
+			}
+		} else {
+			var err error
+			indexes, err = columnIndexes(columnNames, columns)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		return columnNames, func(row []string, _ []string) (bool, []string) {
+			for _, index := range indexes {
+				if index < len(row) {
+					row[index] = fn(row[index])
+				}
+			}
+			return true, row
+		}, nil
+	}
+}
+
+// columnIndexes returns the position of each of columns in columnNames.
+func columnIndexes(columnNames []string, columns []string) ([]int, error) {
+	positions := make(map[string]int, len(columnNames))
+	for i, name := range columnNames {
+		positions[name] = i
+	}
+
+	indexes := make([]int, len(columns))
+	for i, column := range columns {
+		index, ok := positions[column]
+		if !ok {
+			return nil, fmt.Errorf("Unknown column: %v", column)
+		}
+		indexes[i] = index
+	}
+	return indexes, nil
+}
@@ -0,0 +1,99 @@
+package sqltocsvgzip
+
+import (
+	"bytes"
+	"database/sql"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func newPeopleRows(t *testing.T) *sql.Rows {
+	db, err := sql.Open("test", "pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, db, "WIPE")
+	exec(t, db, "CREATE|people|name=string,nick=nullstring,email=string")
+	exec(t, db, "INSERT|people|name=?,nick=?,email=?", " alice ", "al", "alice@example.com")
+	exec(t, db, "INSERT|people|name=?,nick=?,email=?", "bob", nil, "bob@example.org")
+	exec(t, db, "INSERT|people|name=?,nick=?,email=?", "test", "NULL", "test@example.com")
+	exec(t, db, "INSERT|people|name=?,nick=?,email=?", "carol", "", "carol@example.com")
+	rows, err := db.Query("SELECT|people|name,nick,email|")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestPipeline(t *testing.T) {
+	c := WriteConfig(newPeopleRows(t))
+	c.LogLevel = Error
+	c.NullString = "NULL"
+	c.SetRowPreProcessor(func(row []string, columns []string) (bool, []string) {
+		row[0] = strings.TrimSuffix(row[0], " ")
+		return true, row
+	})
+	c.SetPipeline(NewPipeline(
+		TrimSpace("name"),
+		Process(func(row []string, columns []string) (bool, []string) {
+			return row[0] != "test", row
+		}),
+		Rename(map[string]string{"email": "domain"}),
+		RegexReplace(regexp.MustCompile(`^.*@`), "", "domain"),
+		Select("domain", "name", "nick"),
+	).Add(
+		ToUpper("name"),
+		MapValues(map[string]string{"example.org": "org"}, "domain"),
+		Constant("source", "crm"),
+	))
+	var buf bytes.Buffer
+	err := c.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// bob's nick is still NULL after the steps, carol's stays an empty string
+	expected := "domain,name,nick,source\n" +
+		"example.com,ALICE,al,crm\n" +
+		"org,BOB,NULL,crm\n" +
+		"example.com,CAROL,,crm\n"
+	if got := gunzipString(t, buf.Bytes()); got != expected {
+		t.Errorf("got      %q\nexpected %q", got, expected)
+	}
+	if result := c.Result(); result.RowCount != 3 || result.SkippedRows != 1 {
+		t.Errorf("RowCount %v and SkippedRows %v, expected 3 and 1", result.RowCount, result.SkippedRows)
+	}
+}
+
+// A step changing a NULL field makes it a value, quoted if equal to NullString.
+func TestPipelineNulls(t *testing.T) {
+	c := WriteConfig(newPeopleRows(t))
+	c.LogLevel = Error
+	c.NullString = "NULL"
+	c.SetPipeline(NewPipeline(
+		Select("nick"),
+		ToLower(),
+	))
+	var buf bytes.Buffer
+	err := c.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "nick\nal\nnull\nnull\n\"\"\n"
+	if got := gunzipString(t, buf.Bytes()); got != expected {
+		t.Errorf("got %q, expected %q", got, expected)
+	}
+}
+
+func TestPipelineUnknownColumn(t *testing.T) {
+	for _, step := range []TransformStep{Select("missing"), ToUpper("missing")} {
+		c := WriteConfig(newPeopleRows(t))
+		c.LogLevel = Error
+		c.SetPipeline(NewPipeline(step))
+		err := c.Write(&bytes.Buffer{})
+		if err == nil || !strings.Contains(err.Error(), "Unknown column: missing") {
+			t.Errorf("Expected an unknown column error, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package sqltocsvgzip
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// verifyUpload reads the uploaded object back and compares its checksum
+// and row count with the ones of the export.
+// Only AWS S3 is supported.
+func (c *Converter) verifyUpload(sink Sink, output *UploadOutput) error {
+	if _, ok := sink.(*s3Sink); !ok {
+		c.writeLog(Warn, "Only uploads to AWS S3 can be verified. Skipping verification.")
+		return nil
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(output.Bucket),
+		Key:    aws.String(output.Key),
+	}
+	if output.VersionID != "" {
+		input.VersionId = aws.String(output.VersionID)
+	}
+	object, err := c.s3Svc.GetObject(input)
+	if err != nil {
+		return fmt.Errorf("Could not read back the uploaded object: %v", err)
+	}
+	defer object.Body.Close()
+
+	err = c.verifyObject(object.Body)
+	if err != nil && c.S3VerifyDelete {
+		c.writeLog(Error, "Verification failed, deleting the uploaded object: "+output.Key)
+		deleteInput := &s3.DeleteObjectInput{
+			Bucket:    input.Bucket,
+			Key:       input.Key,
+			VersionId: input.VersionId,
+		}
+		_, deleteErr := c.s3Svc.DeleteObject(deleteInput)
+		if deleteErr != nil {
+			return fmt.Errorf("%v. Could not delete the object: %v", err, deleteErr)
+		}
+	}
+	return err
+}
+
+// verifyObject decompresses and counts the rows of the object.
+// Only the checksum of encrypted and non-CSV objects is verified.
+func (c *Converter) verifyObject(body io.Reader) error {
+	hash := sha256.New()
+	body = io.TeeReader(body, hash)
+
+	var rowCount int64
+	countRows := c.encrypt == nil && c.OutputFormat == CSV
+	if countRows {
+		reader, err := NewReader(body, &ReaderConfig{
+			Columns:          c.result.Columns,
+			NoHeader:         !c.WriteHeaders,
+			Delimiter:        c.Delimiter,
+			NullString:       c.NullString,
+			Quoting:          c.Quoting,
+			QuoteChar:        c.QuoteChar,
+			EscapeChar:       c.EscapeChar,
+			RecordTerminator: c.RecordTerminator,
+			Encoding:         c.OutputEncoding,
+		})
+		if err != nil {
+			return fmt.Errorf("Verification failed: %v", err)
+		}
+		for {
+			_, err = reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				reader.Close()
+				return fmt.Errorf("Verification failed: %v", err)
+			}
+		}
+		rowCount = reader.RowCount()
+		reader.Close()
+	} else {
+		c.writeLog(Info, "Verifying the checksum only, rows of encrypted and non-CSV objects are not counted.")
+	}
+
+	// Hash what the reader left
+	_, err := io.Copy(ioutil.Discard, body)
+	if err != nil {
+		return fmt.Errorf("Verification failed: %v", err)
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if countRows && rowCount != c.RowCount {
+		return fmt.Errorf("Verification failed: the object has %v rows, expected %v", rowCount, c.RowCount)
+	}
+	if checksum != c.ChecksumSHA256 {
+		return fmt.Errorf("Verification failed: SHA-256 of the object is %v, expected %v", checksum, c.ChecksumSHA256)
+	}
+
+	c.result.Verified = true
+	c.writeLog(Info, "Verified the uploaded object: "+checksum)
+	return nil
+}
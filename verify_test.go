@@ -0,0 +1,92 @@
+package sqltocsvgzip
+
+import (
+	"compress/flate"
+	"database/sql"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/unicode"
+)
+
+func TestS3Verify(t *testing.T) {
+	tests := []struct {
+		name  string
+		rows  func(t *testing.T) *sql.Rows
+		setup func(c *Converter)
+	}{
+		{"PutObject", func(t *testing.T) *sql.Rows { return testRows(t, "people", "alice", "", "bob") }, func(c *Converter) {}},
+		{"Multipart", func(t *testing.T) *sql.Rows { return largeRows(t, "people", 11) }, func(c *Converter) {
+			c.CompressionLevel = flate.NoCompression
+			c.UploadPartSize = minFileSize
+		}},
+		{"Dialect and encoding", func(t *testing.T) *sql.Rows { return testRows(t, "people", "a\tb", "line\nbreak", `\N`) }, func(c *Converter) {
+			c.SetTSV()
+			c.NullString = `\N`
+			c.OutputEncoding = unicode.UTF16(unicode.LittleEndian, unicode.UseBOM)
+		}},
+	}
+	for _, test := range tests {
+		fake, server := newFakeS3(t)
+		c := newS3Converter(test.rows(t), server)
+		c.S3Verify = true
+		test.setup(c)
+
+		result, err := c.Upload()
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if !result.Verified {
+			t.Errorf("%v: expected the upload to be verified", test.name)
+		}
+		// The uploaded version is read back
+		if len(fake.getVersions) != 1 || fake.getVersions[0] != fake.versions["/exports/people.csv.gz"] {
+			t.Errorf("%v: read back versions %v, expected %v", test.name, fake.getVersions, fake.versions["/exports/people.csv.gz"])
+		}
+		if len(fake.deleted) != 0 {
+			t.Errorf("%v: deleted %v", test.name, fake.deleted)
+		}
+	}
+}
+
+func TestS3VerifyCorrupted(t *testing.T) {
+	for _, verifyDelete := range []bool{false, true} {
+		fake, server := newFakeS3(t)
+		fake.corruptGet = true
+		c := newS3Converter(testRows(t, "people", "alice", "bob"), server)
+		c.S3Verify = true
+		c.S3VerifyDelete = verifyDelete
+
+		_, err := c.Upload()
+		if err == nil || !strings.Contains(err.Error(), "Verification failed") {
+			t.Fatalf("S3VerifyDelete %v: expected a verification error, got %v", verifyDelete, err)
+		}
+		_, exists := fake.objects["/exports/people.csv.gz"]
+		if verifyDelete {
+			if exists || len(fake.deleted) != 1 || fake.deleted[0] != "/exports/people.csv.gz" {
+				t.Errorf("Expected the object to be deleted, deleted %v", fake.deleted)
+			}
+		} else if !exists || len(fake.deleted) != 0 {
+			t.Errorf("Expected the object to be kept, deleted %v", fake.deleted)
+		}
+	}
+}
+
+func TestS3VerifySkipsOtherSinks(t *testing.T) {
+	c := UploadConfig(testRows(t, "people", "alice"))
+	c.LogLevel = Error
+	c.S3Verify = true
+	sink := &memorySink{}
+	c.SetSink(sink)
+
+	result, err := c.Upload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Verified {
+		t.Error("Expected the upload not to be verified")
+	}
+	if gunzipString(t, sink.object) != "name\nalice\n" {
+		t.Errorf("Unexpected object %q", gunzipString(t, sink.object))
+	}
+}
@@ -0,0 +1,344 @@
+package sqltocsvgzip
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// Excel limits
+	xlsxMaxRows       = 1048576
+	xlsxMaxCellLength = 32767
+	xlsxMaxDigits     = 15
+
+	// Time values are written as text, then parsed back into Excel dates
+	xlsxTimeFormat = time.RFC3339Nano
+
+	xlsxHeader = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n"
+	xlsxMain   = "http://schemas.openxmlformats.org/spreadsheetml/2006/main"
+	xlsxRels   = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+)
+
+// Indexes of cellXfs in xlsxStyles
+const (
+	xlsxStyleBold = iota + 1
+	xlsxStyleDate
+	xlsxStyleTimestamp
+	xlsxStyleTime
+)
+
+const xlsxStyles = xlsxHeader + `<styleSheet xmlns="` + xlsxMain + `">` +
+	`<numFmts count="2"><numFmt numFmtId="164" formatCode="yyyy-mm-dd"/><numFmt numFmtId="165" formatCode="yyyy-mm-dd hh:mm:ss"/></numFmts>` +
+	`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+	`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+	`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+	`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+	`<cellXfs count="5">` +
+	`<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+	`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>` +
+	`<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="165" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="21" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`</cellXfs>` +
+	`<cellStyles count="1"><cellStyle name="Normal" xfId="0" builtinId="0"/></cellStyles>` +
+	`</styleSheet>`
+
+// Layouts tried to parse time values, TimeFormat first
+var xlsxTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05 -0700 MST",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	"15:04:05",
+}
+
+var (
+	excelEpoch      = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	excelFirstMarch = time.Date(1900, 3, 1, 0, 0, 0, 0, time.UTC) // Excel wrongly thinks 1900 is a leap year
+)
+
+// xlsxWriter streams the rows into the worksheets of an XLSX workbook.
+// A new worksheet, with the header row, is started every xlsxMaxRows rows.
+type xlsxWriter struct {
+	c         *Converter
+	zw        *zip.Writer
+	sheet     io.Writer
+	sheets    int
+	rows      int // Rows of the current worksheet
+	header    []string
+	types     []string // Logical type of every column
+	refs      []string // Column letters
+	row       bytes.Buffer
+	truncated bool
+}
+
+func (c *Converter) newXLSXWriter(w io.Writer) *xlsxWriter {
+	zw := zip.NewWriter(w)
+	level := c.CompressionLevel
+	zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, level)
+	})
+
+	x := &xlsxWriter{c: c, zw: zw}
+	if c.result.Schema != nil {
+		for _, column := range c.result.Schema.Columns {
+			x.types = append(x.types, column.Type)
+		}
+	}
+	return x
+}
+
+func (x *xlsxWriter) writeHeader(columns []string) error {
+	x.header = columns
+	return x.nextSheet()
+}
+
+func (x *xlsxWriter) writeRow(row []string, nulls []bool) error {
+	if x.sheet == nil || x.rows == xlsxMaxRows {
+		err := x.nextSheet()
+		if err != nil {
+			return err
+		}
+	}
+	return x.writeSheetRow(row, nulls, false)
+}
+
+// nextSheet closes the current worksheet, if any, and starts a new one.
+func (x *xlsxWriter) nextSheet() error {
+	if x.sheet != nil {
+		_, err := io.WriteString(x.sheet, `</sheetData></worksheet>`)
+		if err != nil {
+			return err
+		}
+		x.c.writeLog(Info, fmt.Sprintf("Worksheet %v is full, starting a new one.", x.sheets))
+	}
+
+	x.sheets++
+	sheet, err := x.zw.Create(fmt.Sprintf("xl/worksheets/sheet%v.xml", x.sheets))
+	if err != nil {
+		return err
+	}
+	x.sheet = sheet
+	x.rows = 0
+
+	_, err = io.WriteString(x.sheet, xlsxHeader+`<worksheet xmlns="`+xlsxMain+`"><sheetData>`)
+	if err != nil {
+		return err
+	}
+	if x.header != nil {
+		return x.writeSheetRow(x.header, nil, true)
+	}
+	return nil
+}
+
+func (x *xlsxWriter) writeSheetRow(row []string, nulls []bool, header bool) error {
+	x.rows++
+	x.row.Reset()
+	x.row.WriteString(`<row r="` + strconv.Itoa(x.rows) + `">`)
+	for i, value := range row {
+		for len(x.refs) <= i {
+			x.refs = append(x.refs, xlsxColumn(len(x.refs)))
+		}
+		ref := x.refs[i] + strconv.Itoa(x.rows)
+
+		if header {
+			x.writeString(ref, value, xlsxStyleBold)
+			continue
+		}
+		// Leave NULL and empty cells out
+		if value == "" || isNull(nulls, i) {
+			continue
+		}
+		columnType := TypeString
+		if i < len(x.types) {
+			columnType = x.types[i]
+		}
+		x.writeCell(ref, value, columnType)
+	}
+	x.row.WriteString(`</row>`)
+
+	_, err := x.sheet.Write(x.row.Bytes())
+	return err
+}
+
+// writeCell writes a number, boolean or date cell if value can be one,
+// a text cell otherwise.
+func (x *xlsxWriter) writeCell(ref, value, columnType string) {
+	switch columnType {
+	case TypeInteger, TypeDecimal, TypeFloat:
+		if isExcelNumber(value) {
+			x.row.WriteString(`<c r="` + ref + `"><v>` + value + `</v></c>`)
+			return
+		}
+	case TypeBoolean:
+		if b, err := strconv.ParseBool(value); err == nil {
+			v := "0"
+			if b {
+				v = "1"
+			}
+			x.row.WriteString(`<c r="` + ref + `" t="b"><v>` + v + `</v></c>`)
+			return
+		}
+	case TypeDate, TypeTimestamp, TypeTime:
+		if serial, ok := x.excelDate(value, columnType); ok {
+			style := xlsxStyleTimestamp
+			if columnType == TypeDate {
+				style = xlsxStyleDate
+			} else if columnType == TypeTime {
+				style = xlsxStyleTime
+			}
+			x.row.WriteString(`<c r="` + ref + `" s="` + strconv.Itoa(style) + `"><v>` +
+				strconv.FormatFloat(serial, 'f', -1, 64) + `</v></c>`)
+			return
+		}
+	}
+	x.writeString(ref, value, 0)
+}
+
+func (x *xlsxWriter) writeString(ref, value string, style int) {
+	if utf8.RuneCountInString(value) > xlsxMaxCellLength {
+		value = string([]rune(value)[:xlsxMaxCellLength])
+		if !x.truncated {
+			x.truncated = true
+			x.c.writeLog(Warn, fmt.Sprintf("Truncating values longer than %v characters, the maximum of Excel.", xlsxMaxCellLength))
+		}
+	}
+
+	x.row.WriteString(`<c r="` + ref + `" t="inlineStr"`)
+	if style > 0 {
+		x.row.WriteString(` s="` + strconv.Itoa(style) + `"`)
+	}
+	x.row.WriteString(`><is><t xml:space="preserve">`)
+	xml.EscapeText(&x.row, []byte(value))
+	x.row.WriteString(`</t></is></c>`)
+}
+
+// excelDate parses a time value into an Excel serial date:
+// days since 1899-12-30, the time of day being the fraction.
+func (x *xlsxWriter) excelDate(value, columnType string) (float64, bool) {
+	var t time.Time
+	var err error
+	for i := -1; i < len(xlsxTimeLayouts); i++ {
+		layout := x.c.timeFormat
+		if i >= 0 {
+			layout = xlsxTimeLayouts[i]
+		}
+		t, err = time.Parse(layout, value)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return 0, false
+	}
+
+	clock := float64(t.Hour()*3600+t.Minute()*60+t.Second())/86400 + float64(t.Nanosecond())/86400e9
+	if columnType == TypeTime {
+		return clock, true
+	}
+
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if day.Before(excelFirstMarch) || t.Year() > 9999 {
+		return 0, false
+	}
+	days := float64((day.Unix() - excelEpoch.Unix()) / 86400)
+	if columnType == TypeDate {
+		return days, true
+	}
+	return days + clock, true
+}
+
+// close writes the last worksheet and the workbook parts.
+func (x *xlsxWriter) close() error {
+	if x.sheet == nil {
+		err := x.nextSheet()
+		if err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(x.sheet, `</sheetData></worksheet>`)
+	if err != nil {
+		return err
+	}
+
+	var contentTypes, workbook, workbookRels bytes.Buffer
+	contentTypes.WriteString(xlsxHeader + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`)
+	workbook.WriteString(xlsxHeader + `<workbook xmlns="` + xlsxMain + `" xmlns:r="` + xlsxRels + `"><sheets>`)
+	workbookRels.WriteString(xlsxHeader + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	for i := 1; i <= x.sheets; i++ {
+		contentTypes.WriteString(fmt.Sprintf(`<Override PartName="/xl/worksheets/sheet%v.xml" `+
+			`ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, i))
+		workbook.WriteString(fmt.Sprintf(`<sheet name="Sheet%v" sheetId="%v" r:id="rId%v"/>`, i, i, i))
+		workbookRels.WriteString(fmt.Sprintf(`<Relationship Id="rId%v" `+
+			`Type="`+xlsxRels+`/worksheet" Target="worksheets/sheet%v.xml"/>`, i, i))
+	}
+	contentTypes.WriteString(`</Types>`)
+	workbook.WriteString(`</sheets></workbook>`)
+	workbookRels.WriteString(fmt.Sprintf(`<Relationship Id="rId%v" Type="`+xlsxRels+`/styles" Target="styles.xml"/>`, x.sheets+1))
+	workbookRels.WriteString(`</Relationships>`)
+
+	parts := []struct {
+		name    string
+		content []byte
+	}{
+		{"[Content_Types].xml", contentTypes.Bytes()},
+		{"_rels/.rels", []byte(xlsxHeader + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="` + xlsxRels + `/officeDocument" Target="xl/workbook.xml"/></Relationships>`)},
+		{"xl/workbook.xml", workbook.Bytes()},
+		{"xl/_rels/workbook.xml.rels", workbookRels.Bytes()},
+		{"xl/styles.xml", []byte(xlsxStyles)},
+	}
+	for _, part := range parts {
+		w, err := x.zw.Create(part.name)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(part.content)
+		if err != nil {
+			return err
+		}
+	}
+	return x.zw.Close()
+}
+
+// xlsxColumn returns the letters of the column, e.g. 0 is A and 27 is AB.
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// isExcelNumber reports whether value can be stored as an Excel number
+// without losing precision, Excel keeping 15 significant digits.
+func isExcelNumber(value string) bool {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return false
+	}
+	digits := 0
+	for _, r := range value {
+		if r == 'e' || r == 'E' {
+			break
+		}
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+	return digits <= xlsxMaxDigits
+}
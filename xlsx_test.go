@@ -0,0 +1,59 @@
+package sqltocsvgzip
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestXLSXTimeFormat(t *testing.T) {
+	db, err := sql.Open("test", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, db, "WIPE")
+	exec(t, db, "CREATE|events|at=datetime")
+	exec(t, db, "INSERT|events|at=?", time.Date(2021, 10, 4, 10, 30, 0, 0, time.UTC))
+	rows, err := db.Query("SELECT|events|at|")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := WriteConfig(rows)
+	c.LogLevel = Error
+	c.OutputFormat = XLSX
+	var buf bytes.Buffer
+	err = c.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.TimeFormat != "" {
+		t.Errorf("TimeFormat was changed to %q", c.TimeFormat)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		if f.Name != "xl/worksheets/sheet1.xml" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sheet, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		// Formatted as RFC 3339, then parsed back into an Excel date
+		if !strings.Contains(string(sheet), "<v>44473.4375</v>") {
+			t.Errorf("Time is not written as an Excel date: %s", sheet)
+		}
+		return
+	}
+	t.Fatal("sheet1.xml is missing")
+}